@@ -0,0 +1,118 @@
+// Command admin grants and revokes administrator rights, which nothing in the
+// web interface can do. It reads the same configuration as the web server.
+// A user whose rights change is signed out everywhere, so new rights apply
+// from their next sign-in.
+//
+//	admin [flags] grant <email>   make the user an administrator
+//	admin [flags] revoke <email>  take the user's administrator rights away
+//	admin [flags] list            list administrators
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"movies4u.net/internals/config"
+	"movies4u.net/internals/database"
+	"movies4u.net/internals/models"
+)
+
+const usage = `usage: admin [flags] <command>
+
+commands:
+  grant <email>   make the user an administrator
+  revoke <email>  take the user's administrator rights away
+  list            list administrators`
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	cfg, args, err := config.Parse("admin", args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	db, err := database.Open(cfg.DB, &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+	if err != nil {
+		return err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	ctx := context.Background()
+	users := &models.GormUserStore{DB: db}
+
+	switch command, rest := args[0], args[1:]; command {
+	case "grant", "revoke":
+		if len(rest) != 1 {
+			return fmt.Errorf("%s: expected an email address", command)
+		}
+		return setAdmin(ctx, users, out, rest[0], command == "grant")
+	case "list":
+		return listAdmins(ctx, db, out)
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", command, usage)
+	}
+}
+
+func setAdmin(ctx context.Context, users models.UserStore, out io.Writer, email string, admin bool) error {
+	user, err := users.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return fmt.Errorf("no user has the email address %s", email)
+		}
+		return err
+	}
+	if user.Admin == admin {
+		fmt.Fprintln(out, "nothing to do")
+		return nil
+	}
+
+	// SetAdmin bumps the user's auth version, which ends their sessions.
+	err = users.SetAdmin(ctx, int(user.ID), admin)
+	if err != nil {
+		return err
+	}
+	if admin {
+		fmt.Fprintf(out, "%s is now an administrator\n", user.Email)
+	} else {
+		fmt.Fprintf(out, "%s is no longer an administrator\n", user.Email)
+	}
+	return nil
+}
+
+func listAdmins(ctx context.Context, db *gorm.DB, out io.Writer) error {
+	var admins []models.User
+	err := db.WithContext(ctx).Where("admin = ?", true).Order("id").Find(&admins).Error
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tEMAIL")
+	for _, u := range admins {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", u.ID, u.UserName, u.Email)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"movies4u.net/internals/config"
+	"movies4u.net/internals/database"
+	"movies4u.net/internals/migrations"
+	"movies4u.net/internals/models"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	dbConfig := config.DB{Driver: config.DriverSQLite, Path: filepath.Join(dir, "test.db")}
+	t.Setenv("DB_DRIVER", dbConfig.Driver)
+	t.Setenv("DB_PATH", dbConfig.Path)
+
+	db, err := database.Open(dbConfig, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	ctx := context.Background()
+	migrator, err := migrations.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrator.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := &models.GormUserStore{DB: db}
+	alice := models.User{UserName: "alice", Email: "alice@example.com", Password: "hash"}
+	err = users.Insert(ctx, &alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := func(args ...string) (string, error) {
+		t.Helper()
+		var out bytes.Buffer
+		err := run(append([]string{"-env=" + filepath.Join(dir, "missing.env")}, args...), &out)
+		return out.String(), err
+	}
+	get := func() models.User {
+		t.Helper()
+		user, err := users.Get(ctx, int(alice.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+
+	out, err := admin("grant", "Alice@Example.com")
+	if err != nil || out != "alice@example.com is now an administrator\n" {
+		t.Fatalf("grant: got %q, %v", out, err)
+	}
+	user := get()
+	if !user.Admin {
+		t.Fatal("alice should be an administrator")
+	}
+	// Existing sessions must notice the change.
+	if user.AuthVersion == alice.AuthVersion {
+		t.Error("granting should bump the auth version")
+	}
+
+	out, err = admin("grant", "alice@example.com")
+	if err != nil || out != "nothing to do\n" {
+		t.Errorf("granting again: got %q, %v", out, err)
+	}
+
+	out, err = admin("list")
+	if err != nil || !strings.Contains(out, "alice@example.com") {
+		t.Errorf("list: got %q, %v", out, err)
+	}
+
+	out, err = admin("revoke", "alice@example.com")
+	if err != nil || out != "alice@example.com is no longer an administrator\n" {
+		t.Errorf("revoke: got %q, %v", out, err)
+	}
+	if get().Admin {
+		t.Error("alice should no longer be an administrator")
+	}
+
+	out, err = admin("list")
+	if err != nil || strings.Contains(out, "alice") {
+		t.Errorf("list after revoking: got %q, %v", out, err)
+	}
+
+	for _, args := range [][]string{{}, {"grant"}, {"grant", "nobody@example.com"}, {"promote", "alice@example.com"}} {
+		_, err := admin(args...)
+		if err == nil {
+			t.Errorf("%v should fail", args)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Command migrate applies and rolls back the versioned schema migrations.
+// It reads the same configuration as the web server.
+//
+//	migrate [flags] up            apply every pending migration
+//	migrate [flags] down [n]      roll back the last n migrations, default 1
+//	migrate [flags] to <version>  migrate up or down to version, 0 for none
+//	migrate [flags] status        list migrations and when they were applied
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"movies4u.net/internals/config"
+	"movies4u.net/internals/database"
+	"movies4u.net/internals/migrations"
+)
+
+const usage = `usage: migrate [flags] <command>
+
+commands:
+  up            apply every pending migration
+  down [n]      roll back the last n migrations, default 1
+  to <version>  migrate up or down to version, 0 for none
+  status        list migrations and when they were applied`
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	cfg, args, err := config.Parse("migrate", args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	db, err := database.Open(cfg.DB, &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+	if err != nil {
+		return err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	migrator, err := migrations.New(db)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var ran []migrations.Migration
+
+	switch command, rest := args[0], args[1:]; command {
+	case "up":
+		ran, err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(rest) > 0 {
+			steps, err = strconv.Atoi(rest[0])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("down: %q is not a positive number", rest[0])
+			}
+		}
+		ran, err = migrator.Down(ctx, steps)
+	case "to":
+		if len(rest) != 1 {
+			return errors.New("to: expected a version")
+		}
+		version, parseErr := strconv.ParseInt(rest[0], 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("to: %q is not a version", rest[0])
+		}
+		ran, err = migrator.To(ctx, version)
+	case "status":
+		return printStatus(ctx, migrator)
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", command, usage)
+	}
+
+	for _, m := range ran {
+		fmt.Printf("%04d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(ran) == 0 {
+		fmt.Println("nothing to do")
+	}
+	return nil
+}
+
+func printStatus(ctx context.Context, migrator *migrations.Migrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"movies4u.net/internals/models"
+	"movies4u.net/internals/ratelimit"
+	"movies4u.net/internals/validator"
+)
+
+// apiPrefix is where the versioned JSON API is served.
+const apiPrefix = "/api/v1"
+
+// apiRoute is an operation of the versioned JSON API. routes() registers it
+// and openAPIDocument describes it, so the published document can't drift
+// from what is served.
+type apiRoute struct {
+	method   string
+	path     string // under apiPrefix, with {name} wildcards
+	id       string // the OpenAPI operationId
+	summary  string
+	tag      string
+	scope    string // API token scope needed, "" for a public route
+	limit    ratelimit.Policy
+	params   []apiParam
+	status   int   // on success
+	response any   // a value of the success body's type, nil for no body
+	errors   []int // error statuses besides those of authentication, rate limits and crashes
+	handler  http.HandlerFunc
+}
+
+// apiParam is a path or query parameter of an apiRoute, with the JSON
+// schema of its value.
+type apiParam struct {
+	name        string
+	in          string // "path" or "query"
+	description string
+	schema      map[string]any
+}
+
+// Paging of API collections.
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// API collections reply with one of these rather than a bare array, leaving
+// room for paging and other metadata.
+type filmPage struct {
+	Films  []models.FilmWithCounts `json:"films"`
+	Total  int64                   `json:"total"`
+	Offset int                     `json:"offset"`
+	Limit  int                     `json:"limit"`
+}
+
+type personPage struct {
+	People []models.Person `json:"people"`
+	Total  int64           `json:"total"`
+	Offset int             `json:"offset"`
+	Limit  int             `json:"limit"`
+}
+
+type genreList struct {
+	Genres []models.Genre `json:"genres"`
+}
+
+type filmList struct {
+	Films []models.FilmWithCounts `json:"films"`
+}
+
+// apiRoles maps the people collections onto the roles they list.
+var apiRoles = map[string]string{
+	"directors": models.RoleDirector,
+	"stars":     models.RoleStar,
+}
+
+// apiLists maps the lists under /me onto the lists they hold.
+var apiLists = map[string]string{
+	"watchlist": models.ListWatchlist,
+	"watched":   models.ListWatchedlist,
+}
+
+func (app *application) apiRoutes() []apiRoute {
+	var (
+		idParam     = func(what string) apiParam { return apiParam{"id", "path", "ID of the " + what, idSchema} }
+		roleParam   = apiParam{"role", "path", "Which people to list", map[string]any{"type": "string", "enum": []string{"directors", "stars"}}}
+		nameParam   = apiParam{"q", "query", "Part of the name, ignoring case", map[string]any{"type": "string"}}
+		offsetParam = apiParam{"offset", "query", "How many results to skip", map[string]any{"type": "integer", "minimum": 0, "default": 0}}
+		limitParam  = apiParam{"limit", "query", "How many results to return", map[string]any{"type": "integer", "minimum": 1, "maximum": maxPageLimit, "default": defaultPageLimit}}
+		filterParam = func(name, what string) apiParam {
+			return apiParam{name, "query", "Only films crediting this " + what + " ID", map[string]any{"type": "integer", "minimum": 0}}
+		}
+		// Listings and edits cost more than single reads.
+		limited = ratelimit.Policy{Limit: 60, Period: time.Minute, Burst: 20}
+	)
+
+	routes := []apiRoute{
+		{
+			method: http.MethodGet, path: "/openapi.json", id: "getOpenAPI", tag: "meta",
+			summary:  "This document",
+			status:   http.StatusOK,
+			response: map[string]any{},
+			handler:  app.apiOpenAPI,
+		},
+		{
+			method: http.MethodGet, path: "/films", id: "listFilms", tag: "films", scope: models.ScopeRead, limit: limited,
+			summary:  "List films in ID order, optionally filtered by name or credits",
+			params:   []apiParam{nameParam, filterParam("genre", "genre"), filterParam("director", "director"), filterParam("star", "star"), offsetParam, limitParam},
+			status:   http.StatusOK,
+			response: filmPage{},
+			errors:   []int{http.StatusUnprocessableEntity},
+			handler:  app.apiFilms,
+		},
+		{
+			method: http.MethodGet, path: "/films/{id}", id: "getFilm", tag: "films", scope: models.ScopeRead,
+			summary:  "Get a film with its credits and list counts",
+			params:   []apiParam{idParam("film")},
+			status:   http.StatusOK,
+			response: models.FilmWithCounts{},
+			errors:   []int{http.StatusNotFound},
+			handler:  app.apiFilm,
+		},
+		{
+			method: http.MethodGet, path: "/genres", id: "listGenres", tag: "genres", scope: models.ScopeRead,
+			summary:  "List every genre by name",
+			status:   http.StatusOK,
+			response: genreList{},
+			handler:  app.apiGenres,
+		},
+		{
+			method: http.MethodGet, path: "/genres/{id}", id: "getGenre", tag: "genres", scope: models.ScopeRead,
+			summary:  "Get a genre",
+			params:   []apiParam{idParam("genre")},
+			status:   http.StatusOK,
+			response: models.Genre{},
+			errors:   []int{http.StatusNotFound},
+			handler:  app.apiGenre,
+		},
+		{
+			method: http.MethodGet, path: "/people/{role}", id: "listPeople", tag: "people", scope: models.ScopeRead, limit: limited,
+			summary:  "List directors or stars in ID order, optionally filtered by name",
+			params:   []apiParam{roleParam, nameParam, offsetParam, limitParam},
+			status:   http.StatusOK,
+			response: personPage{},
+			errors:   []int{http.StatusNotFound, http.StatusUnprocessableEntity},
+			handler:  app.apiPeople,
+		},
+		{
+			method: http.MethodGet, path: "/people/{role}/{id}", id: "getPerson", tag: "people", scope: models.ScopeRead,
+			summary:  "Get a director or star",
+			params:   []apiParam{roleParam, idParam("person")},
+			status:   http.StatusOK,
+			response: models.Person{},
+			errors:   []int{http.StatusNotFound},
+			handler:  app.apiPerson,
+		},
+	}
+
+	for _, name := range []string{"watchlist", "watched"} {
+		list := apiLists[name]
+		title := strings.ToUpper(name[:1]) + name[1:]
+		routes = append(routes,
+			apiRoute{
+				method: http.MethodGet, path: "/me/" + name, id: "get" + title, tag: "lists", scope: models.ScopeRead,
+				summary:  "List the films on your " + name,
+				status:   http.StatusOK,
+				response: filmList{},
+				handler:  app.apiListFilms(list),
+			},
+			apiRoute{
+				method: http.MethodPut, path: "/me/" + name + "/{id}", id: "add" + title, tag: "lists", scope: models.ScopeWrite, limit: limited,
+				summary: "Put a film on your " + name + "; it may be there already",
+				params:  []apiParam{idParam("film")},
+				status:  http.StatusNoContent,
+				errors:  []int{http.StatusNotFound},
+				handler: app.apiListPut(list),
+			},
+			apiRoute{
+				method: http.MethodDelete, path: "/me/" + name + "/{id}", id: "remove" + title, tag: "lists", scope: models.ScopeWrite, limit: limited,
+				summary: "Take a film off your " + name + "; it may not be there",
+				params:  []apiParam{idParam("film")},
+				status:  http.StatusNoContent,
+				errors:  []int{http.StatusNotFound},
+				handler: app.apiListDelete(list),
+			},
+		)
+	}
+	return routes
+}
+
+// idSchema describes the IDs in API paths.
+var idSchema = map[string]any{"type": "integer", "minimum": 1}
+
+// pathID returns the positive integer in the path wildcard name.
+func pathID(r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue(name))
+	return id, err == nil && id > 0
+}
+
+// queryInt returns the whole number in the query parameter name, or
+// fallback if it is missing, recording a field error in v if it isn't one.
+func queryInt(r *http.Request, v *validator.Validator, name string, fallback int) int {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	v.CheckField(err == nil && n >= 0, name, "Must be a whole number")
+	return n
+}
+
+// pageParams returns the offset and limit query parameters.
+func pageParams(r *http.Request, v *validator.Validator) (int, int) {
+	offset := queryInt(r, v, "offset", 0)
+	limit := queryInt(r, v, "limit", defaultPageLimit)
+	v.CheckField(limit >= 1 && limit <= maxPageLimit, "limit", "Must be between 1 and "+strconv.Itoa(maxPageLimit))
+	return offset, limit
+}
+
+// lastUpdated returns when the most recently changed of films changed.
+func lastUpdated(films []models.Film) time.Time {
+	var modified time.Time
+	for _, film := range films {
+		if film.UpdatedAt.After(modified) {
+			modified = film.UpdatedAt
+		}
+	}
+	return modified
+}
+
+func (app *application) apiOpenAPI(w http.ResponseWriter, r *http.Request) {
+	app.serveJSON(w, r, openAPIDocument(app.apiRoutes()), time.Time{})
+}
+
+func (app *application) apiFilms(w http.ResponseWriter, r *http.Request) {
+	var v validator.Validator
+	q := models.FilmQuery{
+		Name:       r.URL.Query().Get("q"),
+		GenreID:    queryInt(r, &v, "genre", 0),
+		DirectorID: queryInt(r, &v, "director", 0),
+		StarID:     queryInt(r, &v, "star", 0),
+	}
+	q.Offset, q.Limit = pageParams(r, &v)
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	films, total, err := app.films.List(r.Context(), q)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	withCounts, err := app.films.WithCounts(r.Context(), app.authenticatedUserID(r), films)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.serveJSON(w, r, filmPage{Films: withCounts, Total: total, Offset: q.Offset, Limit: q.Limit}, lastUpdated(films))
+}
+
+func (app *application) apiFilm(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r, "id")
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	film, err := app.films.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	withCounts, err := app.films.WithCounts(r.Context(), app.authenticatedUserID(r), []models.Film{film})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.serveJSON(w, r, withCounts[0], film.UpdatedAt)
+}
+
+func (app *application) apiGenres(w http.ResponseWriter, r *http.Request) {
+	genres, err := app.credits.Genres(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.serveJSON(w, r, genreList{Genres: genres}, time.Time{})
+}
+
+func (app *application) apiGenre(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r, "id")
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	genre, err := app.credits.Genre(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.serveJSON(w, r, genre, time.Time{})
+}
+
+func (app *application) apiPeople(w http.ResponseWriter, r *http.Request) {
+	role, ok := apiRoles[r.PathValue("role")]
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	var v validator.Validator
+	offset, limit := pageParams(r, &v)
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	people, total, err := app.credits.People(r.Context(), role, r.URL.Query().Get("q"), offset, limit)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.serveJSON(w, r, personPage{People: people, Total: total, Offset: offset, Limit: limit}, time.Time{})
+}
+
+func (app *application) apiPerson(w http.ResponseWriter, r *http.Request) {
+	role, ok := apiRoles[r.PathValue("role")]
+	id, validID := pathID(r, "id")
+	if !ok || !validID {
+		app.notFound(w, r)
+		return
+	}
+
+	person, err := app.credits.Person(r.Context(), role, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.serveJSON(w, r, person, time.Time{})
+}
+
+func (app *application) apiListFilms(list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := app.authenticatedUserID(r)
+		films, err := app.lists.Films(r.Context(), userID, list)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		withCounts, err := app.films.WithCounts(r.Context(), userID, films)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		// Adding or removing a film doesn't change any film's UpdatedAt,
+		// so only the ETag is reliable.
+		app.serveJSON(w, r, filmList{Films: withCounts}, time.Time{})
+	}
+}
+
+// apiListPut adds a film to list. Films that don't exist are not found, as
+// the film is part of the resource's path.
+func (app *application) apiListPut(list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filmID, ok := pathID(r, "id")
+		if !ok {
+			app.notFound(w, r)
+			return
+		}
+
+		err := app.lists.Add(r.Context(), app.authenticatedUserID(r), filmID, list)
+		if err != nil {
+			if errors.Is(err, models.ErrInvalidReference) {
+				app.notFound(w, r)
+			} else {
+				app.serverError(w, r, err)
+			}
+			return
+		}
+		app.metrics.ListAdds.WithLabelValues(list).Inc()
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiListDelete takes a film off list. As with apiListPut, films that don't
+// exist are not found, though one that simply isn't on the list is fine.
+func (app *application) apiListDelete(list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filmID, ok := pathID(r, "id")
+		if !ok {
+			app.notFound(w, r)
+			return
+		}
+
+		_, err := app.films.Get(r.Context(), filmID)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				app.notFound(w, r)
+			} else {
+				app.serverError(w, r, err)
+			}
+			return
+		}
+
+		err = app.lists.Remove(r.Context(), app.authenticatedUserID(r), filmID, list)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
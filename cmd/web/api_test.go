@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"movies4u.net/internals/models"
+)
+
+// apiCheck is a request to the versioned API whose response must match the
+// OpenAPI document. Requests the document rules out are still sent, to
+// check the handler's answer, but not validated themselves.
+type apiCheck struct {
+	method     string
+	path       string
+	token      string
+	invalid    bool
+	wantStatus int
+}
+
+func TestOpenAPI(t *testing.T) {
+	app, _ := newTestApplication(t)
+	alice := addTestUser(t, app, "alice", "alice@example.com", false)
+	read := addTestAPIToken(t, app, alice.ID, models.ScopeRead)
+	write := addTestAPIToken(t, app, alice.ID, models.ScopeWrite)
+	ts := newTestServer(t, app.routes())
+	ctx := context.Background()
+
+	res := routeTest{method: http.MethodGet, path: apiPrefix + "/openapi.json", wantStatus: http.StatusOK}.run(t, ts)
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData([]byte(res.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doc.Validate(ctx)
+	if err != nil {
+		t.Fatalf("invalid document: %v", err)
+	}
+
+	// The router matches requests against the servers in the document, so
+	// it is told where the test server is.
+	doc.Servers = openapi3.Servers{{URL: ts.URL + apiPrefix}}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []apiCheck{
+		{method: http.MethodGet, path: "/openapi.json", wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/films", wantStatus: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/films", token: "m4u_nope", wantStatus: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/films", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/films?q=HEA&genre=2&director=2&star=2", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/films?offset=1&limit=1", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/films?limit=1000", token: read, invalid: true, wantStatus: http.StatusUnprocessableEntity},
+		{method: http.MethodGet, path: "/films/1", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/films/5", token: read, wantStatus: http.StatusNotFound},
+		{method: http.MethodGet, path: "/genres", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/genres/1", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/genres/9", token: read, wantStatus: http.StatusNotFound},
+		{method: http.MethodGet, path: "/people/directors", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/people/stars?q=keanu&limit=5", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/people/stars?offset=-1", token: read, invalid: true, wantStatus: http.StatusUnprocessableEntity},
+		{method: http.MethodGet, path: "/people/directors/2", token: read, wantStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/people/stars/9", token: read, wantStatus: http.StatusNotFound},
+		{method: http.MethodGet, path: "/people/writers/1", token: read, invalid: true, wantStatus: http.StatusNotFound},
+	}
+	for _, list := range []string{"/me/watchlist", "/me/watched"} {
+		checks = append(checks,
+			apiCheck{method: http.MethodPut, path: list + "/1", token: read, wantStatus: http.StatusForbidden},
+			apiCheck{method: http.MethodPut, path: list + "/1", token: write, wantStatus: http.StatusNoContent},
+			apiCheck{method: http.MethodPut, path: list + "/1", token: write, wantStatus: http.StatusNoContent},
+			apiCheck{method: http.MethodPut, path: list + "/77", token: write, wantStatus: http.StatusNotFound},
+			apiCheck{method: http.MethodGet, path: list, token: read, wantStatus: http.StatusOK},
+			apiCheck{method: http.MethodDelete, path: list + "/1", token: write, wantStatus: http.StatusNoContent},
+			apiCheck{method: http.MethodDelete, path: list + "/2", token: write, wantStatus: http.StatusNoContent},
+		)
+	}
+
+	covered := map[string]bool{}
+	for _, check := range checks {
+		t.Run(check.method+" "+check.path, func(t *testing.T) {
+			header := http.Header{}
+			if check.token != "" {
+				header.Set("Authorization", "Bearer "+check.token)
+			}
+
+			req, err := http.NewRequest(check.method, ts.URL+apiPrefix+check.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = header
+			route, pathParams, err := router.FindRoute(req)
+			if err != nil {
+				t.Fatalf("not in the document: %v", err)
+			}
+			covered[route.Operation.OperationID] = true
+
+			input := &openapi3filter.RequestValidationInput{
+				Request:    req,
+				PathParams: pathParams,
+				Route:      route,
+				Options: &openapi3filter.Options{
+					AuthenticationFunc:    openapi3filter.NoopAuthenticationFunc,
+					IncludeResponseStatus: true,
+				},
+			}
+			err = openapi3filter.ValidateRequest(ctx, input)
+			if check.invalid != (err != nil) {
+				t.Errorf("request validation: got %v, want invalid %t", err, check.invalid)
+			}
+
+			res := ts.do(t, check.method, apiPrefix+check.path, header, nil)
+			if res.status != check.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", res.status, check.wantStatus, res.body)
+			}
+			validateAPIResponse(t, input, res)
+		})
+	}
+
+	for path, item := range doc.Paths.Map() {
+		for method, op := range item.Operations() {
+			if !covered[op.OperationID] {
+				t.Errorf("%s %s is never checked", method, path)
+			}
+		}
+	}
+}
+
+func validateAPIResponse(t *testing.T, input *openapi3filter.RequestValidationInput, res testResponse) {
+	t.Helper()
+
+	err := openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 res.status,
+		Header:                 res.header,
+		Body:                   io.NopCloser(strings.NewReader(res.body)),
+		Options:                input.Options,
+	})
+	if err != nil {
+		t.Errorf("response doesn't match the document: %v", err)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	t.Run("films", func(t *testing.T) {
+		page := decodeJSON[filmPage](t, ts.get(t, apiPrefix+"/films?offset=1&limit=1"))
+		if page.Total != 2 || page.Offset != 1 || page.Limit != 1 || len(page.Films) != 1 || page.Films[0].Name != "Heat" {
+			t.Errorf("got %+v", page)
+		}
+
+		page = decodeJSON[filmPage](t, ts.get(t, apiPrefix+"/films?star=1"))
+		if page.Total != 1 || page.Films[0].Name != "The Matrix" {
+			t.Errorf("films with star 1: got %+v", page)
+		}
+	})
+
+	t.Run("people", func(t *testing.T) {
+		page := decodeJSON[personPage](t, ts.get(t, apiPrefix+"/people/stars?q=PACINO"))
+		if page.Total != 1 || page.People[0] != (models.Person{ID: 2, Role: models.RoleStar, Name: "Al Pacino"}) {
+			t.Errorf("got %+v", page)
+		}
+	})
+
+	// Sessions send the CSRF token with writes, like the other JSON routes.
+	t.Run("lists", func(t *testing.T) {
+		send := func(method, path string, wantStatus int) {
+			t.Helper()
+			res := ts.do(t, method, apiPrefix+path, http.Header{"X-Csrf-Token": {ts.csrfToken(t)}}, nil)
+			if res.status != wantStatus {
+				t.Errorf("%s %s: got status %d, want %d", method, path, res.status, wantStatus)
+			}
+		}
+
+		send(http.MethodPut, "/me/watchlist/2", http.StatusNoContent)
+		send(http.MethodPut, "/me/watchlist/77", http.StatusNotFound)
+		list := decodeJSON[filmList](t, ts.get(t, apiPrefix+"/me/watchlist"))
+		if len(list.Films) != 1 || list.Films[0].ID != 2 || !list.Films[0].OnWatchlist || list.Films[0].WatchlistCount != 1 {
+			t.Fatalf("got %+v", list)
+		}
+
+		send(http.MethodDelete, "/me/watchlist/2", http.StatusNoContent)
+		send(http.MethodDelete, "/me/watchlist/2", http.StatusNoContent)
+		send(http.MethodDelete, "/me/watchlist/77", http.StatusNotFound)
+		list = decodeJSON[filmList](t, ts.get(t, apiPrefix+"/me/watchlist"))
+		if len(list.Films) != 0 {
+			t.Errorf("after removing got %+v", list)
+		}
+	})
+
+	t.Run("signed out", func(t *testing.T) {
+		anonymous := newTestServer(t, app.routes())
+		res := routeTest{method: http.MethodGet, path: apiPrefix + "/me/watched", wantStatus: http.StatusUnauthorized}.run(t, anonymous)
+		if body := decodeJSON[errorResponse](t, res); body.Error.Code != "unauthorized" {
+			t.Errorf("got %+v", body.Error)
+		}
+	})
+}
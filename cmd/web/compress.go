@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressSize is the smallest body worth compressing; below it the
+// encoding overhead outweighs the savings.
+const minCompressSize = 1024
+
+// compressor is a reusable streaming encoder.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// contentEncoding is a Content-Encoding the server can produce, with a pool
+// of encoders for responses and a one-shot encoder at maximum compression
+// for static files.
+type contentEncoding struct {
+	name     string
+	pool     sync.Pool
+	compress func(b []byte) ([]byte, error)
+}
+
+func (e *contentEncoding) get(w io.Writer) compressor {
+	c := e.pool.Get().(compressor)
+	c.Reset(w)
+	return c
+}
+
+func (e *contentEncoding) put(c compressor) {
+	c.Reset(io.Discard)
+	e.pool.Put(c)
+}
+
+// contentEncodings are the encodings offered for responses, in order of
+// preference when a client accepts several equally.
+var contentEncodings = []*contentEncoding{
+	{
+		name: "zstd",
+		pool: sync.Pool{New: func() any {
+			// NewWriter only fails on invalid options.
+			enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+			return enc
+		}},
+		compress: func(b []byte) ([]byte, error) {
+			enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return enc.EncodeAll(b, nil), enc.Close()
+		},
+	},
+	{
+		name: "br",
+		pool: sync.Pool{New: func() any {
+			return brotli.NewWriterLevel(nil, 5)
+		}},
+		compress: func(b []byte) ([]byte, error) {
+			return compressAll(brotli.NewWriterLevel(nil, brotli.BestCompression), b)
+		},
+	},
+	{
+		name: "gzip",
+		pool: sync.Pool{New: func() any {
+			return gzip.NewWriter(nil)
+		}},
+		compress: func(b []byte) ([]byte, error) {
+			enc, err := gzip.NewWriterLevel(nil, gzip.BestCompression)
+			if err != nil {
+				return nil, err
+			}
+			return compressAll(enc, b)
+		},
+	},
+}
+
+func compressAll(c compressor, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	c.Reset(&buf)
+	_, err := c.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// negotiateEncoding picks the first of offers the Accept-Encoding header
+// rates highest, or "" if none is acceptable and the body should be sent as
+// it is.
+func negotiateEncoding(acceptEncoding string, offers []string) string {
+	rated := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		params = strings.TrimSpace(params)
+		if value, ok := strings.CutPrefix(params, "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		rated[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, ok := rated[offer]
+		if !ok {
+			q, ok = rated["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether bodies of contentType shrink when
+// compressed. Images other than SVG, fonts and archives are compressed
+// already.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/manifest+json", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// compress encodes response bodies with the best encoding the client
+// accepts. Bodies that are small, of an incompressible type, already encoded
+// or not a full 200 response are sent as they are.
+func (app *application) compress(next http.Handler) http.Handler {
+	offers := make([]string, len(contentEncodings))
+	for i, e := range contentEncodings {
+		offers[i] = e.name
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		name := negotiateEncoding(r.Header.Get("Accept-Encoding"), offers)
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var encoding *contentEncoding
+		for _, e := range contentEncodings {
+			if e.name == name {
+				encoding = e
+			}
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// the body is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding *contentEncoding
+	status   int
+	buf      []byte
+	started  bool
+	enc      compressor // set once the body is being compressed
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.started || cw.status != 0 {
+		return
+	}
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	if !cw.started {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < minCompressSize {
+			return len(p), nil
+		}
+		return len(p), cw.start(true)
+	}
+
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// start sends the header, compressing the body if worthwhile is set and the
+// response allows it, then whatever body is buffered.
+func (cw *compressWriter) start(worthwhile bool) error {
+	cw.started = true
+	h := cw.Header()
+
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	// Handlers that encode the body themselves tag each encoding
+	// separately, so their responses are left alone.
+	if h.Get("Content-Encoding") == "" && worthwhile && cw.status == http.StatusOK && compressible(h.Get("Content-Type")) {
+		// The handler's strong validator is for the identity body, which
+		// the compressed one isn't byte-for-byte.
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		h.Set("Content-Encoding", cw.encoding.name)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		cw.enc = cw.encoding.get(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// Flush sends what has been written so far, compressing it if the response
+// allows, since a streamed body's final size isn't known.
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.start(true)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) close() {
+	if !cw.started && cw.status != 0 {
+		cw.start(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.encoding.put(cw.enc)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"movies4u.net/internals/models"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	offers := []string{"zstd", "br", "gzip"}
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"zstd;q=0, gzip;q=0.1", "gzip"},
+		{"*", "zstd"},
+		{"*;q=0.2, br;q=0.8", "br"},
+		{"*, zstd;q=0", "br"},
+		{"gzip;q=bad", ""},
+	}
+
+	for _, tt := range tests {
+		got := negotiateEncoding(tt.acceptEncoding, offers)
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+// decoders undo each content encoding.
+var decoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+}
+
+func decode(t *testing.T, encoding, body string) string {
+	t.Helper()
+
+	r, err := decoders[encoding](strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompression(t *testing.T) {
+	app, store := newTestApplication(t)
+	for id := 3; id <= 20; id++ {
+		store.AddFilm(models.Film{ID: uint(id), Name: fmt.Sprintf("Film %d", id), Description: strings.Repeat("A long description. ", 10)})
+	}
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	// Setting Accept-Encoding stops the client from decoding responses
+	// itself.
+	identity := ts.do(t, http.MethodGet, "/films?start=1&end=20", http.Header{"Accept-Encoding": {"identity"}}, nil)
+	if len(identity.body) < minCompressSize {
+		t.Fatalf("body of %d bytes is too small to compress", len(identity.body))
+	}
+	if identity.header.Get("Content-Encoding") != "" {
+		t.Errorf("got Content-Encoding %q without asking", identity.header.Get("Content-Encoding"))
+	}
+	// A body sent as it is keeps the handler's strong validator.
+	if etag := identity.header.Get("ETag"); !strings.HasPrefix(etag, `"`) {
+		t.Errorf("got ETag %q for an uncompressed body", etag)
+	}
+
+	for encoding := range decoders {
+		t.Run(encoding, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, "/films?start=1&end=20", http.Header{"Accept-Encoding": {encoding}}, nil)
+			if got := res.header.Get("Content-Encoding"); got != encoding {
+				t.Fatalf("got Content-Encoding %q", got)
+			}
+			if !strings.Contains(res.header.Get("Vary"), "Accept-Encoding") {
+				t.Errorf("got Vary %q", res.header.Get("Vary"))
+			}
+			if etag := res.header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+				t.Errorf("got strong ETag %q for a compressed body", etag)
+			}
+			if decode(t, encoding, res.body) != identity.body {
+				t.Error("decoded body differs")
+			}
+
+			routeTest{method: http.MethodGet, path: "/films?start=1&end=20", header: http.Header{
+				"Accept-Encoding": {encoding},
+				"If-None-Match":   {res.header.Get("ETag")},
+			}, wantStatus: http.StatusNotModified}.run(t, ts)
+		})
+	}
+
+	t.Run("small body", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/films/1", http.Header{"Accept-Encoding": {"gzip"}}, nil)
+		if res.header.Get("Content-Encoding") != "" {
+			t.Errorf("got Content-Encoding %q", res.header.Get("Content-Encoding"))
+		}
+		if etag := res.header.Get("ETag"); !strings.HasPrefix(etag, `"`) {
+			t.Errorf("got ETag %q for an uncompressed body", etag)
+		}
+	})
+
+	t.Run("precompressed static file", func(t *testing.T) {
+		plain := ts.do(t, http.MethodGet, "/static/css/main.css", http.Header{"Accept-Encoding": {"identity"}}, nil)
+		res := ts.do(t, http.MethodGet, "/static/css/main.css", http.Header{"Accept-Encoding": {"gzip, br"}}, nil)
+
+		encoding := res.header.Get("Content-Encoding")
+		if encoding == "" || !strings.HasSuffix(res.header.Get("ETag"), "-"+encoding+`"`) {
+			t.Fatalf("got Content-Encoding %q, ETag %q", encoding, res.header.Get("ETag"))
+		}
+		if decode(t, encoding, res.body) != plain.body {
+			t.Error("decoded body differs")
+		}
+	})
+
+	t.Run("incompressible static file", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/static/img/logo.png", http.Header{"Accept-Encoding": {"gzip"}}, nil)
+		if res.status != http.StatusOK || res.header.Get("Content-Encoding") != "" {
+			t.Errorf("got status %d, Content-Encoding %q", res.status, res.header.Get("Content-Encoding"))
+		}
+	})
+}
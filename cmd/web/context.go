@@ -3,3 +3,9 @@ package main
 type contextKey string
 
 const isAuthenticatedContextKey = contextKey("isAuthenticated")
+const isAdminContextKey = contextKey("isAdmin")
+const userIDContextKey = contextKey("userID")
+const apiTokenContextKey = contextKey("apiToken")
+const forwardedTLSContextKey = contextKey("forwardedTLS")
+const routeContextKey = contextKey("route")
+const jsonRouteContextKey = contextKey("jsonRoute")
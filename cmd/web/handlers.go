@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	// "html/template"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"movies4u.net/internals/models"
+	"movies4u.net/internals/totp"
 	"movies4u.net/internals/validator"
-	"golang.org/x/crypto/bcrypt"
-	"gorm.io/gorm"
 )
 
 type userCreateForm struct {
@@ -20,6 +26,42 @@ type userCreateForm struct {
 	validator.Validator
 }
 
+type twoFactorForm struct {
+	Code string
+	validator.Validator
+}
+
+type apiTokenForm struct {
+	Name      string
+	Scope     string
+	ExpiresIn string
+	validator.Validator
+}
+
+type accountForm struct {
+	UserName string
+	Email    string
+	validator.Validator
+}
+
+// emailVerificationTimeout is how long the link sent to confirm a new email
+// address stays valid.
+const emailVerificationTimeout = 24 * time.Hour
+
+// apiTokenLifetimes are the expiry choices offered when creating a token,
+// keyed by form value. Zero means the token never expires.
+var apiTokenLifetimes = map[string]time.Duration{
+	"7":     7 * 24 * time.Hour,
+	"30":    30 * 24 * time.Hour,
+	"90":    90 * 24 * time.Hour,
+	"365":   365 * 24 * time.Hour,
+	"never": 0,
+}
+
+// pendingLoginTimeout is how long a user has to enter their two-factor code
+// after giving a correct password.
+const pendingLoginTimeout = 5 * time.Minute
+
 func (app *application) setCSPHeader(w http.ResponseWriter) {
 	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline'; img-src *; style-src 'self' 'unsafe-inline';")
 }
@@ -27,12 +69,12 @@ func (app *application) setCSPHeader(w http.ResponseWriter) {
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	app.setCSPHeader(w)
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		app.notFound(w, r)
 		return
 	}
 
 	data := app.newTemplateData(r)
-	app.render(w, http.StatusOK, "index.html", data)
+	app.render(w, r, http.StatusOK, "index.html", data)
 }
 
 func (app *application) search(w http.ResponseWriter, r *http.Request) {
@@ -46,17 +88,16 @@ func (app *application) searchPost(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&filmRequest)
 	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
+		app.badJSON(w, r, err)
 		return
 	}
 
-	var films []models.Film
-	result := app.DB.Where("name LIKE ?", "%"+filmRequest.Film+"%").Find(&films)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			app.notFound(w)
+	films, err := app.films.Search(r.Context(), filmRequest.Film)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
@@ -64,16 +105,15 @@ func (app *application) searchPost(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(films); err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 	}
 }
 
 func (app *application) getFilm(w http.ResponseWriter, r *http.Request) {
-	app.infoLog.Printf("filmView: Method=%s, URL=%s", r.Method, r.URL)
 
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil || id < 0 {
-		app.notFound(w)
+		app.notFound(w, r)
 		return
 	}
 
@@ -81,38 +121,40 @@ func (app *application) getFilm(w http.ResponseWriter, r *http.Request) {
 		id = 1
 	}
 
-	var film models.Film
-	result := app.DB.Preload("Genres").Preload("Directors").Preload("Stars").First(&film, id)
-
-	if result.Error != nil {
-		app.serverError(w, err)
+	film, err := app.films.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	filmJson, err := film.Json(app.DB)
+	withCounts, err := app.films.WithCounts(r.Context(), app.authenticatedUserID(r), []models.Film{film})
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
-	w.Write(filmJson)
+
+	// Last-Modified follows the film alone; the ETag also covers the list
+	// counts.
+	app.serveJSON(w, r, withCounts[0], film.UpdatedAt)
 }
 
 func (app *application) getFilms(w http.ResponseWriter, r *http.Request) {
-	app.infoLog.Printf("filmView: Method=%s, URL=%s", r.Method, r.URL)
 	start := r.URL.Query().Get("start")
 	finish := r.URL.Query().Get("end")
 	var startId, finishId int
 
+	var v validator.Validator
+
 	if start == "" {
 		startId = 1
 	} else {
 		var err error
 		startId, err = strconv.Atoi(start)
-		if err != nil {
-			app.serverError(w, err)
-			return
-		}
+		v.CheckField(err == nil, "start", "Must be a whole number")
 	}
 
 	if finish == "" {
@@ -120,69 +162,58 @@ func (app *application) getFilms(w http.ResponseWriter, r *http.Request) {
 	} else {
 		var err error
 		finishId, err = strconv.Atoi(finish)
-		if err != nil {
-			app.serverError(w, err)
-			return
-		}
+		v.CheckField(err == nil, "end", "Must be a whole number")
 	}
 
-	var films []models.Film
-	result := app.DB.Preload("Genres").Preload("Directors").Preload("Stars").Where("id BETWEEN ? AND ?", startId, finishId).Find(&films)
-
-	if result.Error != nil {
-		app.serverError(w, result.Error)
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	var filmJsons []json.RawMessage
-	for _, film := range films {
-		filmJson, err := film.Json(app.DB)
-		if err != nil {
-			app.serverError(w, err)
-			return
-		}
-		filmJsons = append(filmJsons, filmJson)
+	films, err := app.films.Range(r.Context(), startId, finishId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
 
-	if err := json.NewEncoder(w).Encode(filmJsons); err != nil {
-		app.serverError(w, err)
+	withCounts, err := app.films.WithCounts(r.Context(), app.authenticatedUserID(r), films)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
+
+	app.serveJSON(w, r, withCounts, lastUpdated(films))
 }
 
 func (app *application) methodNotAllowed(method string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		app.infoLog.Printf("methodNotAllowed: Method=%s, URL=%s", r.Method, r.URL)
 		w.Header().Set("Allow", method)
-		app.clientError(w, http.StatusMethodNotAllowed)
+		app.clientError(w, r, http.StatusMethodNotAllowed)
 	}
 }
 
 func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
-	app.infoLog.Printf("userLogin: Method=%s, URL=%s", r.Method, r.URL)
 	data := app.newTemplateData(r)
 	data.Form = userCreateForm{}
-	app.render(w, http.StatusOK, "login.html", data)
+	app.render(w, r, http.StatusOK, "login.html", data)
 }
 
 func (app *application) userSignin(w http.ResponseWriter, r *http.Request) {
-	app.infoLog.Printf("userSignin: Method=%s, URL=%s", r.Method, r.URL)
 	data := app.newTemplateData(r)
 	data.Form = userCreateForm{}
-	app.render(w, http.StatusOK, "signin.html", data)
+	app.render(w, r, http.StatusOK, "signin.html", data)
 }
 
 func (app *application) userSigninPost(w http.ResponseWriter, r *http.Request) {
-	app.infoLog.Printf("userSigninPost: Method=%s, URL=%s", r.Method, r.URL)
 
 	err := r.ParseForm()
 	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
+		app.clientError(w, r, http.StatusBadRequest)
 		return
 	}
 
 	username := r.Form.Get("username")
-	email := r.Form.Get("email")
+	email := models.NormalizeEmail(r.Form.Get("email"))
 	password := r.Form.Get("password")
 	confirmPassword := r.Form.Get("confirm_password")
 
@@ -204,14 +235,14 @@ func (app *application) userSigninPost(w http.ResponseWriter, r *http.Request) {
 	if !form.Valid() {
 		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "signin.html", data)
+		app.render(w, r, http.StatusUnprocessableEntity, "signin.html", data)
 		return
 	}
 
 	// Hash the password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -223,21 +254,33 @@ func (app *application) userSigninPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Insert the user into the database
-	result := app.DB.Create(&user)
-	if result.Error != nil {
-		app.serverError(w, result.Error)
+	err = app.users.Insert(r.Context(), &user)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrDuplicateEmail):
+			form.AddFieldError("email", "Email address is already in use")
+		case errors.Is(err, models.ErrDuplicateUsername):
+			form.AddFieldError("username", "Username is already taken")
+		default:
+			app.serverError(w, r, err)
+			return
+		}
+
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "signin.html", data)
 		return
 	}
+	app.metrics.Signups.Inc()
 
 	// Redirect to the login page
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 }
 
 func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
-	app.infoLog.Printf("userLoginPost: Method=%s, URL=%s", r.Method, r.URL)
 	err := r.ParseForm()
 	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
+		app.clientError(w, r, http.StatusBadRequest)
 		return
 	}
 
@@ -257,39 +300,97 @@ func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 		data := app.newTemplateData(r)
 		data.Form = form
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "login.html", data)
+		app.render(w, r, http.StatusUnprocessableEntity, "login.html", data)
+		return
+	}
+	ip := app.clientIP(r)
+	wait, err := app.throttle.Check(email, ip)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+		form.AddNonFieldError(fmt.Sprintf("Too many failed login attempts. Try again in %s", wait.Round(time.Second)))
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusTooManyRequests, "login.html", data)
 		return
 	}
-	app.infoLog.Println("I amhere")
-	app.infoLog.Println(email + password)
-	id, err := app.Authenticate(email, password)
-	app.infoLog.Println("I amhere")
+
+	id, err := app.Authenticate(r.Context(), email, password)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCredentials) {
+			res, err := app.throttle.Fail(email, ip)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			if res.AccountLocked {
+				app.notifyLockout(r.Context(), email)
+			}
+			if res.IPLocked {
+				app.logger.WarnContext(r.Context(), "address locked out after failed logins", "ip", ip)
+			}
+
 			form.AddNonFieldError("Email or password is incorrect")
 			data := app.newTemplateData(r)
 			data.Form = form
-			app.render(w, http.StatusUnprocessableEntity, "login.html", data)
+			app.render(w, r, http.StatusUnprocessableEntity, "login.html", data)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
+	err = app.throttle.Reset(email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	user, err := app.users.Get(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
 	err = app.sessionManager.RenewToken(r.Context())
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
+		return
+	}
+
+	// With two-factor enabled the password only gets the user as far as the
+	// code prompt; userID isn't set until userTOTPPost succeeds.
+	if user.TOTPEnabled {
+		app.sessionManager.Put(r.Context(), "pendingUserID", id)
+		app.sessionManager.Put(r.Context(), "pendingEmail", email)
+		app.sessionManager.Put(r.Context(), "pendingExpires", time.Now().Add(pendingLoginTimeout).Unix())
+		http.Redirect(w, r, "/user/login/totp", http.StatusSeeOther)
+		return
+	}
+
+	err = app.startUserSession(r, id)
+	if err != nil {
+		app.serverError(w, r, err)
 		return
 	}
-	app.sessionManager.Put(r.Context(), "userID", id)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
 
-	err := app.sessionManager.RenewToken(r.Context())
+	err := app.sessions.Delete(r.Context(), app.sessionManager.Token(r.Context()))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 	app.sessionManager.Remove(r.Context(), "userID")
@@ -300,7 +401,7 @@ func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
 
 func (app *application) putWatchlist(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
-		app.clientError(w, http.StatusMethodNotAllowed)
+		app.clientError(w, r, http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -311,44 +412,51 @@ func (app *application) putWatchlist(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
+		app.badJSON(w, r, err)
 		return
 	}
 
-	if body.ID > 9999 {
-		app.clientError(w, http.StatusUnprocessableEntity)
+	var v validator.Validator
+	v.CheckField(body.ID <= 9999, "id", "No film has this ID")
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
 		return
 	}
 
-	userID := app.sessionManager.GetInt(r.Context(), "userID")
+	userID := app.authenticatedUserID(r)
 	if userID == 0 {
-		app.clientError(w, http.StatusUnauthorized)
-		return
-	}
-
-	var user models.User
-	result := app.DB.First(&user, userID)
-	if result.Error != nil {
-		app.serverError(w, result.Error)
+		app.clientError(w, r, http.StatusUnauthorized)
 		return
 	}
 
 	if body.Watchlist {
-		app.DB.Model(&user).Association("WatchList").Delete(&models.Film{ID: body.ID})
+		err = app.lists.Remove(r.Context(), userID, int(body.ID), models.ListWatchlist)
 	} else {
-		app.DB.Model(&user).Association("WatchList").Append(&models.Film{ID: body.ID})
+		err = app.lists.Add(r.Context(), userID, int(body.ID), models.ListWatchlist)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidReference) {
+			v.AddFieldError("id", "No film has this ID")
+			app.failedValidation(w, r, v)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	if !body.Watchlist {
+		app.metrics.ListAdds.WithLabelValues(models.ListWatchlist).Inc()
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(map[string]bool{"watchlist": body.Watchlist}); err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 	}
 }
 
 func (app *application) putWatchedlist(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
-		app.clientError(w, http.StatusMethodNotAllowed)
+		app.clientError(w, r, http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -359,87 +467,909 @@ func (app *application) putWatchedlist(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
+		app.badJSON(w, r, err)
 		return
 	}
 
-	if body.ID > 9999 {
-		app.clientError(w, http.StatusUnprocessableEntity)
+	var v validator.Validator
+	v.CheckField(body.ID <= 9999, "id", "No film has this ID")
+	if !v.Valid() {
+		app.failedValidation(w, r, v)
 		return
 	}
 
-	userID := app.sessionManager.GetInt(r.Context(), "userID")
+	userID := app.authenticatedUserID(r)
 	if userID == 0 {
-		app.clientError(w, http.StatusUnauthorized)
-		return
-	}
-
-	var user models.User
-	result := app.DB.First(&user, userID)
-	if result.Error != nil {
-		app.serverError(w, result.Error)
+		app.clientError(w, r, http.StatusUnauthorized)
 		return
 	}
 
 	if body.Watchlist {
-		app.DB.Model(&user).Association("WatchedList").Delete(&models.Film{ID: body.ID})
+		err = app.lists.Remove(r.Context(), userID, int(body.ID), models.ListWatchedlist)
 	} else {
-		app.DB.Model(&user).Association("WatchedList").Append(&models.Film{ID: body.ID})
+		err = app.lists.Add(r.Context(), userID, int(body.ID), models.ListWatchedlist)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidReference) {
+			v.AddFieldError("id", "No film has this ID")
+			app.failedValidation(w, r, v)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	if !body.Watchlist {
+		app.metrics.ListAdds.WithLabelValues(models.ListWatchedlist).Inc()
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(map[string]bool{"watchedlist": body.Watchlist}); err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 	}
 }
 
 func (app *application) getWatchlist(w http.ResponseWriter, r *http.Request) {
-	userID := app.sessionManager.GetInt(r.Context(), "userID")
+	userID := app.authenticatedUserID(r)
 	if userID == 0 {
-		app.clientError(w, http.StatusUnauthorized)
+		app.clientError(w, r, http.StatusUnauthorized)
 		return
 	}
 
-	var user models.User
-	result := app.DB.Preload("WatchList").First(&user, userID)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			app.notFound(w)
-		} else {
-			app.serverError(w, result.Error)
-		}
+	films, err := app.lists.Films(r.Context(), userID, models.ListWatchlist)
+	if err != nil {
+		app.serverError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(user.WatchList); err != nil {
-		app.serverError(w, err)
-	}
+	// Adding or removing a film doesn't change any film's UpdatedAt, so
+	// only the ETag is reliable.
+	app.serveJSON(w, r, films, time.Time{})
 }
 
 func (app *application) getWatchedlist(w http.ResponseWriter, r *http.Request) {
-	userID := app.sessionManager.GetInt(r.Context(), "userID")
+	userID := app.authenticatedUserID(r)
 	if userID == 0 {
-		app.clientError(w, http.StatusUnauthorized)
+		app.clientError(w, r, http.StatusUnauthorized)
 		return
 	}
 
-	var user models.User
-	result := app.DB.Preload("WatchedList").First(&user, userID)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			app.notFound(w)
-		} else {
-			app.serverError(w, result.Error)
+	films, err := app.lists.Films(r.Context(), userID, models.ListWatchedlist)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Adding or removing a film doesn't change any film's UpdatedAt, so
+	// only the ETag is reliable.
+	app.serveJSON(w, r, films, time.Time{})
+}
+
+// notifyLockout tells the owner of email, if there is one, that their account
+// has been temporarily locked.
+func (app *application) notifyLockout(ctx context.Context, email string) {
+	user, err := app.users.GetByEmail(ctx, email)
+	if err != nil {
+		if !errors.Is(err, models.ErrNoRecord) {
+			app.logger.Error(err.Error())
 		}
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(user.WatchedList); err != nil {
-		app.serverError(w, err)
+	body := fmt.Sprintf("Hi %s,\n\n"+
+		"We locked your Movies4u account for %s after too many failed sign-in attempts.\n"+
+		"If this wasn't you, consider changing your password once the lock expires.\n",
+		user.UserName, app.throttle.Account.LockoutFor)
+	app.sendMail(user.Email, "Your Movies4u account has been locked", body)
+}
+
+func (app *application) adminLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := app.throttle.Locked()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Lockouts = lockouts
+	app.render(w, r, http.StatusOK, "lockouts.html", data)
+}
+
+func (app *application) adminUnlockPost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	subject := r.PostForm.Get("subject")
+	if !validator.NotBlank(subject) {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	err = app.throttle.Unlock(subject)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Unlocked "+subject)
+	http.Redirect(w, r, "/admin/lockouts", http.StatusSeeOther)
+}
+
+func (app *application) userTOTP(w http.ResponseWriter, r *http.Request) {
+	if app.sessionManager.GetInt(r.Context(), "pendingUserID") == 0 {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = twoFactorForm{}
+	app.render(w, r, http.StatusOK, "totp.html", data)
+}
+
+func (app *application) userTOTPPost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	id := app.sessionManager.GetInt(r.Context(), "pendingUserID")
+	email := app.sessionManager.GetString(r.Context(), "pendingEmail")
+	expires := app.sessionManager.GetInt64(r.Context(), "pendingExpires")
+	if id == 0 || time.Now().Unix() > expires {
+		app.clearPendingLogin(r)
+		app.sessionManager.Put(r.Context(), "flash", "Your login expired, please sign in again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	form := twoFactorForm{Code: r.PostForm.Get("code")}
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field can't be blank")
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "totp.html", data)
+		return
+	}
+
+	ip := app.clientIP(r)
+	wait, err := app.throttle.Check(email, ip)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+		form.AddNonFieldError(fmt.Sprintf("Too many failed attempts. Try again in %s", wait.Round(time.Second)))
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusTooManyRequests, "totp.html", data)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), uint(id), form.Code)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !ok {
+		res, err := app.throttle.Fail(email, ip)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if res.AccountLocked {
+			app.notifyLockout(r.Context(), email)
+		}
+
+		form.AddFieldError("code", "This code is not valid")
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "totp.html", data)
+		return
+	}
+
+	err = app.throttle.Reset(email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.clearPendingLogin(r)
+	err = app.startUserSession(r, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) userTwoFactor(w http.ResponseWriter, r *http.Request) {
+	data, err := app.newTwoFactorTemplateData(w, r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
+	data.Form = twoFactorForm{}
+	app.render(w, r, http.StatusOK, "twofactor.html", data)
+}
+
+func (app *application) userTwoFactorEnablePost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	secret := app.sessionManager.GetString(r.Context(), "totpSecret")
+	if secret == "" {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	form := twoFactorForm{Code: r.PostForm.Get("code")}
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field can't be blank")
+
+	step, ok := totp.Validate(secret, form.Code, time.Now())
+	if form.Valid() {
+		form.CheckField(ok, "code", "This code is not valid")
+	}
+
+	if !form.Valid() {
+		data, err := app.newTwoFactorTemplateData(w, r)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "twofactor.html", data)
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(10)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	codeHashes := make([]string, len(codes))
+	for i, code := range codes {
+		codeHashes[i] = totp.HashRecoveryCode(code)
+	}
+	err = app.users.SetTOTP(r.Context(), userID, secret, step, codeHashes)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Remove(r.Context(), "totpSecret")
+
+	data := app.newTemplateData(r)
+	data.RecoveryCodes = codes
+	app.render(w, r, http.StatusOK, "recovery.html", data)
+}
+
+func (app *application) userTwoFactorDisablePost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	password := r.PostForm.Get("password")
+
+	user, err := app.users.Get(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	form := twoFactorForm{}
+	form.CheckField(validator.NotBlank(password), "password", "This field can't be blank")
+	if form.Valid() {
+		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+		if err != nil && !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			app.serverError(w, r, err)
+			return
+		}
+		form.CheckField(err == nil, "password", "Password is incorrect")
+	}
+
+	if !form.Valid() {
+		data, err := app.newTwoFactorTemplateData(w, r)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "twofactor.html", data)
+		return
+	}
+
+	err = app.users.ClearTOTP(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Two-factor authentication has been turned off.")
+	http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+}
+
+func (app *application) userTokens(w http.ResponseWriter, r *http.Request) {
+	data, err := app.newTokensTemplateData(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	data.Form = apiTokenForm{Scope: models.ScopeRead, ExpiresIn: "30"}
+	app.render(w, r, http.StatusOK, "tokens.html", data)
+}
+
+func (app *application) userTokensPost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	form := apiTokenForm{
+		Name:      strings.TrimSpace(r.PostForm.Get("name")),
+		Scope:     r.PostForm.Get("scope"),
+		ExpiresIn: r.PostForm.Get("expires_in"),
+	}
+
+	_, validLifetime := apiTokenLifetimes[form.ExpiresIn]
+
+	form.CheckField(validator.NotBlank(form.Name), "name", "This field can't be blank")
+	form.CheckField(validator.MaxChars(form.Name, 100), "name", "Name must be at most 100 characters")
+	form.CheckField(validator.PermittedValue(form.Scope, models.ScopeRead, models.ScopeWrite), "scope", "Choose read or write access")
+	form.CheckField(validLifetime, "expires_in", "Choose when the token expires")
+
+	if !form.Valid() {
+		data, err := app.newTokensTemplateData(r)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "tokens.html", data)
+		return
+	}
+
+	plaintext, hash, err := models.GenerateAPIToken()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	token := models.APIToken{
+		UserID:    uint(app.authenticatedUserID(r)),
+		Name:      form.Name,
+		TokenHash: hash,
+		Scope:     form.Scope,
+	}
+	if lifetime := apiTokenLifetimes[form.ExpiresIn]; lifetime > 0 {
+		expires := time.Now().Add(lifetime)
+		token.ExpiresAt = &expires
+	}
+
+	err = app.tokens.Insert(r.Context(), &token)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The plaintext token is shown once, on this response, and can't be
+	// recovered afterwards.
+	data, err := app.newTokensTemplateData(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	data.Form = apiTokenForm{Scope: models.ScopeRead, ExpiresIn: "30"}
+	data.NewAPIToken = plaintext
+	app.render(w, r, http.StatusCreated, "tokens.html", data)
+}
+
+func (app *application) userTokenRevokePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+
+	err = app.tokens.Delete(r.Context(), app.authenticatedUserID(r), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Token revoked.")
+	http.Redirect(w, r, "/user/tokens", http.StatusSeeOther)
+}
+
+func (app *application) userSessions(w http.ResponseWriter, r *http.Request) {
+	userID := app.authenticatedUserID(r)
+
+	err := app.sessions.DeleteExpired(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	sessions, err := app.sessions.ForUser(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Sessions = sessions
+	data.CurrentSession = app.sessionManager.Token(r.Context())
+	app.render(w, r, http.StatusOK, "sessions.html", data)
+}
+
+func (app *application) userSessionRevokePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+
+	session, err := app.sessions.Get(r.Context(), app.authenticatedUserID(r), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// Revoking the session this request came in on is just a logout.
+	if session.Token == app.sessionManager.Token(r.Context()) {
+		app.userLogoutPost(w, r)
+		return
+	}
+
+	err = app.revokeUserSessions(r.Context(), []models.UserSession{session})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Signed out of that device.")
+	http.Redirect(w, r, "/user/sessions", http.StatusSeeOther)
+}
+
+func (app *application) userSessionsRevokeOthersPost(w http.ResponseWriter, r *http.Request) {
+	err := app.revokeOtherSessions(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Signed out of all other devices.")
+	http.Redirect(w, r, "/user/sessions", http.StatusSeeOther)
+}
+
+func (app *application) userSettings(w http.ResponseWriter, r *http.Request) {
+	data, err := app.newSettingsTemplateData(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	data.Form = accountForm{UserName: data.User.UserName}
+	app.render(w, r, http.StatusOK, "settings.html", data)
+}
+
+func (app *application) userSettingsUsernamePost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	form := accountForm{UserName: strings.TrimSpace(r.PostForm.Get("username"))}
+	form.CheckField(validator.NotBlank(form.UserName), "username", "This field can't be blank")
+	form.CheckField(validator.MinChars(form.UserName, 3), "username", "Username must be at least 3 characters")
+	form.CheckField(validator.MaxChars(form.UserName, 255), "username", "Username must be at most 255 characters")
+
+	if form.Valid() {
+		err = app.users.UpdateUserName(r.Context(), app.authenticatedUserID(r), form.UserName)
+		if errors.Is(err, models.ErrDuplicateUsername) {
+			form.AddFieldError("username", "Username is already taken")
+		} else if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		app.renderSettings(w, r, form)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your username has been changed.")
+	http.Redirect(w, r, "/user/settings", http.StatusSeeOther)
+}
+
+func (app *application) userSettingsEmailPost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	password := r.PostForm.Get("email_password")
+	form := accountForm{Email: models.NormalizeEmail(r.PostForm.Get("email"))}
+
+	form.CheckField(validator.NotBlank(form.Email), "email", "This field can't be blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This is not an email")
+	form.CheckField(validator.NotBlank(password), "email_password", "This field can't be blank")
+
+	if form.Valid() {
+		ok, err := app.checkPassword(r.Context(), userID, password)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		form.CheckField(ok, "email_password", "Password is incorrect")
+	}
+
+	if form.Valid() {
+		taken, err := app.users.EmailTaken(r.Context(), form.Email)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		form.CheckField(!taken, "email", "Email address is already in use")
+	}
+
+	if !form.Valid() {
+		app.renderSettings(w, r, form)
+		return
+	}
+
+	token, hash, err := models.GenerateToken("")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Only the most recent request counts.
+	verification := models.EmailVerification{
+		UserID:    uint(userID),
+		Email:     form.Email,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(emailVerificationTimeout),
+	}
+	err = app.users.RequestEmailChange(r.Context(), &verification)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	link := app.baseURL + "/user/settings/email/verify?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi,\n\n"+
+		"Someone asked to use this address for a Movies4u account. If it was you, confirm the change within %s by opening:\n\n"+
+		"%s\n\n"+
+		"If it wasn't you, you can ignore this message.\n",
+		emailVerificationTimeout, link)
+	app.sendMail(form.Email, "Confirm your new Movies4u email address", body)
+
+	app.sessionManager.Put(r.Context(), "flash", "We've sent a confirmation link to "+form.Email+".")
+	http.Redirect(w, r, "/user/settings", http.StatusSeeOther)
+}
+
+func (app *application) userSettingsEmailVerify(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	verification, err := app.users.EmailVerification(r.Context(), models.HashToken(token))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.sessionManager.Put(r.Context(), "flash", "That confirmation link is invalid or has expired.")
+			http.Redirect(w, r, "/user/settings", http.StatusSeeOther)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	err = app.users.SetEmail(r.Context(), int(verification.UserID), verification.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateEmail) {
+			app.sessionManager.Put(r.Context(), "flash", "That email address is already in use.")
+			http.Redirect(w, r, "/user/settings", http.StatusSeeOther)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your email address has been changed.")
+	http.Redirect(w, r, "/user/settings", http.StatusSeeOther)
+}
+
+func (app *application) userSettingsPasswordPost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	current := r.PostForm.Get("current_password")
+	password := r.PostForm.Get("new_password")
+	confirmPassword := r.PostForm.Get("confirm_password")
+
+	form := accountForm{}
+	form.CheckField(validator.NotBlank(current), "current_password", "This field can't be blank")
+	form.CheckField(validator.NotBlank(password), "new_password", "This field can't be blank")
+	form.CheckField(validator.MinChars(password, 8), "new_password", "Password must be at least 8 characters")
+	form.CheckField(validator.PasswordsMatch(password, confirmPassword), "confirm_password", "Passwords do not match")
+
+	if form.Valid() {
+		ok, err := app.checkPassword(r.Context(), userID, current)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		form.CheckField(ok, "current_password", "Password is incorrect")
+	}
+
+	if !form.Valid() {
+		app.renderSettings(w, r, form)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.users.UpdatePassword(r.Context(), userID, string(hashedPassword))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	// The new password moved the user's version on; this session keeps
+	// up with it, and reading it afresh replaces the cached state.
+	state, err := app.userAuthState(r.Context(), userID, true)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "authVersion", state.Version)
+
+	// Anyone holding an old session loses it along with the old password.
+	err = app.renewUserSession(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.revokeOtherSessions(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been changed and your other devices signed out.")
+	http.Redirect(w, r, "/user/settings", http.StatusSeeOther)
+}
+
+func (app *application) userSettingsDeletePost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	password := r.PostForm.Get("delete_password")
+
+	form := accountForm{}
+	form.CheckField(validator.NotBlank(password), "delete_password", "This field can't be blank")
+
+	if form.Valid() {
+		ok, err := app.checkPassword(r.Context(), userID, password)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		form.CheckField(ok, "delete_password", "Password is incorrect")
+	}
+
+	if !form.Valid() {
+		app.renderSettings(w, r, form)
+		return
+	}
+
+	user, err := app.users.Get(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	sessions, err := app.sessions.ForUser(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.revokeUserSessions(r.Context(), sessions)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.exporter.RemoveUser(uint(userID))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.users.Delete(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.invalidateUser(r.Context(), userID)
+
+	err = app.throttle.Reset(user.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.sessionManager.Destroy(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your account has been deleted.")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (app *application) userExports(w http.ResponseWriter, r *http.Request) {
+	exports, err := app.exports.ForUser(r.Context(), app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Exports = exports
+	app.render(w, r, http.StatusOK, "export.html", data)
+}
+
+func (app *application) userExportsPost(w http.ResponseWriter, r *http.Request) {
+	userID := app.authenticatedUserID(r)
+
+	// One export in flight per user is plenty.
+	inFlight, err := app.exports.InFlight(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if inFlight {
+		app.sessionManager.Put(r.Context(), "flash", "Your export is already being prepared.")
+		http.Redirect(w, r, "/user/export", http.StatusSeeOther)
+		return
+	}
+
+	job := models.DataExport{UserID: uint(userID), Status: models.ExportPending}
+	err = app.exports.Insert(r.Context(), &job)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		app.processExport(job.ID)
+	})
+
+	app.sessionManager.Put(r.Context(), "flash", "We're preparing your data. We'll email you when it's ready.")
+	http.Redirect(w, r, "/user/export", http.StatusSeeOther)
+}
+
+func (app *application) userExportDownload(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+
+	// Other users' exports, and ones that aren't ready or have expired,
+	// are as good as missing.
+	job, err := app.exports.Get(r.Context(), id)
+	if err == nil && (job.UserID != uint(app.authenticatedUserID(r)) || job.Status != models.ExportReady || !job.ExpiresAt.After(time.Now())) {
+		err = models.ErrNoRecord
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	f, err := os.Open(app.exporter.Path(job.ID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			app.notFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	name := fmt.Sprintf("movies4u-export-%s.zip", job.CompletedAt.Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, name, *job.CompletedAt, f)
+}
+
+// healthz is the liveness probe: if the process can answer, it's alive.
+func (app *application) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyz is the readiness probe. The instance only takes traffic once the
+// database answers and the film catalogue has been loaded, and stops as soon
+// as it starts shutting down.
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"database":  "ok",
+		"catalogue": app.catalogue.Load().(string),
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	err := app.db.PingContext(ctx)
+	if err != nil {
+		checks["database"] = "unavailable"
+	}
+
+	status := "ok"
+	code := http.StatusOK
+	if checks["database"] != "ok" || checks["catalogue"] != catalogueReady || app.shuttingDown.Load() {
+		status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	if app.shuttingDown.Load() {
+		checks["server"] = "shutting down"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": checks})
 }
@@ -0,0 +1,880 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"movies4u.net/internals/logging"
+	"movies4u.net/internals/models"
+	"movies4u.net/internals/totp"
+)
+
+// routeTest is a single request and what the response should look like.
+// Empty fields aren't checked.
+type routeTest struct {
+	name         string
+	method       string
+	path         string
+	form         url.Values // sent as a form with a CSRF token when non-nil
+	json         string     // sent as JSON with a CSRF token when non-empty
+	header       http.Header
+	wantStatus   int
+	wantLocation string
+	wantBody     string
+}
+
+func (tt routeTest) run(t *testing.T, ts *testServer) testResponse {
+	t.Helper()
+
+	var res testResponse
+	switch {
+	case tt.form != nil:
+		res = ts.postForm(t, tt.path, tt.form)
+	case tt.json != "":
+		res = ts.sendJSON(t, tt.method, tt.path, tt.json)
+	default:
+		res = ts.do(t, tt.method, tt.path, tt.header, nil)
+	}
+
+	if res.status != tt.wantStatus {
+		t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, res.status, tt.wantStatus)
+	}
+	if tt.wantLocation != "" && res.header.Get("Location") != tt.wantLocation {
+		t.Errorf("%s %s: got location %q, want %q", tt.method, tt.path, res.header.Get("Location"), tt.wantLocation)
+	}
+	if tt.wantBody != "" && !strings.Contains(res.body, tt.wantBody) {
+		t.Errorf("%s %s: body does not contain %q", tt.method, tt.path, tt.wantBody)
+	}
+	return res
+}
+
+func runRouteTests(t *testing.T, ts *testServer, tests []routeTest) {
+	t.Helper()
+
+	for _, tt := range tests {
+		if tt.method == "" {
+			tt.method = http.MethodGet
+			if tt.form != nil {
+				tt.method = http.MethodPost
+			}
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, ts)
+		})
+	}
+}
+
+func TestPublicRoutes(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "healthz", path: "/healthz", wantStatus: http.StatusOK, wantBody: `"status":"ok"`},
+		{name: "readyz", path: "/readyz", wantStatus: http.StatusOK, wantBody: `"catalogue":"ok"`},
+		{name: "login page", path: "/user/login", wantStatus: http.StatusOK, wantBody: `name='csrf_token'`},
+		{name: "signin page", path: "/user/signin", wantStatus: http.StatusOK, wantBody: `name="confirm_password"`},
+		{name: "totp page without a pending login", path: "/user/login/totp", wantStatus: http.StatusSeeOther, wantLocation: "/user/login"},
+		{name: "totp post without a pending login", path: "/user/login/totp", form: url.Values{"code": {"123456"}}, wantStatus: http.StatusSeeOther, wantLocation: "/user/login"},
+		{name: "email verification with a bad token", path: "/user/settings/email/verify?token=nope", wantStatus: http.StatusSeeOther, wantLocation: "/user/settings"},
+		{name: "static file", path: "/static/css/main.css", wantStatus: http.StatusOK},
+		{name: "missing static file", path: "/static/css/nope.css", wantStatus: http.StatusNotFound},
+		{name: "logout with GET", path: "/user/logout", wantStatus: http.StatusMethodNotAllowed},
+		{name: "login with OPTIONS", method: http.MethodOptions, path: "/user/login", wantStatus: http.StatusMethodNotAllowed},
+		{name: "film create with GET", path: "/film/create", wantStatus: http.StatusMethodNotAllowed},
+		{name: "form without a CSRF token", path: "/user/login", form: url.Values{"csrf_token": {""}}, wantStatus: http.StatusForbidden},
+	})
+}
+
+func TestReadyzReportsCatalogue(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.catalogue.Store(catalogueLoading)
+	ts := newTestServer(t, app.routes())
+
+	res := ts.get(t, "/readyz")
+	if res.status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", res.status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReadyzReportsDatabase(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.db = &testDB{err: errors.New("connection refused")}
+	ts := newTestServer(t, app.routes())
+
+	routeTest{path: "/readyz", wantStatus: http.StatusServiceUnavailable, wantBody: `"database":"unavailable"`}.run(t, ts)
+}
+
+// TestProtectedRoutesRequireLogin covers every route behind
+// requireAuthentication. Pages redirect to the login page, while JSON routes
+// and clients asking for JSON get a 401 error.
+func TestProtectedRoutesRequireLogin(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	var tests []routeTest
+	for _, path := range []string{
+		"/", "/film/search", "/user/2fa", "/user/tokens", "/user/settings", "/user/export",
+		"/user/export/1/download", "/user/sessions", "/admin/lockouts",
+	} {
+		tests = append(tests, routeTest{name: "GET " + path, path: path, wantStatus: http.StatusSeeOther, wantLocation: "/user/login"})
+	}
+	for _, path := range []string{
+		"/user/logout", "/user/2fa/enable", "/user/2fa/disable", "/user/tokens", "/user/tokens/1/revoke",
+		"/user/settings/username", "/user/settings/email", "/user/settings/password", "/user/settings/delete",
+		"/user/export", "/user/sessions/1/revoke", "/user/sessions/revoke-others", "/admin/lockouts/unlock",
+	} {
+		tests = append(tests, routeTest{name: "POST " + path, path: path, form: url.Values{}, wantStatus: http.StatusSeeOther, wantLocation: "/user/login"})
+	}
+	unauthorized := `"code":"unauthorized"`
+	for _, path := range []string{"/films/1", "/films", "/watchlist", "/watchedlist"} {
+		tests = append(tests, routeTest{name: "GET " + path, path: path, wantStatus: http.StatusUnauthorized, wantBody: unauthorized})
+	}
+	tests = append(tests,
+		routeTest{name: "POST /film/search", method: http.MethodPost, path: "/film/search", json: `{"Film":"heat"}`, wantStatus: http.StatusUnauthorized, wantBody: unauthorized},
+		routeTest{name: "PUT /watchlist", method: http.MethodPut, path: "/watchlist", json: `{"id":1}`, wantStatus: http.StatusUnauthorized, wantBody: unauthorized},
+		routeTest{name: "PUT /watchedlist", method: http.MethodPut, path: "/watchedlist", json: `{"id":1}`, wantStatus: http.StatusUnauthorized, wantBody: unauthorized},
+		routeTest{name: "page asking for JSON", path: "/user/settings", header: http.Header{"Accept": {"application/json"}}, wantStatus: http.StatusUnauthorized, wantBody: unauthorized},
+	)
+
+	runRouteTests(t, ts, tests)
+}
+
+func TestUserSignin(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+
+	form := func(userName, email, password, confirm string) url.Values {
+		return url.Values{"username": {userName}, "email": {email}, "password": {password}, "confirm_password": {confirm}}
+	}
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "valid", path: "/user/signin", form: form("bob", "bob@example.com", "password1", "password1"), wantStatus: http.StatusSeeOther, wantLocation: "/user/login"},
+		{name: "duplicate email", path: "/user/signin", form: form("carol", " ALICE@example.com", "password1", "password1"), wantStatus: http.StatusUnprocessableEntity, wantBody: "Email address is already in use"},
+		{name: "duplicate username", path: "/user/signin", form: form("alice", "carol@example.com", "password1", "password1"), wantStatus: http.StatusUnprocessableEntity, wantBody: "Username is already taken"},
+		{name: "short password", path: "/user/signin", form: form("dave", "dave@example.com", "pass", "pass"), wantStatus: http.StatusUnprocessableEntity, wantBody: "Password must be at least 8 characters"},
+		{name: "passwords differ", path: "/user/signin", form: form("dave", "dave@example.com", "password1", "password2"), wantStatus: http.StatusUnprocessableEntity, wantBody: "Passwords do not match"},
+		{name: "bad email", path: "/user/signin", form: form("dave", "dave", "password1", "password1"), wantStatus: http.StatusUnprocessableEntity, wantBody: "This is not an email"},
+	})
+
+	_, err := app.users.GetByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Errorf("signed-up user not stored: %v", err)
+	}
+}
+
+func TestUserLogin(t *testing.T) {
+	app, _ := newTestApplication(t)
+	alice := addTestUser(t, app, "alice", "alice@example.com", false)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tess := models.User{UserName: "tess", Email: "tess@example.com", Password: alice.Password, TOTPSecret: secret, TOTPEnabled: true}
+	err = app.users.Insert(context.Background(), &tess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "wrong password", path: "/user/login", form: url.Values{"email": {"alice@example.com"}, "password": {"wrong password"}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "Email or password is incorrect"},
+		{name: "unknown email", path: "/user/login", form: url.Values{"email": {"nobody@example.com"}, "password": {testPassword}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "Email or password is incorrect"},
+		{name: "blank password", path: "/user/login", form: url.Values{"email": {"alice@example.com"}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "This field can&#39;t be blank"},
+		{name: "valid", path: "/user/login", form: url.Values{"email": {"Alice@Example.com"}, "password": {testPassword}}, wantStatus: http.StatusSeeOther, wantLocation: "/"},
+		{name: "home once signed in", path: "/", wantStatus: http.StatusOK},
+		{name: "logout", path: "/user/logout", form: url.Values{}, wantStatus: http.StatusSeeOther, wantLocation: "/"},
+		{name: "home after logout", path: "/", wantStatus: http.StatusSeeOther, wantLocation: "/user/login"},
+		{name: "two-factor user", path: "/user/login", form: url.Values{"email": {"tess@example.com"}, "password": {testPassword}}, wantStatus: http.StatusSeeOther, wantLocation: "/user/login/totp"},
+		{name: "two-factor user not signed in yet", path: "/", wantStatus: http.StatusSeeOther, wantLocation: "/user/login"},
+		{name: "totp page", path: "/user/login/totp", wantStatus: http.StatusOK, wantBody: `name="code"`},
+		{name: "blank code", path: "/user/login/totp", form: url.Values{"code": {""}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "This field can&#39;t be blank"},
+	})
+}
+
+func TestSignedInPages(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "home", path: "/", wantStatus: http.StatusOK},
+		{name: "unknown page", path: "/nope", wantStatus: http.StatusNotFound},
+		{name: "search page", path: "/film/search", wantStatus: http.StatusSeeOther, wantLocation: "/"},
+		{name: "two-factor settings", path: "/user/2fa", wantStatus: http.StatusOK, wantBody: "otpauth://"},
+		{name: "tokens", path: "/user/tokens", wantStatus: http.StatusOK},
+		{name: "settings", path: "/user/settings", wantStatus: http.StatusOK, wantBody: "alice@example.com"},
+		{name: "exports", path: "/user/export", wantStatus: http.StatusOK},
+		{name: "missing export", path: "/user/export/1/download", wantStatus: http.StatusNotFound},
+		{name: "sessions", path: "/user/sessions", wantStatus: http.StatusOK},
+		{name: "admin page", path: "/admin/lockouts", wantStatus: http.StatusNotFound},
+		{name: "admin unlock", path: "/admin/lockouts/unlock", form: url.Values{"subject": {"ip:192.0.2.1"}}, wantStatus: http.StatusNotFound},
+	})
+}
+
+func TestAdminRoutes(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "root", "root@example.com", true)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "root@example.com")
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "lockouts", path: "/admin/lockouts", wantStatus: http.StatusOK},
+		{name: "unlock", path: "/admin/lockouts/unlock", form: url.Values{"subject": {"ip:192.0.2.1"}}, wantStatus: http.StatusSeeOther, wantLocation: "/admin/lockouts"},
+		{name: "unlock without a subject", path: "/admin/lockouts/unlock", form: url.Values{}, wantStatus: http.StatusBadRequest},
+	})
+}
+
+// filmJSON is the shape of a film in JSON responses.
+type filmJSON struct {
+	ID             uint   `json:"id"`
+	Name           string `json:"name"`
+	Year           int    `json:"year"`
+	Genres         []any  `json:"genres"`
+	Directors      []any  `json:"directors"`
+	Stars          []any  `json:"stars"`
+	WatchlistCount int64  `json:"watchlist_count"`
+	WatchedCount   int64  `json:"watched_count"`
+	OnWatchlist    bool   `json:"on_watchlist"`
+	Watched        bool   `json:"watched"`
+}
+
+func decodeJSON[T any](t *testing.T, res testResponse) T {
+	t.Helper()
+
+	if ct := res.header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("got content type %q, want application/json", ct)
+	}
+
+	var v T
+	err := json.Unmarshal([]byte(res.body), &v)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", res.body, err)
+	}
+	return v
+}
+
+// countingUsers counts the users read through a UserStore.
+type countingUsers struct {
+	models.UserStore
+	gets int
+}
+
+func (u *countingUsers) Get(ctx context.Context, id int) (models.User, error) {
+	u.gets++
+	return u.UserStore.Get(ctx, id)
+}
+
+func TestAuthenticateCache(t *testing.T) {
+	app, store := newTestApplication(t)
+	alice := addTestUser(t, app, "alice", "alice@example.com", false)
+	users := &countingUsers{UserStore: app.users}
+	app.users = users
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	users.gets = 0
+	for range 3 {
+		routeTest{method: http.MethodGet, path: "/films/1", wantStatus: http.StatusOK}.run(t, ts)
+	}
+	if users.gets != 0 {
+		t.Errorf("authenticated requests read the user %d times", users.gets)
+	}
+
+	// Another instance makes alice an admin. Her session outlives the
+	// change only until this instance's cached state goes.
+	err := store.Users().SetAdmin(context.Background(), int(alice.ID), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routeTest{method: http.MethodGet, path: "/films/1", wantStatus: http.StatusOK}.run(t, ts)
+
+	app.invalidateUser(context.Background(), int(alice.ID))
+	routeTest{method: http.MethodGet, path: "/films/1", wantStatus: http.StatusUnauthorized}.run(t, ts)
+
+	// Signing in again picks up the new version and role.
+	ts.login(t, "alice@example.com")
+	routeTest{method: http.MethodGet, path: "/admin/lockouts", wantStatus: http.StatusOK}.run(t, ts)
+}
+
+func TestFilmsJSON(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "missing film", path: "/films/5", wantStatus: http.StatusNotFound},
+		{name: "bad id", path: "/films/abc", wantStatus: http.StatusNotFound},
+		{name: "search with bad JSON", method: http.MethodPost, path: "/film/search", json: `{`, wantStatus: http.StatusBadRequest},
+	})
+
+	t.Run("film", func(t *testing.T) {
+		film := decodeJSON[filmJSON](t, routeTest{method: http.MethodGet, path: "/films/1", wantStatus: http.StatusOK}.run(t, ts))
+		if film.ID != 1 || film.Name != "The Matrix" || len(film.Genres) != 1 || len(film.Directors) != 1 || len(film.Stars) != 1 {
+			t.Errorf("got %+v", film)
+		}
+		if film.WatchlistCount != 0 || film.WatchedCount != 0 || film.OnWatchlist || film.Watched {
+			t.Errorf("film should be on no lists, got %+v", film)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		films := decodeJSON[[]filmJSON](t, routeTest{method: http.MethodGet, path: "/films?start=1&end=2", wantStatus: http.StatusOK}.run(t, ts))
+		if len(films) != 2 || films[0].ID != 1 || films[1].ID != 2 {
+			t.Errorf("got %+v", films)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		films := decodeJSON[[]filmJSON](t, routeTest{method: http.MethodPost, path: "/film/search", json: `{"Film":"HEA"}`, wantStatus: http.StatusOK}.run(t, ts))
+		if len(films) != 1 || films[0].Name != "Heat" {
+			t.Errorf("got %+v", films)
+		}
+	})
+}
+
+func TestJSONErrors(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	tests := []struct {
+		routeTest
+		wantCode   string
+		wantFields []string
+	}{
+		{routeTest{name: "missing film", path: "/films/5", wantStatus: http.StatusNotFound}, "not_found", nil},
+		{routeTest{name: "bad range", path: "/films?start=a&end=b", wantStatus: http.StatusUnprocessableEntity}, "validation_failed", []string{"start", "end"}},
+		{routeTest{name: "bad JSON", method: http.MethodPut, path: "/watchlist", json: `{"id":`, wantStatus: http.StatusBadRequest}, "bad_request", nil},
+		{routeTest{name: "unknown film", method: http.MethodPut, path: "/watchedlist", json: `{"id":77}`, wantStatus: http.StatusUnprocessableEntity}, "validation_failed", []string{"id"}},
+		{routeTest{name: "page asking for JSON", path: "/nowhere", header: http.Header{"Accept": {"application/json"}}, wantStatus: http.StatusNotFound}, "not_found", nil},
+	}
+
+	for _, tt := range tests {
+		if tt.method == "" {
+			tt.method = http.MethodGet
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.run(t, ts)
+			if got := res.header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("got Content-Type %q", got)
+			}
+
+			body := decodeJSON[errorResponse](t, res)
+			if body.Error.Code != tt.wantCode || body.Error.Message == "" {
+				t.Errorf("got %+v", body.Error)
+			}
+			if body.Error.RequestID == "" || body.Error.RequestID != res.header.Get("X-Request-ID") {
+				t.Errorf("got request ID %q, header %q", body.Error.RequestID, res.header.Get("X-Request-ID"))
+			}
+			if len(body.Error.Fields) != len(tt.wantFields) {
+				t.Errorf("got fields %v, want %v", body.Error.Fields, tt.wantFields)
+			}
+			for _, field := range tt.wantFields {
+				if body.Error.Fields[field] == "" {
+					t.Errorf("no error for %s in %v", field, body.Error.Fields)
+				}
+			}
+		})
+	}
+
+	t.Run("page", func(t *testing.T) {
+		res := routeTest{method: http.MethodGet, path: "/nowhere", header: http.Header{"Accept": {"text/html,application/xhtml+xml,*/*;q=0.8"}}, wantStatus: http.StatusNotFound}.run(t, ts)
+		if got := res.header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+			t.Errorf("got Content-Type %q", got)
+		}
+	})
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json", true},
+		{"application/json, text/plain, */*", true},
+		{"application/*;q=0.9, text/html;q=0.5", true},
+		{"text/html;q=0.5, application/json;q=0.5", false},
+		{"*/*, text/html;q=0.1", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := wantsJSON(r); got != tt.want {
+			t.Errorf("%q: got %t, want %t", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestFilmCache(t *testing.T) {
+	app, store := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	filmName := func() string {
+		t.Helper()
+		return decodeJSON[filmJSON](t, ts.get(t, "/films/1")).Name
+	}
+	genreName := func() string {
+		t.Helper()
+		return decodeJSON[models.Genre](t, ts.get(t, "/api/v1/genres/1")).Name
+	}
+
+	if name, genre := filmName(), genreName(); name != "The Matrix" || genre != "Sci-Fi" {
+		t.Fatalf("got %q and %q", name, genre)
+	}
+
+	renamed := testFilmMatrix
+	renamed.Name = "The Matrix Reloaded"
+	renamed.Genres = []models.Genre{{ID: 1, Name: "Science Fiction"}}
+	store.AddFilm(renamed)
+	if name, genre := filmName(), genreName(); name != "The Matrix" || genre != "Sci-Fi" {
+		t.Errorf("before invalidating got %q and %q, want the cached names", name, genre)
+	}
+
+	// Credits share the films' cache, so one invalidation drops both.
+	app.invalidateFilms(context.Background())
+	if name, genre := filmName(), genreName(); name != renamed.Name || genre != "Science Fiction" {
+		t.Errorf("after invalidating got %q and %q", name, genre)
+	}
+
+	scrape := httptest.NewRecorder()
+	app.metrics.Handler().ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`movies4u_cache_lookups_total{kind="film",result="hit"} 1`,
+		`movies4u_cache_lookups_total{kind="film",result="miss"} 2`,
+		`movies4u_cache_lookups_total{kind="genre",result="hit"} 1`,
+		`movies4u_cache_lookups_total{kind="genre",result="miss"} 2`,
+	} {
+		if !strings.Contains(scrape.Body.String(), want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	addTestUser(t, app, "bob", "bob@example.com", false)
+	alice := newTestServer(t, app.routes())
+	alice.login(t, "alice@example.com")
+	bob := newTestServer(t, app.routes())
+	bob.login(t, "bob@example.com")
+
+	// GET /films allows a burst of 20.
+	for want := 19; want >= 0; want-- {
+		res := routeTest{method: http.MethodGet, path: "/films", wantStatus: http.StatusOK}.run(t, alice)
+		if got := res.header.Get("RateLimit-Remaining"); got != strconv.Itoa(want) {
+			t.Fatalf("got RateLimit-Remaining %q, want %d", got, want)
+		}
+	}
+
+	res := routeTest{method: http.MethodGet, path: "/films", wantStatus: http.StatusTooManyRequests}.run(t, alice)
+	for _, name := range []string{"Retry-After", "RateLimit-Limit", "RateLimit-Reset"} {
+		if value, err := strconv.Atoi(res.header.Get(name)); err != nil || value <= 0 {
+			t.Errorf("got %s %q", name, res.header.Get(name))
+		}
+	}
+
+	// Buckets are per user and per route.
+	routeTest{method: http.MethodGet, path: "/films", wantStatus: http.StatusOK}.run(t, bob)
+	routeTest{method: http.MethodGet, path: "/films/1", wantStatus: http.StatusOK}.run(t, alice)
+
+	scrape := httptest.NewRecorder()
+	app.metrics.Handler().ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `movies4u_rate_limited_requests_total{route="GET /films"} 1`; !strings.Contains(scrape.Body.String(), want) {
+		t.Errorf("metrics don't contain %s", want)
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	for _, path := range []string{"/films/1", "/films/2"} {
+		routeTest{method: http.MethodGet, path: path, wantStatus: http.StatusOK}.run(t, ts)
+	}
+
+	// Requests are labelled with the pattern they matched, so film IDs
+	// can't create a series each.
+	scrape := httptest.NewRecorder()
+	app.metrics.Handler().ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := scrape.Body.String()
+	if want := `movies4u_http_requests_total{method="GET",route="GET /films/{id}",status="200"} 2`; !strings.Contains(body, want) {
+		t.Errorf("metrics don't contain %s", want)
+	}
+	if strings.Contains(body, `route="/films/1"`) || strings.Contains(body, `route="GET /films/1"`) {
+		t.Error("metrics are labelled with the raw path")
+	}
+}
+
+// panicStore is a session store that panics, standing in for middleware
+// failing below the handlers.
+type panicStore struct{}
+
+func (panicStore) Find(token string) ([]byte, bool, error)          { panic("store down") }
+func (panicStore) Commit(token string, b []byte, e time.Time) error { panic("store down") }
+func (panicStore) Delete(token string) error                        { panic("store down") }
+
+func TestRecoverPanic(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		store   bool // whether the session store panics
+		want    string
+	}{
+		{"handler", func(w http.ResponseWriter, r *http.Request) { panic("boom") }, false, "boom"},
+		{"session store", func(w http.ResponseWriter, r *http.Request) {}, true, "store down"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+			var logs strings.Builder
+			app.logger = logging.New(&logs, "json", slog.LevelInfo)
+			if tt.store {
+				app.sessionManager.Store = panicStore{}
+			}
+			ts := newTestServer(t, app.middleware(tt.handler))
+
+			header := http.Header{"Cookie": {app.sessionManager.Cookie.Name + "=token"}}
+			res := routeTest{method: http.MethodGet, path: "/", header: header, wantStatus: http.StatusInternalServerError}.run(t, ts)
+			id := res.header.Get("X-Request-ID")
+
+			// The panic is logged with the request ID, and the access log
+			// and the request metrics record the 500 it became.
+			var sawPanic, sawRequest bool
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var rec map[string]any
+				err := json.Unmarshal([]byte(line), &rec)
+				if err != nil {
+					t.Fatalf("%v: %s", err, line)
+				}
+				if rec["request_id"] != id {
+					t.Errorf("got request ID %v, want %q", rec["request_id"], id)
+				}
+				switch rec["msg"] {
+				case tt.want:
+					sawPanic = true
+				case "request":
+					sawRequest = rec["status"] == float64(http.StatusInternalServerError)
+				}
+			}
+			if !sawPanic || !sawRequest {
+				t.Errorf("got logs %s", logs.String())
+			}
+
+			scrape := httptest.NewRecorder()
+			app.metrics.Handler().ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if want := `movies4u_http_requests_total{method="GET",route="unmatched",status="500"} 1`; !strings.Contains(scrape.Body.String(), want) {
+				t.Errorf("metrics don't contain %s", want)
+			}
+		})
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	res := ts.get(t, "/films/1")
+	etag, lastModified := res.header.Get("ETag"), res.header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("got ETag %q, Last-Modified %q", etag, lastModified)
+	}
+	if got := res.header.Get("Cache-Control"); got != cacheRevalidate {
+		t.Errorf("got Cache-Control %q, want %q", got, cacheRevalidate)
+	}
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "matching ETag", path: "/films/1", header: http.Header{"If-None-Match": {etag}}, wantStatus: http.StatusNotModified},
+		{name: "other ETag", path: "/films/1", header: http.Header{"If-None-Match": {`"stale"`}}, wantStatus: http.StatusOK},
+		{name: "not modified since", path: "/films/1", header: http.Header{"If-Modified-Since": {lastModified}}, wantStatus: http.StatusNotModified},
+		{name: "modified since", path: "/films/1", header: http.Header{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, wantStatus: http.StatusOK},
+		{name: "ETag wins over date", path: "/films/1", header: http.Header{"If-None-Match": {`"stale"`}, "If-Modified-Since": {lastModified}}, wantStatus: http.StatusOK},
+	})
+
+	t.Run("list change", func(t *testing.T) {
+		routeTest{method: http.MethodPut, path: "/watchlist", json: `{"id":1}`, wantStatus: http.StatusOK}.run(t, ts)
+		routeTest{method: http.MethodGet, path: "/films/1", header: http.Header{"If-None-Match": {etag}}, wantStatus: http.StatusOK}.run(t, ts)
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		res := ts.get(t, "/user/settings")
+		if got := res.header.Get("Cache-Control"); !strings.HasPrefix(got, cacheNoStore) {
+			t.Errorf("got Cache-Control %q, want %q", got, cacheNoStore)
+		}
+	})
+}
+
+func TestStaticAssets(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	fingerprinted := app.static.URL("js/index.js")
+	if fingerprinted == "/static/js/index.js" {
+		t.Fatal("index.js isn't fingerprinted")
+	}
+
+	login := ts.get(t, "/user/login")
+	if !strings.Contains(login.body, app.static.URL("css/styles.css")) {
+		t.Error("pages don't link to the fingerprinted stylesheet")
+	}
+
+	for _, tt := range []struct {
+		path             string
+		wantCacheControl string
+	}{
+		{fingerprinted, "public, max-age=31536000, immutable"},
+		{"/static/js/index.js", "public, no-cache"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			res := ts.get(t, tt.path)
+			if res.status != http.StatusOK || !strings.Contains(res.header.Get("Content-Type"), "javascript") {
+				t.Fatalf("got status %d, content type %q", res.status, res.header.Get("Content-Type"))
+			}
+			if got := res.header.Get("Cache-Control"); got != tt.wantCacheControl {
+				t.Errorf("got Cache-Control %q, want %q", got, tt.wantCacheControl)
+			}
+			routeTest{method: http.MethodGet, path: tt.path, header: http.Header{"If-None-Match": {res.header.Get("ETag")}}, wantStatus: http.StatusNotModified}.run(t, ts)
+		})
+	}
+
+	routeTest{method: http.MethodGet, path: "/static/js/index.0123456789.js", wantStatus: http.StatusNotFound}.run(t, ts)
+}
+
+func TestListsJSON(t *testing.T) {
+	for _, list := range []string{models.ListWatchlist, models.ListWatchedlist} {
+		t.Run(list, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+			addTestUser(t, app, "alice", "alice@example.com", false)
+			ts := newTestServer(t, app.routes())
+			ts.login(t, "alice@example.com")
+
+			path := "/" + list
+			runRouteTests(t, ts, []routeTest{
+				{name: "add", method: http.MethodPut, path: path, json: `{"id":1,"` + list + `":false}`, wantStatus: http.StatusOK, wantBody: `{"` + list + `":false}`},
+				{name: "add again", method: http.MethodPut, path: path, json: `{"id":1,"` + list + `":false}`, wantStatus: http.StatusOK},
+				{name: "add unknown film", method: http.MethodPut, path: path, json: `{"id":77}`, wantStatus: http.StatusUnprocessableEntity},
+				{name: "add out of range film", method: http.MethodPut, path: path, json: `{"id":10000}`, wantStatus: http.StatusUnprocessableEntity},
+				{name: "bad JSON", method: http.MethodPut, path: path, json: `[`, wantStatus: http.StatusBadRequest},
+			})
+
+			films := decodeJSON[[]filmJSON](t, ts.get(t, path))
+			if len(films) != 1 || films[0].ID != 1 {
+				t.Fatalf("after adding got %+v", films)
+			}
+
+			film := decodeJSON[filmJSON](t, ts.get(t, "/films/1"))
+			count, mine := film.WatchlistCount, film.OnWatchlist
+			if list == models.ListWatchedlist {
+				count, mine = film.WatchedCount, film.Watched
+			}
+			if count != 1 || !mine {
+				t.Errorf("film has count %d, mine %t for %s", count, mine, list)
+			}
+
+			routeTest{method: http.MethodPut, path: path, json: `{"id":1,"` + list + `":true}`, wantStatus: http.StatusOK}.run(t, ts)
+			films = decodeJSON[[]filmJSON](t, ts.get(t, path))
+			if len(films) != 0 {
+				t.Errorf("after removing got %+v", films)
+			}
+		})
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	app, _ := newTestApplication(t)
+	alice := addTestUser(t, app, "alice", "alice@example.com", false)
+	read := addTestAPIToken(t, app, alice.ID, models.ScopeRead)
+	write := addTestAPIToken(t, app, alice.ID, models.ScopeWrite)
+	ts := newTestServer(t, app.routes())
+
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}, "Content-Type": {"application/json"}}
+	}
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "read with read token", path: "/films/1", header: bearer(read), wantStatus: http.StatusOK},
+		{name: "list with read token", path: "/watchlist", header: bearer(read), wantStatus: http.StatusOK},
+		{name: "bad token", path: "/films/1", header: bearer("m4u_nope"), wantStatus: http.StatusUnauthorized},
+		{name: "not a bearer token", path: "/films/1", header: http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, wantStatus: http.StatusUnauthorized},
+		{name: "browser route with token", path: "/user/settings", header: bearer(read), wantStatus: http.StatusForbidden},
+	})
+
+	t.Run("write with read token", func(t *testing.T) {
+		res := ts.do(t, http.MethodPut, "/watchlist", bearer(read), strings.NewReader(`{"id":1}`))
+		if res.status != http.StatusForbidden {
+			t.Errorf("got status %d, want %d", res.status, http.StatusForbidden)
+		}
+	})
+
+	// Token requests carry no cookies, so they skip the CSRF check.
+	t.Run("write with write token", func(t *testing.T) {
+		res := ts.do(t, http.MethodPut, "/watchlist", bearer(write), strings.NewReader(`{"id":1}`))
+		if res.status != http.StatusOK {
+			t.Errorf("got status %d, want %d", res.status, http.StatusOK)
+		}
+	})
+}
+
+func TestUserTokens(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "create", path: "/user/tokens", form: url.Values{"name": {"script"}, "scope": {models.ScopeRead}, "expires_in": {"30"}}, wantStatus: http.StatusCreated, wantBody: models.APITokenPrefix},
+		{name: "create without a name", path: "/user/tokens", form: url.Values{"scope": {models.ScopeRead}, "expires_in": {"30"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "create with a bad scope", path: "/user/tokens", form: url.Values{"name": {"x"}, "scope": {"admin"}, "expires_in": {"30"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "revoke", path: "/user/tokens/1/revoke", form: url.Values{}, wantStatus: http.StatusSeeOther, wantLocation: "/user/tokens"},
+		{name: "revoke again", path: "/user/tokens/1/revoke", form: url.Values{}, wantStatus: http.StatusNotFound},
+		{name: "revoke bad id", path: "/user/tokens/abc/revoke", form: url.Values{}, wantStatus: http.StatusNotFound},
+	})
+}
+
+func TestUserSessions(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	other := newTestServer(t, app.routes())
+	other.login(t, "alice@example.com")
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "list", path: "/user/sessions", wantStatus: http.StatusOK},
+		{name: "revoke missing", path: "/user/sessions/99/revoke", form: url.Values{}, wantStatus: http.StatusNotFound},
+		{name: "revoke bad id", path: "/user/sessions/abc/revoke", form: url.Values{}, wantStatus: http.StatusNotFound},
+		{name: "revoke others", path: "/user/sessions/revoke-others", form: url.Values{}, wantStatus: http.StatusSeeOther, wantLocation: "/user/sessions"},
+		{name: "still signed in", path: "/", wantStatus: http.StatusOK},
+	})
+
+	res := other.get(t, "/")
+	if res.status != http.StatusSeeOther {
+		t.Errorf("revoked session: got status %d, want %d", res.status, http.StatusSeeOther)
+	}
+}
+
+func TestUserSettings(t *testing.T) {
+	app, _ := newTestApplication(t)
+	alice := addTestUser(t, app, "alice", "alice@example.com", false)
+	addTestUser(t, app, "bob", "bob@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "username", path: "/user/settings/username", form: url.Values{"username": {"alicia"}}, wantStatus: http.StatusSeeOther, wantLocation: "/user/settings"},
+		{name: "taken username", path: "/user/settings/username", form: url.Values{"username": {"bob"}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "Username is already taken"},
+		{name: "short username", path: "/user/settings/username", form: url.Values{"username": {"al"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "email", path: "/user/settings/email", form: url.Values{"email": {"new@example.com"}, "email_password": {testPassword}}, wantStatus: http.StatusSeeOther, wantLocation: "/user/settings"},
+		{name: "taken email", path: "/user/settings/email", form: url.Values{"email": {"BOB@example.com"}, "email_password": {testPassword}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "Email address is already in use"},
+		{name: "email with wrong password", path: "/user/settings/email", form: url.Values{"email": {"new@example.com"}, "email_password": {"wrong password"}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "Password is incorrect"},
+		{name: "password with wrong current password", path: "/user/settings/password", form: url.Values{"current_password": {"wrong password"}, "new_password": {"new password"}, "confirm_password": {"new password"}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "Password is incorrect"},
+		{name: "password mismatch", path: "/user/settings/password", form: url.Values{"current_password": {testPassword}, "new_password": {"new password"}, "confirm_password": {"other password"}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "Passwords do not match"},
+		{name: "password", path: "/user/settings/password", form: url.Values{"current_password": {testPassword}, "new_password": {"new password"}, "confirm_password": {"new password"}}, wantStatus: http.StatusSeeOther, wantLocation: "/user/settings"},
+		{name: "delete with wrong password", path: "/user/settings/delete", form: url.Values{"delete_password": {testPassword}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "Password is incorrect"},
+		{name: "delete", path: "/user/settings/delete", form: url.Values{"delete_password": {"new password"}}, wantStatus: http.StatusSeeOther, wantLocation: "/user/login"},
+		{name: "signed out after delete", path: "/", wantStatus: http.StatusSeeOther, wantLocation: "/user/login"},
+	})
+
+	_, err := app.users.Get(context.Background(), int(alice.ID))
+	if err != models.ErrNoRecord {
+		t.Errorf("deleted user: got error %v, want %v", err, models.ErrNoRecord)
+	}
+}
+
+func TestUserExports(t *testing.T) {
+	app, _ := newTestApplication(t)
+	addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "request", path: "/user/export", form: url.Values{}, wantStatus: http.StatusSeeOther, wantLocation: "/user/export"},
+		{name: "list", path: "/user/export", wantStatus: http.StatusOK},
+		{name: "download someone else's", path: "/user/export/99/download", wantStatus: http.StatusNotFound},
+		{name: "download bad id", path: "/user/export/abc/download", wantStatus: http.StatusNotFound},
+	})
+}
+
+var totpSecretRX = regexp.MustCompile(`<code>([A-Z2-7]+)</code>`)
+
+func TestUserTwoFactor(t *testing.T) {
+	app, _ := newTestApplication(t)
+	alice := addTestUser(t, app, "alice", "alice@example.com", false)
+	ts := newTestServer(t, app.routes())
+	ts.login(t, "alice@example.com")
+
+	routeTest{name: "enable before enrolling", path: "/user/2fa/enable", form: url.Values{"code": {"000000"}}, wantStatus: http.StatusSeeOther, wantLocation: "/user/2fa"}.run(t, ts)
+
+	// Visiting the page starts enrolment with a secret kept in the session.
+	matches := totpSecretRX.FindStringSubmatch(ts.get(t, "/user/2fa").body)
+	if len(matches) < 2 {
+		t.Fatal("no secret on the two-factor page")
+	}
+	code, err := totp.GenerateCode(matches[1], totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "enable with a blank code", path: "/user/2fa/enable", form: url.Values{"code": {""}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "enable with a wrong code", path: "/user/2fa/enable", form: url.Values{"code": {"000000"}}, wantStatus: http.StatusUnprocessableEntity, wantBody: "This code is not valid"},
+		{name: "enable", path: "/user/2fa/enable", form: url.Values{"code": {code}}, wantStatus: http.StatusOK},
+	})
+	checkTwoFactor(t, app, alice, true)
+
+	runRouteTests(t, ts, []routeTest{
+		{name: "disable with a wrong password", path: "/user/2fa/disable", form: url.Values{"password": {"wrong password"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "disable", path: "/user/2fa/disable", form: url.Values{"password": {testPassword}}, wantStatus: http.StatusSeeOther, wantLocation: "/user/2fa"},
+	})
+	checkTwoFactor(t, app, alice, false)
+}
+
+// checkTwoFactor checks whether user has two-factor authentication turned
+// on, and that signing in asks for a code only if so.
+func checkTwoFactor(t *testing.T, app *application, user models.User, want bool) {
+	t.Helper()
+
+	stored, err := app.users.Get(context.Background(), int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TOTPEnabled != want {
+		t.Errorf("got TOTPEnabled %t, want %t", stored.TOTPEnabled, want)
+	}
+
+	wantLocation := "/"
+	if want {
+		wantLocation = "/user/login/totp"
+	}
+	routeTest{
+		name: "next login", path: "/user/login", form: url.Values{"email": {user.Email}, "password": {testPassword}},
+		wantStatus: http.StatusSeeOther, wantLocation: wantLocation,
+	}.run(t, newTestServer(t, app.routes()))
+}
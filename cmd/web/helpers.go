@@ -2,44 +2,199 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"math"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
-	"movies4u.net/internals/models"
+	"github.com/gorilla/csrf"
+	"github.com/skip2/go-qrcode"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/gorm"
+	"movies4u.net/internals/logging"
+	"movies4u.net/internals/models"
+	"movies4u.net/internals/sessionstore"
+	"movies4u.net/internals/totp"
+	"movies4u.net/internals/validator"
 )
 
-func (app *application) generateRandomKey() string {
-	key := make([]byte, 32)
-	rand.Read(key)
-	return base64.StdEncoding.EncodeToString(key)
+// csrfFailure logs why a request failed the CSRF check and rejects it.
+func (app *application) csrfFailure(w http.ResponseWriter, r *http.Request) {
+	app.logger.InfoContext(r.Context(), "csrf check failed", "method", r.Method, "uri", r.URL.RequestURI(), "reason", csrf.FailureReason(r))
+	app.clientError(w, r, http.StatusForbidden)
 }
 
-func (app *application) serverError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.errorLog.Output(2, trace)
+// isTLS reports whether the client reached us over HTTPS, either directly
+// or through a trusted proxy that terminated TLS.
+func (app *application) isTLS(r *http.Request) bool {
+	forwarded, _ := r.Context().Value(forwardedTLSContextKey).(bool)
+	return r.TLS != nil || forwarded
+}
+
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.ErrorContext(r.Context(), err.Error(), "method", r.Method, "uri", r.URL.RequestURI(), "trace", string(debug.Stack()))
+	if wantsJSON(r) {
+		app.errorJSON(w, r, http.StatusInternalServerError, errorCode(http.StatusInternalServerError), http.StatusText(http.StatusInternalServerError), nil)
+		return
+	}
 	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 }
 
-func (app *application) clientError(w http.ResponseWriter, status int) {
+func (app *application) clientError(w http.ResponseWriter, r *http.Request, status int) {
+	if wantsJSON(r) {
+		app.errorJSON(w, r, status, errorCode(status), http.StatusText(status), nil)
+		return
+	}
 	http.Error(w, strconv.Itoa(status)+" "+http.StatusText(status), status)
 }
 
-func (app *application) notFound(w http.ResponseWriter) {
-	app.clientError(w, http.StatusNotFound)
+func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
+	app.clientError(w, r, http.StatusNotFound)
+}
+
+// failedValidation rejects a JSON request whose fields didn't pass v.
+// Forms re-render their page with the errors instead.
+func (app *application) failedValidation(w http.ResponseWriter, r *http.Request, v validator.Validator) {
+	message := "The request has invalid fields"
+	if len(v.NonFieldErrors) > 0 {
+		message = strings.Join(v.NonFieldErrors, "; ")
+	}
+	app.errorJSON(w, r, http.StatusUnprocessableEntity, "validation_failed", message, v.FieldErrors)
 }
 
-func (app *application) render(w http.ResponseWriter, status int, page string, data *templateData) {
+// badJSON rejects a request whose body couldn't be decoded, saying why.
+func (app *application) badJSON(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorJSON(w, r, http.StatusBadRequest, errorCode(http.StatusBadRequest), "The body isn't valid JSON: "+err.Error(), nil)
+}
+
+// errorResponse is the body of every error from a JSON route.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	// Code is a stable, machine-readable name for the error, such as
+	// not_found or validation_failed.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields maps request fields to what is wrong with them.
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+// errorJSON writes an error response in the JSON envelope, tagged with the
+// request ID so a report can be matched to the logs.
+func (app *application) errorJSON(w http.ResponseWriter, r *http.Request, status int, code, message string, fields map[string]string) {
+	body, err := json.Marshal(errorResponse{Error: errorBody{
+		Code:      code,
+		Message:   message,
+		Fields:    fields,
+		RequestID: logging.RequestID(r.Context()),
+	}})
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), err.Error())
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("ETag")
+	h.Del("Last-Modified")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// errorCode names a status for the JSON error envelope, such as
+// too_many_requests for 429.
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// wantsJSON reports whether errors for r should be JSON rather than plain
+// text: r was routed to a JSON route or is for the versioned API, or it
+// never reached a route, as when it fails the CSRF check, and the client
+// asks for JSON ahead of HTML.
+func wantsJSON(r *http.Request) bool {
+	if jsonRoute, ok := r.Context().Value(jsonRouteContextKey).(bool); ok && jsonRoute {
+		return true
+	}
+	if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		return true
+	}
+	// A type named outright beats one only covered by a wildcard of the
+	// same weight, as in "application/json, */*".
+	accept := r.Header.Get("Accept")
+	jsonQ, jsonRank := acceptQuality(accept, "application/json")
+	htmlQ, htmlRank := acceptQuality(accept, "text/html")
+	return jsonQ > htmlQ || jsonQ == htmlQ && jsonRank > htmlRank
+}
+
+// acceptQuality returns the weight the Accept header gives mediaType, taken
+// from the most specific range that covers it, and how specific that range
+// is: 2 for the type itself, 1 for type/*, 0 for */* and -1 for none.
+func acceptQuality(accept, mediaType string) (float64, int) {
+	kind, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		var rank int
+		switch name {
+		case mediaType:
+			rank = 2
+		case kind + "/*":
+			rank = 1
+		case "*/*":
+			rank = 0
+		default:
+			continue
+		}
+		if rank <= specificity {
+			continue
+		}
+
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			value, ok := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if !ok {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				weight = parsed
+			}
+		}
+		q, specificity = weight, rank
+	}
+	return q, specificity
+}
+
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, page string, data *templateData) {
+	_, span := tracer.Start(r.Context(), "render "+page)
+	defer span.End()
+
 	ts, ok := app.templateCache[page]
 	if !ok {
 		err := fmt.Errorf("the template %s does not exist", page)
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 	buf := new(bytes.Buffer)
@@ -47,17 +202,37 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	err := ts.ExecuteTemplate(buf, "base", data)
 
 	if err != nil {
-		app.serverError(w, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.serverError(w, r, err)
 	}
 
 	w.WriteHeader(status)
 	_, err = buf.WriteTo(w)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 	}
 
 }
 
+// serveJSON writes v as JSON, tagged with an ETag hashed from the body and,
+// unless modified is zero, a Last-Modified date. Requests whose
+// If-None-Match or If-Modified-Since shows the client has it already get 304
+// Not Modified. If-None-Match takes precedence, so clients should use it when
+// the body depends on more than modified tracks.
+func (app *application) serveJSON(w http.ResponseWriter, r *http.Request, v any, modified time.Time) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
+
 func (app *application) isAuthenticated(r *http.Request) bool {
 	isAuthenticated, ok := r.Context().Value(isAuthenticatedContextKey).(bool)
 	if !ok {
@@ -66,28 +241,268 @@ func (app *application) isAuthenticated(r *http.Request) bool {
 	return isAuthenticated
 }
 
-func (app *application) Authenticate(email, password string) (int, error) {
+func (app *application) isAdmin(r *http.Request) bool {
+	isAdmin, ok := r.Context().Value(isAdminContextKey).(bool)
+	if !ok {
+		return false
+	}
+	return isAdmin
+}
+
+// authenticatedUserID returns the ID of the user making the request, whether
+// they signed in with a session or an API token, or 0 if nobody did.
+func (app *application) authenticatedUserID(r *http.Request) int {
+	id, ok := r.Context().Value(userIDContextKey).(int)
+	if !ok {
+		return 0
+	}
+	return id
+}
+
+// apiToken returns the API token the request was authenticated with, if any.
+func (app *application) apiToken(r *http.Request) *models.APIToken {
+	token, ok := r.Context().Value(apiTokenContextKey).(*models.APIToken)
+	if !ok {
+		return nil
+	}
+	return token
+}
+
+// lookupAPIToken finds the live token matching plaintext. Unknown and
+// expired tokens both come back as models.ErrNoRecord.
+func (app *application) lookupAPIToken(ctx context.Context, plaintext string) (*models.APIToken, error) {
+	if !strings.HasPrefix(plaintext, models.APITokenPrefix) {
+		return nil, models.ErrNoRecord
+	}
+
+	token, err := app.tokens.GetByHash(ctx, models.HashToken(plaintext))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.Expired(now) {
+		return nil, models.ErrNoRecord
+	}
+
+	// Recording every use would turn each API read into a write, so the
+	// timestamp is only refreshed once a minute.
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > time.Minute {
+		err = app.tokens.Touch(ctx, int(token.ID), now)
+		if err != nil {
+			return nil, err
+		}
+		token.LastUsedAt = &now
+	}
+
+	return &token, nil
+}
+
+// clientIP returns the address of the client that sent r.
+func (app *application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// isTrustedProxy reports whether ip belongs to one of the configured proxy
+// networks.
+func (app *application) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range app.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMail delivers a message in the background so handlers never wait on
+// the mail server. When no mailer is configured the message is only logged.
+func (app *application) sendMail(recipient, subject, body string) {
+	if app.mailer == nil {
+		app.logger.Info("mail disabled, not sending", "subject", subject, "email", recipient)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(recipient, subject, body)
+		if err != nil {
+			app.logger.Error(err.Error(), "subject", subject, "email", recipient)
+		}
+	})
+}
+
+// background runs fn in its own goroutine, recovering any panic and tracking
+// it so shutdown can wait for it to finish.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprint(err), "trace", string(debug.Stack()))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// processExport builds a single data export and emails its owner when the
+// download is ready.
+func (app *application) processExport(id uint) {
+	processed, err := app.exporter.Process(id)
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+	if !processed {
+		return
+	}
+
+	job, err := app.exports.Get(context.Background(), int(id))
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+	user, err := app.users.Get(context.Background(), int(job.UserID))
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\n"+
+		"The copy of your Movies4u data you asked for is ready. Download it from your export page before %s.\n",
+		user.UserName, humanDate(*job.ExpiresAt))
+	app.sendMail(user.Email, "Your Movies4u data export is ready", body)
+}
+
+// runExports picks up export jobs that weren't handled when they were
+// requested, such as ones left behind by a restart, and removes expired
+// archives.
+func (app *application) runExports(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ids, err := app.exporter.Pending()
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+		for _, id := range ids {
+			if app.ctx.Err() != nil {
+				return
+			}
+			app.processExport(id)
+		}
+
+		err = app.exporter.Purge()
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-app.ctx.Done():
+			return
+		}
+	}
+}
+
+// purgeSessions deletes expired sessions from store every interval until
+// background work stops.
+func (app *application) purgeSessions(store *sessionstore.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-app.ctx.Done():
+			return
+		}
+
+		_, err := store.Purge(app.ctx)
+		if err != nil && app.ctx.Err() == nil {
+			app.logger.Error(err.Error())
+		}
+	}
+}
+
+// purgeRateLimits drops rate limit buckets that have filled up again every
+// interval until background work stops.
+func (app *application) purgeRateLimits(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-app.ctx.Done():
+			return
+		}
+
+		_, err := app.rateLimiter.Purge(app.ctx, time.Now())
+		if err != nil && app.ctx.Err() == nil {
+			app.logger.Error(err.Error())
+		}
+	}
+}
+
+// purgeLoginAttempts deletes failed login records that have stopped counting
+// every interval until background work stops.
+func (app *application) purgeLoginAttempts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-app.ctx.Done():
+			return
+		}
+
+		_, err := app.throttle.Purge(app.ctx, time.Now())
+		if err != nil && app.ctx.Err() == nil {
+			app.logger.Error(err.Error())
+		}
+	}
+}
+
+// invalidateFilms drops cached film and credit reads. Anything that changes
+// films or their credits, such as a catalogue import or an admin edit, must
+// call it.
+func (app *application) invalidateFilms(ctx context.Context) {
+	films, ok := app.films.(*models.CachedFilmStore)
+	if !ok {
+		return
+	}
 
-	var id int
-	var hashedPassword []byte
-	var result struct {
-		ID       int
-		Password []byte
+	err := films.Invalidate(ctx)
+	if err != nil {
+		app.logger.Error("invalidating film cache", "error", err)
 	}
-	err := app.DB.Model(&models.User{}).Select("id, password").Where("email = ?", email).Scan(&result).Error
+}
 
+func (app *application) Authenticate(ctx context.Context, email, password string) (int, error) {
+
+	user, err := app.users.GetByEmail(ctx, email)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		if errors.Is(err, models.ErrNoRecord) {
 			return 0, models.ErrInvalidCredentials
 		} else {
 			return 0, err
 		}
 	}
 
-	id = result.ID
-	hashedPassword = result.Password
-
-	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
 		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
 			return 0, models.ErrInvalidCredentials
@@ -95,5 +510,343 @@ func (app *application) Authenticate(email, password string) (int, error) {
 			return 0, err
 		}
 	}
-	return id, nil
+	return int(user.ID), nil
+}
+
+func (app *application) clearPendingLogin(r *http.Request) {
+	app.sessionManager.Remove(r.Context(), "pendingUserID")
+	app.sessionManager.Remove(r.Context(), "pendingEmail")
+	app.sessionManager.Remove(r.Context(), "pendingExpires")
+}
+
+// verifySecondFactor checks code against the user's authenticator secret or,
+// failing that, their unused recovery codes. A code is only ever accepted
+// once.
+func (app *application) verifySecondFactor(ctx context.Context, userID uint, code string) (bool, error) {
+	user, err := app.users.Get(ctx, int(userID))
+	if err != nil {
+		return false, err
+	}
+
+	// The store only advances the step past the stored one, which stops a
+	// code being replayed, even across instances.
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		return app.users.AdvanceTOTPStep(ctx, int(userID), step)
+	}
+
+	return app.users.UseRecoveryCode(ctx, int(userID), totp.HashRecoveryCode(code))
+}
+
+// newTwoFactorTemplateData fills in the two-factor settings page. Users who
+// haven't enrolled yet get a fresh secret, kept in their session until they
+// confirm it with a code.
+func (app *application) newTwoFactorTemplateData(w http.ResponseWriter, r *http.Request) (*templateData, error) {
+	userID := app.authenticatedUserID(r)
+
+	user, err := app.users.Get(r.Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	data := app.newTemplateData(r)
+	data.TwoFactor.Enabled = user.TOTPEnabled
+	if user.TOTPEnabled {
+		return data, nil
+	}
+
+	secret := app.sessionManager.GetString(r.Context(), "totpSecret")
+	if secret == "" {
+		secret, err = totp.GenerateSecret()
+		if err != nil {
+			return nil, err
+		}
+		app.sessionManager.Put(r.Context(), "totpSecret", secret)
+	}
+
+	uri := totp.ProvisioningURI(secret, "Movies4u", user.Email)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	// The QR code is inlined as a data URI, which the default policy blocks.
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:; style-src 'self' fonts.googleapis.com; font-src fonts.gstatic.com")
+
+	data.TwoFactor.Secret = secret
+	data.TwoFactor.URI = template.URL(uri)
+	data.TwoFactor.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	return data, nil
+}
+
+func (app *application) newTokensTemplateData(r *http.Request) (*templateData, error) {
+	tokens, err := app.tokens.ForUser(r.Context(), app.authenticatedUserID(r))
+	if err != nil {
+		return nil, err
+	}
+
+	data := app.newTemplateData(r)
+	data.APITokens = tokens
+	return data, nil
+}
+
+// startUserSession signs userID in on the current session and records it so
+// it shows up on the devices page. The caller must already have renewed the
+// session token.
+func (app *application) startUserSession(r *http.Request, userID int) error {
+	now := time.Now()
+
+	state, err := app.userAuthState(r.Context(), userID, true)
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), "userID", userID)
+	app.sessionManager.Put(r.Context(), "authVersion", state.Version)
+	app.sessionManager.Put(r.Context(), "seenAt", now.Unix())
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	session := models.UserSession{
+		UserID:    uint(userID),
+		Token:     app.sessionManager.Token(r.Context()),
+		IP:        app.clientIP(r),
+		UserAgent: userAgent,
+		LastSeen:  now,
+		ExpiresAt: app.sessionManager.Deadline(r.Context()),
+	}
+	return app.sessions.Insert(r.Context(), &session)
+}
+
+// renewUserSession renews the session token, for example after a privilege
+// change, and keeps the session's device record pointing at the new token.
+func (app *application) renewUserSession(r *http.Request) error {
+	oldToken := app.sessionManager.Token(r.Context())
+
+	err := app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return app.sessions.Rename(r.Context(), oldToken, app.sessionManager.Token(r.Context()))
+}
+
+// touchUserSession refreshes the device record for the current session at
+// most once a minute. It reports false if the record is gone, meaning the
+// session was revoked from another device.
+func (app *application) touchUserSession(r *http.Request) (bool, error) {
+	now := time.Now()
+	if now.Unix()-app.sessionManager.GetInt64(r.Context(), "seenAt") < 60 {
+		return true, nil
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	found, err := app.sessions.Touch(r.Context(), app.sessionManager.Token(r.Context()), app.clientIP(r), userAgent, now)
+	if err != nil || !found {
+		return false, err
+	}
+
+	app.sessionManager.Put(r.Context(), "seenAt", now.Unix())
+	return true, nil
+}
+
+// authState is what authenticate needs to know about a signed-in user.
+type authState struct {
+	Version int64 `json:"version"`
+	Admin   bool  `json:"admin"`
+}
+
+func authCacheKey(userID int) string {
+	return "auth:" + strconv.Itoa(userID)
+}
+
+// userAuthState returns the authentication state of userID, from the cache
+// unless fresh is set. States read from the database are cached.
+func (app *application) userAuthState(ctx context.Context, userID int, fresh bool) (authState, error) {
+	var state authState
+	if app.authCache != nil && !fresh {
+		value, ok, err := app.authCache.Get(ctx, authCacheKey(userID))
+		hit := err == nil && ok && json.Unmarshal(value, &state) == nil
+		app.metrics.ObserveCache("auth", hit)
+		if hit {
+			return state, nil
+		}
+	}
+
+	user, err := app.users.Get(ctx, userID)
+	if err != nil {
+		return authState{}, err
+	}
+	state = authState{Version: user.AuthVersion, Admin: user.Admin}
+
+	if app.authCache != nil {
+		value, err := json.Marshal(state)
+		if err == nil {
+			err = app.authCache.Set(ctx, authCacheKey(userID), value, app.authCacheTTL)
+		}
+		if err != nil {
+			app.logger.ErrorContext(ctx, "caching authentication state", "error", err)
+		}
+	}
+	return state, nil
+}
+
+// invalidateUser drops the cached authentication state of userID. Call it
+// after deleting the user or changing their password or role, so this
+// instance stops accepting their old sessions at once; other instances
+// follow within the cache's TTL.
+func (app *application) invalidateUser(ctx context.Context, userID int) {
+	if app.authCache == nil {
+		return
+	}
+
+	err := app.authCache.Delete(ctx, authCacheKey(userID))
+	if err != nil {
+		app.logger.ErrorContext(ctx, "invalidating authentication state", "error", err)
+	}
+}
+
+// revokeOtherSessions signs the current user out everywhere except the
+// session this request came in on.
+func (app *application) revokeOtherSessions(r *http.Request) error {
+	sessions, err := app.sessions.ForUser(r.Context(), app.authenticatedUserID(r))
+	if err != nil {
+		return err
+	}
+
+	current := app.sessionManager.Token(r.Context())
+	sessions = slices.DeleteFunc(sessions, func(s models.UserSession) bool {
+		return s.Token == current
+	})
+	return app.revokeUserSessions(r.Context(), sessions)
+}
+
+// revokeUserSessions deletes sessions from both the session store and the
+// device records.
+func (app *application) revokeUserSessions(ctx context.Context, sessions []models.UserSession) error {
+	for _, session := range sessions {
+		err := app.sessionManager.Store.Delete(session.Token)
+		if err != nil {
+			return err
+		}
+
+		err = app.sessions.Delete(ctx, session.Token)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPassword reports whether password is the current password of userID.
+func (app *application) checkPassword(ctx context.Context, userID int, password string) (bool, error) {
+	user, err := app.users.Get(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (app *application) newSettingsTemplateData(r *http.Request) (*templateData, error) {
+	user, err := app.users.Get(r.Context(), app.authenticatedUserID(r))
+	if err != nil {
+		return nil, err
+	}
+
+	data := app.newTemplateData(r)
+	data.User = &user
+	return data, nil
+}
+
+// renderSettings re-renders the settings page with the errors in form.
+func (app *application) renderSettings(w http.ResponseWriter, r *http.Request, form accountForm) {
+	data, err := app.newSettingsTemplateData(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if form.UserName == "" {
+		form.UserName = data.User.UserName
+	}
+	data.Form = form
+	app.render(w, r, http.StatusUnprocessableEntity, "settings.html", data)
+}
+
+// statusWriter records the status code and body size of a response for the
+// access log.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status = status
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	n, err := sw.ResponseWriter.Write(b)
+	sw.size += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// validRequestID reports whether a client supplied request ID is safe to
+// reuse: short and limited to characters that can't forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// countActiveSessions reports the number of unexpired browser sessions for
+// the metrics endpoint.
+func (app *application) countActiveSessions() float64 {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	count, err := app.sessions.CountActive(ctx)
+	if err != nil {
+		app.logger.Error("counting sessions", "error", err)
+		return math.NaN()
+	}
+	return float64(count)
 }
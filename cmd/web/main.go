@@ -1,114 +1,399 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"crypto/rand"
 	"errors"
 	"flag"
-	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
-	_ "github.com/go-sql-driver/mysql"
-	"gorm.io/driver/mysql"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"gorm.io/gorm"
+	"movies4u.net/internals/cache"
+	"movies4u.net/internals/config"
+	"movies4u.net/internals/database"
 	"movies4u.net/internals/dataloader"
+	"movies4u.net/internals/export"
+	"movies4u.net/internals/logging"
+	"movies4u.net/internals/mailer"
+	"movies4u.net/internals/metrics"
+	"movies4u.net/internals/migrations"
 	"movies4u.net/internals/models"
+	"movies4u.net/internals/ratelimit"
+	"movies4u.net/internals/sessionstore"
+	"movies4u.net/internals/throttle"
+	"movies4u.net/internals/tracing"
+	"movies4u.net/ui"
 )
 
+// Pinger checks that a database is reachable. readyz is the only code that
+// needs the database itself rather than a store.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
 type application struct {
-	errorLog       *log.Logger
-	infoLog        *log.Logger
-	DB             *gorm.DB
+	logger         *slog.Logger
+	db             Pinger
+	films          models.FilmStore
+	users          models.UserStore
+	lists          models.ListStore
+	credits        models.CreditStore
+	sessions       models.SessionStore
+	tokens         models.TokenStore
+	exports        models.ExportStore
+	baseURL        string      // public address of the site, without a trailing slash
+	authCache      cache.Cache // signed-in users' authState, nil when caching is off
+	authCacheTTL   time.Duration
 	templateCache  map[string]*template.Template
+	static         *staticAssets
 	sessionManager *scs.SessionManager
+	throttle       *throttle.Throttle
+	rateLimiter    ratelimit.Backend // nil when rate limits are off
+	mailer         *mailer.Mailer
+	exporter       *export.Exporter
+	csrfKey        []byte
+	secureCookies  bool
+	trustedProxies []*net.IPNet
+	wg             sync.WaitGroup
+	ctx            context.Context // cancelled when background work should stop
+	stopBackground context.CancelFunc
+	catalogue      atomic.Value // catalogueLoading, catalogueReady or catalogueFailed
+	shuttingDown   atomic.Bool
+	metrics        *metrics.Metrics
+	// metricsEndpoint serves /metrics on the main listener; nil when metrics
+	// are disabled or served on their own address.
+	metricsEndpoint http.Handler
 }
 
+// States of the film catalogue import, reported by /readyz.
+const (
+	catalogueLoading = "loading"
+	catalogueReady   = "ok"
+	catalogueFailed  = "failed"
+)
+
+var tracer = tracing.Tracer("movies4u.net/cmd/web")
+
 func main() {
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
 
-	addr := flag.String("addr", ":4000", "Http Server Listening Port")
-	jsonFilePath := flag.String("json", "./data/films.json", "Path to the JSON file containing film data")
+	logger := logging.New(os.Stdout, cfg.Log.Format, logging.ParseLevel(cfg.Log.Level))
+	slog.SetDefault(logger)
+	errorLog := slog.NewLogLogger(logger.Handler(), slog.LevelError)
 
-	flag.Parse()
+	// Redacted, so secrets never reach the logs.
+	logger.Info("loaded configuration", "config", cfg.Redacted())
 
-	dsn := os.Getenv("DB_USER") + ":" + os.Getenv("DB_PASSWORD") + "@tcp(" + os.Getenv("DB_HOST") + ":" + os.Getenv("DB_PORT") + ")/" + os.Getenv("DB_NAME") + "?parseTime=true"
-	fmt.Println(dsn)
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
 	if err != nil {
-		errorLog.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	db, err := database.Open(cfg.DB, &gorm.Config{})
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
 	sqlDB, err := db.DB()
 	if err != nil {
-		errorLog.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 	defer sqlDB.Close()
 
-	templateCache, err := newTemplateCache()
+	m := metrics.New()
+	m.RegisterDB(sqlDB, cfg.DB.Name)
+	err = db.Use(metrics.GormPlugin{Metrics: m})
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	err = db.Use(tracing.GormPlugin{System: cfg.DB.Driver})
 	if err != nil {
-		errorLog.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
-	sessionManager := scs.New()
-	sessionManager.Store = mysqlstore.New(sqlDB)
-	sessionManager.Lifetime = 12 * time.Hour
-	sessionManager.Cookie.Secure = true // Set to false if not using HTTPS
-
-	app := application{
-		errorLog:       errorLog,
-		infoLog:        infoLog,
-		DB:             db,
-		templateCache:  templateCache,
-		sessionManager: sessionManager,
+	assets, err := newStaticAssets(ui.Files)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
-	// Ensure tables are created before checking their contents
-	err = db.AutoMigrate(&models.User{}, &models.Genre{}, &models.Star{}, &models.Director{}, &models.Film{})
+	templateCache, err := newTemplateCache(assets)
 	if err != nil {
-		errorLog.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
-	dataLoader := dataloader.DataLoader{DB: db}
-	err = dataLoader.LoadFilmsFromFile(*jsonFilePath)
+	sessionManager := scs.New()
+	sessionStore := sessionstore.New(db)
+	sessionManager.Store = sessionStore
+	sessionManager.Lifetime = cfg.Session.Lifetime
+	sessionManager.Cookie.Secure = cfg.Session.SecureCookies
+
+	// The CSRF key must be shared by every instance and survive restarts,
+	// otherwise forms rendered before a deploy stop working.
+	csrfKey := cfg.Session.CSRFKeyBytes()
+	if csrfKey == nil {
+		logger.Warn("CSRF_KEY not set, using a random key for this process")
+		csrfKey = make([]byte, 32)
+		_, err = rand.Read(csrfKey)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var mail *mailer.Mailer
+	if cfg.SMTP.Host != "" {
+		mail = &mailer.Mailer{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			Sender:   cfg.SMTP.Sender,
+		}
+	}
+
+	trustedProxies, err := cfg.Proxy.Networks()
 	if err != nil {
-		if errors.Is(err, dataloader.ErrDataLoaded) {
-			infoLog.Println("Loaded Database")
-		} else {
-			errorLog.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	var films models.FilmStore = &models.GormFilmStore{DB: db}
+	var credits models.CreditStore = &models.GormCreditStore{DB: db}
+	var authCache cache.Cache
+	if cfg.Cache.Size > 0 {
+		lru := cache.NewLRU(cfg.Cache.Size)
+		cachedFilms := &models.CachedFilmStore{
+			Store:   films,
+			Cache:   lru,
+			TTL:     cfg.Cache.TTL,
+			Observe: m.ObserveCache,
+		}
+		films = cachedFilms
+		credits = &models.CachedCreditStore{Store: credits, Films: cachedFilms}
+		m.RegisterGauge("cache_entries", "Entries held by the film cache.", func() float64 { return float64(lru.Len()) })
+
+		authLRU := cache.NewLRU(cfg.Cache.Size)
+		authCache = authLRU
+		m.RegisterGauge("auth_cache_entries", "Users whose authentication state is cached.", func() float64 { return float64(authLRU.Len()) })
+	}
+
+	var rateLimiter ratelimit.Backend
+	if cfg.RateLimit.Enabled {
+		switch cfg.RateLimit.Backend {
+		case config.BackendDatabase:
+			rateLimiter = &ratelimit.Store{DB: db}
+		default:
+			rateLimiter = ratelimit.NewMemory()
 		}
 	}
 
-	tlsConfig := &tls.Config{
-		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
-		MinVersion:       tls.VersionTLS12,
-		MaxVersion:       tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	users := &models.GormUserStore{DB: db}
+	lists := &models.GormListStore{DB: db}
+	sessions := &models.GormSessionStore{DB: db}
+	tokens := &models.GormTokenStore{DB: db}
+	exports := &models.GormExportStore{DB: db}
+
+	ctx, stopBackground := context.WithCancel(context.Background())
+
+	app := &application{
+		logger:         logger,
+		db:             sqlDB,
+		films:          films,
+		users:          users,
+		authCache:      authCache,
+		authCacheTTL:   cfg.Cache.AuthTTL,
+		lists:          lists,
+		credits:        credits,
+		sessions:       sessions,
+		tokens:         tokens,
+		exports:        exports,
+		baseURL:        strings.TrimSuffix(cfg.BaseURL, "/"),
+		templateCache:  templateCache,
+		static:         assets,
+		sessionManager: sessionManager,
+		throttle: &throttle.Throttle{
+			Backend: &throttle.Store{DB: db},
+			Account: throttle.DefaultAccountPolicy,
+			IP:      throttle.DefaultIPPolicy,
+		},
+		rateLimiter:    rateLimiter,
+		mailer:         mail,
+		csrfKey:        csrfKey,
+		secureCookies:  cfg.Session.SecureCookies,
+		trustedProxies: trustedProxies,
+		exporter: &export.Exporter{
+			Users:    users,
+			Lists:    lists,
+			Sessions: sessions,
+			Tokens:   tokens,
+			Exports:  exports,
+			Dir:      cfg.ExportDir,
+			TTL:      7 * 24 * time.Hour,
 		},
+		metrics:        m,
+		ctx:            ctx,
+		stopBackground: stopBackground,
 	}
+	app.catalogue.Store(catalogueLoading)
+	m.RegisterGauge("active_sessions", "Signed-in browser sessions that haven't expired.", app.countActiveSessions)
 
-	infoLog.Printf("Starting Server %s", *addr)
+	// Bring the schema up to date before anything reads it. Instances
+	// starting together take turns through the migration lock.
+	if cfg.DB.AutoMigrate {
+		migrator, err := migrations.New(db)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		for _, m := range applied {
+			logger.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+	}
+
+	// The catalogue loads in the background so the server can answer
+	// health checks meanwhile; /readyz reports when it's done.
+	app.background(func() {
+		dataLoader := dataloader.DataLoader{DB: db, Progress: m.CatalogueProgress}
+		err := dataLoader.LoadFilmsFromFile(app.ctx, cfg.DataPath)
+		if err != nil && !errors.Is(err, dataloader.ErrDataLoaded) {
+			app.catalogue.Store(catalogueFailed)
+			logger.Error("loading catalogue", "error", err)
+			return
+		}
+		app.invalidateFilms(app.ctx)
+		app.catalogue.Store(catalogueReady)
+		logger.Info("loaded catalogue")
+	})
+
+	app.background(func() {
+		app.runExports(time.Minute)
+	})
+
+	app.background(func() {
+		app.purgeSessions(sessionStore, 5*time.Minute)
+	})
+
+	app.background(func() {
+		app.purgeLoginAttempts(10 * time.Minute)
+	})
+
+	if rateLimiter != nil {
+		app.background(func() {
+			app.purgeRateLimits(time.Minute)
+		})
+	}
+
+	var extra []*http.Server
+	if cfg.Metrics.Enabled {
+		endpoint := requireMetricsToken(cfg.Metrics.Token, m.Handler())
+		if cfg.Metrics.Addr == "" {
+			app.metricsEndpoint = endpoint
+		} else {
+			mux := http.NewServeMux()
+			mux.Handle("GET /metrics", endpoint)
+			extra = append(extra, &http.Server{
+				Addr:         cfg.Metrics.Addr,
+				ErrorLog:     errorLog,
+				Handler:      mux,
+				IdleTimeout:  cfg.Timeouts.Idle,
+				ReadTimeout:  cfg.Timeouts.Read,
+				WriteTimeout: cfg.Timeouts.Write,
+			})
+		}
+	}
 
 	srv := &http.Server{
-		Addr:         *addr,
+		Addr:         cfg.Addr,
 		ErrorLog:     errorLog,
 		Handler:      app.routes(),
-		TLSConfig:    tlsConfig,
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  cfg.Timeouts.Idle,
+		ReadTimeout:  cfg.Timeouts.Read,
+		WriteTimeout: cfg.Timeouts.Write,
+	}
+
+	var redirect *http.Server
+	if cfg.TLS.RedirectAddr != "" {
+		redirect = &http.Server{
+			Addr:         cfg.TLS.RedirectAddr,
+			ErrorLog:     errorLog,
+			Handler:      redirectToHTTPS(cfg.Addr),
+			IdleTimeout:  cfg.Timeouts.Idle,
+			ReadTimeout:  cfg.Timeouts.Read,
+			WriteTimeout: cfg.Timeouts.Write,
+		}
+	}
+
+	switch cfg.TLS.Mode {
+	case config.ModeTLS:
+		reloader, err := newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		srv.TLSConfig = newTLSConfig(reloader.GetCertificate)
+		app.background(func() {
+			app.watchCertificate(reloader, time.Minute)
+		})
+	case config.ModeACME:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.TLS.ACMEDomains...),
+			Cache:      autocert.DirCache(cfg.TLS.ACMECacheDir),
+			Email:      cfg.TLS.ACMEEmail,
+		}
+		srv.TLSConfig = newTLSConfig(manager.GetCertificate)
+		srv.TLSConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		if redirect != nil {
+			// HTTP-01 challenges arrive on the plain HTTP listener.
+			redirect.Handler = manager.HTTPHandler(redirect.Handler)
+		}
+	}
+
+	logger.Info("starting server", "addr", cfg.Addr, "mode", cfg.TLS.Mode)
+
+	if redirect != nil {
+		extra = append(extra, redirect)
+	}
+
+	err = app.serve(srv, cfg.Timeouts.Shutdown, extra...)
+
+	// Flush spans buffered during the shutdown.
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = errors.Join(err, shutdownTracing(flushCtx))
+	if err != nil {
+		logger.Error(err.Error())
+		sqlDB.Close()
+		os.Exit(1)
 	}
-	err = srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
-	errorLog.Fatal(err)
 }
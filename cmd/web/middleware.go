@@ -2,10 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/csrf"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"movies4u.net/internals/logging"
 	"movies4u.net/internals/models"
+	"movies4u.net/internals/ratelimit"
 )
 
 func secureHeaders(next http.Handler) http.Handler {
@@ -21,21 +34,79 @@ func secureHeaders(next http.Handler) http.Handler {
 		})
 }
 
-func (app *application) logRequest(next http.Handler) http.Handler {
+// requestID tags every request with an ID, taken from a valid X-Request-ID
+// header or generated, which is echoed in the response and added to every log
+// line written with the request's context.
+func (app *application) requestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method,
-			r.URL.RequestURI())
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(logging.WithRequestID(r.Context(), id))
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// traceRequest starts a span for every request, continuing the trace from
+// the W3C traceparent header when the caller sent one. tagRoute renames it
+// after the matched route.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	tagged := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			attribute.String("request.id", logging.RequestID(r.Context())),
+			semconv.ClientAddress(app.clientIP(r)),
+		)
+		next.ServeHTTP(w, r)
+	})
+
+	return otelhttp.NewHandler(tagged, "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+	)
+}
+
+// logRequest writes an access log line for every request once it has been
+// served.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		// Deferred so a panic on its way to recoverPanic is logged too, as
+		// the 500 it turns into.
+		panicked := true
+		defer func() {
+			status := sw.status
+			if panicked {
+				status = http.StatusInternalServerError
+			}
+			app.logger.InfoContext(r.Context(), "request",
+				"ip", app.clientIP(r),
+				"proto", r.Proto,
+				"method", r.Method,
+				"uri", r.URL.RequestURI(),
+				"status", status,
+				"size", sw.size,
+				"duration", time.Since(start),
+			)
+		}()
+
+		next.ServeHTTP(sw, r)
+		panicked = false
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
 				w.Header().Set("Connection", "close")
-				app.serverError(w, fmt.Errorf("%s", err))
+				app.serverError(w, r, fmt.Errorf("%s", err))
 			}
 		}()
 
@@ -61,6 +132,19 @@ func (app *application) chainMiddleware(mux http.Handler, middleware ...func(htt
 func (app *application) requireAuthentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.isAuthenticated(r) {
+			// A token whose owner no longer exists, a JSON route and a
+			// client asking for JSON get a 401 rather than a redirect to a
+			// login page a script can't use.
+			if r.Header.Get("Authorization") != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				app.clientError(w, r, http.StatusUnauthorized)
+				return
+			}
+			if wantsJSON(r) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				app.errorJSON(w, r, http.StatusUnauthorized, errorCode(http.StatusUnauthorized), http.StatusText(http.StatusUnauthorized), nil)
+				return
+			}
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
@@ -68,26 +152,338 @@ func (app *application) requireAuthentication(next http.Handler) http.Handler {
 	})
 }
 
+// requireAPIAuthentication is requireAuthentication for the versioned API,
+// whose clients are told to authenticate rather than sent to the login page.
+func (app *application) requireAPIAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.isAuthenticated(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			app.clientError(w, r, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.isAdmin(r) {
+			app.notFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireSession keeps API token clients out of routes meant for a browser,
+// such as account settings and token management.
+func (app *application) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.apiToken(r) != nil {
+			app.clientError(w, r, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireScope rejects requests made with an API token that wasn't granted
+// scope. Session-authenticated requests are always allowed through.
+func (app *application) requireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := app.apiToken(r); token != nil && !token.Allows(scope) {
+			app.clientError(w, r, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		id := app.sessionManager.GetInt(r.Context(), "userID")
+		var id int
+		var token *models.APIToken
+
+		// Script clients send a personal API token instead of a session
+		// cookie. A bad token is rejected outright rather than falling back
+		// to anonymous access.
+		if header := r.Header.Get("Authorization"); header != "" {
+			plaintext, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				app.clientError(w, r, http.StatusUnauthorized)
+				return
+			}
+
+			var err error
+			token, err = app.lookupAPIToken(r.Context(), strings.TrimSpace(plaintext))
+			if err != nil {
+				if errors.Is(err, models.ErrNoRecord) {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					app.clientError(w, r, http.StatusUnauthorized)
+				} else {
+					app.serverError(w, r, err)
+				}
+				return
+			}
+			id = int(token.UserID)
+		} else {
+			id = app.sessionManager.GetInt(r.Context(), "userID")
+			if id != 0 {
+				live, err := app.touchUserSession(r)
+				if err != nil {
+					app.serverError(w, r, err)
+					return
+				}
+
+				// The session was revoked from another device.
+				if !live {
+					err = app.sessionManager.Destroy(r.Context())
+					if err != nil {
+						app.serverError(w, r, err)
+						return
+					}
+					id = 0
+				}
+			}
+		}
+
 		if id == 0 {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		var count int64
-		err := app.DB.Model(&models.User{}).Where("id = ?", id).Count(&count).Error
-		if err != nil {
-			app.serverError(w, err)
+		// Sessions are checked against the version of the user they signed
+		// in, which moves on when the password or role changes. A cached
+		// state can be older than the session, so a mismatch is confirmed
+		// with the database before the session ends.
+		sessionVersion := app.sessionManager.GetInt64(r.Context(), "authVersion")
+		state, err := app.userAuthState(r.Context(), id, false)
+		if err == nil && token == nil && state.Version != sessionVersion {
+			state, err = app.userAuthState(r.Context(), id, true)
+		}
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, r, err)
+			return
+		}
+
+		if token == nil && (err != nil || state.Version != sessionVersion) {
+			err = app.sessionManager.Destroy(r.Context())
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		if count > 0 {
+		if err == nil {
 			ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
+			ctx = context.WithValue(ctx, isAdminContextKey, state.Admin)
+			ctx = context.WithValue(ctx, userIDContextKey, id)
+			if token != nil {
+				ctx = context.WithValue(ctx, apiTokenContextKey, token)
+			}
 			r = r.WithContext(ctx)
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// noSurf enforces CSRF tokens on every state-changing request. Forms send the
+// token in a csrf_token field and fetch calls in an X-CSRF-Token header.
+// Requests authenticated with an API token carry no ambient credentials, so
+// they are let through unchecked.
+func (app *application) noSurf(next http.Handler) http.Handler {
+	protect := csrf.Protect(app.csrfKey,
+		csrf.FieldName("csrf_token"),
+		csrf.RequestHeader("X-CSRF-Token"),
+		csrf.Path("/"),
+		csrf.HttpOnly(true),
+		csrf.Secure(app.secureCookies),
+		csrf.SameSite(csrf.SameSiteLaxMode),
+		csrf.ErrorHandler(http.HandlerFunc(app.csrfFailure)),
+	)(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.apiToken(r) != nil {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+
+		// Over plain HTTP there is no Referer to insist on; the origin and
+		// token checks still apply.
+		if !app.isTLS(r) {
+			r = csrf.PlaintextHTTPRequest(r)
+		}
+
+		protect.ServeHTTP(w, r)
+	})
+}
+
+// proxyHeaders applies X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host when the request comes from a trusted proxy, so client
+// IPs, redirects and secure cookies reflect the original request. Headers
+// from anyone else are ignored.
+func (app *application) proxyHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(app.trustedProxies) == 0 || !app.isTrustedProxy(app.clientIP(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Walk X-Forwarded-For from the right and take the first address
+		// that is not one of our proxies; anything further left may be
+		// forged by the client.
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(strings.Join(forwarded, ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := strings.TrimSpace(hops[i])
+				if net.ParseIP(hop) == nil {
+					break
+				}
+				r.RemoteAddr = net.JoinHostPort(hop, "0")
+				if !app.isTrustedProxy(hop) {
+					break
+				}
+			}
+		}
+
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+
+		if strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedTLSContextKey, true))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// instrument records request counts and latency per route pattern. The
+// pattern is filled in by tagRoute once the router has matched the request;
+// requests that never reach a route are counted as "unmatched".
+func (app *application) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := new(string)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		// Deferred, like the access log, so panics are counted as 500s.
+		panicked := true
+		defer func() {
+			status := sw.status
+			if panicked {
+				status = http.StatusInternalServerError
+			}
+			if *route == "" {
+				*route = "unmatched"
+			}
+			app.metrics.ObserveRequest(*route, r.Method, status, time.Since(start))
+		}()
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), routeContextKey, route)))
+		panicked = false
+	})
+}
+
+// tagRoute records pattern as the route that handled the request for
+// instrument and names the request's span after it.
+func tagRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route, ok := r.Context().Value(routeContextKey).(*string); ok {
+			*route = pattern
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(pattern)
+		span.SetAttributes(semconv.HTTPRoute(pattern))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// jsonRoute marks the request as bound for a JSON route, so errors on the
+// way to the handler and from it use the JSON error envelope.
+func jsonRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jsonRouteContextKey, true)))
+	})
+}
+
+// Cache-Control policies for routes. Pages carry CSRF tokens and account
+// details, so nothing keeps them; JSON reads may be kept by the browser but
+// are revalidated against their ETag on every use.
+const (
+	cacheNoStore    = "no-store"
+	cacheRevalidate = "private, no-cache"
+)
+
+// cacheControl sets the route's Cache-Control policy. Handlers can still
+// replace it.
+func cacheControl(policy string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", policy)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit holds requests to route to policy, with a bucket per signed-in
+// user and one per client IP for everyone else. Every response carries
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset; rejected ones
+// are a 429 with Retry-After. If the backend fails the request goes through,
+// since turning everyone away is worse than a burst getting past.
+func (app *application) rateLimit(route string, policy ratelimit.Policy, next http.Handler) http.Handler {
+	if app.rateLimiter == nil || policy.Unlimited() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := route + " ip:" + app.clientIP(r)
+		if id := app.authenticatedUserID(r); id != 0 {
+			key = route + " user:" + strconv.Itoa(id)
+		}
+
+		res, err := app.rateLimiter.Take(r.Context(), key, policy, time.Now())
+		if err != nil {
+			app.logger.ErrorContext(r.Context(), "rate limit", "route", route, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+		if !res.Allowed {
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+			app.metrics.RateLimited.WithLabelValues(route).Inc()
+			app.clientError(w, r, http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ceilSeconds rounds d up to whole seconds, so clients told to wait don't
+// come back a moment too early.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// requireMetricsToken rejects scrapes without the bearer token, when one is
+// configured.
+func requireMetricsToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIDocument describes routes as an OpenAPI 3.0 document. Response
+// schemas are derived from the Go types the handlers encode, following
+// their JSON tags.
+func openAPIDocument(routes []apiRoute) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+	for _, route := range routes {
+		item, ok := paths[route.path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[route.path] = item
+		}
+		item[strings.ToLower(route.method)] = route.operation(schemas)
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "movies4u API",
+			"version": "1.0.0",
+			"description": "Browse the film catalogue and manage your lists. Errors share one " +
+				"JSON shape, ErrorResponse. Reads carry an ETag and answer If-None-Match " +
+				"with 304 Not Modified.",
+		},
+		"servers": []any{map[string]any{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"token": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A personal API token from the account's token page.",
+				},
+				"session": map[string]any{
+					"type":        "apiKey",
+					"in":          "cookie",
+					"name":        "session",
+					"description": "A signed-in browser session. Writes also need the X-CSRF-Token header.",
+				},
+			},
+		},
+	}
+}
+
+// operation describes the route as an OpenAPI operation, adding the schemas
+// it refers to to schemas.
+func (route apiRoute) operation(schemas map[string]any) map[string]any {
+	op := map[string]any{
+		"operationId": route.id,
+		"summary":     route.summary,
+		"tags":        []string{route.tag},
+	}
+
+	if len(route.params) > 0 {
+		var params []any
+		for _, p := range route.params {
+			params = append(params, map[string]any{
+				"name":        p.name,
+				"in":          p.in,
+				"description": p.description,
+				"required":    p.in == "path",
+				"schema":      p.schema,
+			})
+		}
+		op["parameters"] = params
+	}
+
+	success := map[string]any{"description": http.StatusText(route.status)}
+	if route.response != nil {
+		success["content"] = jsonContent(schemaFor(reflect.TypeOf(route.response), schemas))
+	}
+	responses := map[string]any{strconv.Itoa(route.status): success}
+	if route.method == http.MethodGet {
+		responses["304"] = map[string]any{"description": http.StatusText(http.StatusNotModified)}
+	}
+
+	errors := slices.Clone(route.errors)
+	if route.scope != "" {
+		errors = append(errors, http.StatusUnauthorized, http.StatusForbidden)
+		op["security"] = []any{map[string]any{"token": []string{}}, map[string]any{"session": []string{}}}
+		op["description"] = "Needs a session, or an API token with the " + route.scope + " scope."
+	}
+	if !route.limit.Unlimited() {
+		errors = append(errors, http.StatusTooManyRequests)
+	}
+	errors = append(errors, http.StatusInternalServerError)
+
+	errorSchema := schemaFor(reflect.TypeOf(errorResponse{}), schemas)
+	for _, status := range errors {
+		responses[strconv.Itoa(status)] = map[string]any{
+			"description": http.StatusText(status),
+			"content":     jsonContent(errorSchema),
+		}
+	}
+	op["responses"] = responses
+	return op
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// schemaFor returns the JSON schema of the values encoding/json makes from
+// t. Named structs become components in schemas and are referred to.
+func schemaFor(t reflect.Type, schemas map[string]any) map[string]any {
+	if t == reflect.TypeFor[time.Time]() {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32:
+		return map[string]any{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Pointer:
+		return nullable(schemaFor(t.Elem(), schemas))
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := schemas[name]; !ok {
+			// Claimed before recursing, in case the type refers to itself.
+			schemas[name] = nil
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// structSchema describes a struct as an object. Fields without omitempty
+// are always encoded, so they are required.
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	addFields(t, properties, &required, schemas)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		slices.Sort(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds the fields of t to properties, promoting those of embedded
+// structs as encoding/json does.
+func addFields(t reflect.Type, properties map[string]any, required *[]string, schemas map[string]any) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addFields(field.Type, properties, required, schemas)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := schemaFor(field.Type, schemas)
+		// Go encodes nil slices and maps as null.
+		if kind := field.Type.Kind(); kind == reflect.Slice || kind == reflect.Map {
+			schema = nullable(schema)
+		}
+		properties[name] = schema
+		if !slices.Contains(strings.Split(options, ","), "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// nullable lets schema also be null. OpenAPI 3.0 ignores keywords beside a
+// $ref, so references are wrapped.
+func nullable(schema map[string]any) map[string]any {
+	if _, ok := schema["$ref"]; ok {
+		return map[string]any{"allOf": []any{schema}, "nullable": true}
+	}
+	schema["nullable"] = true
+	return schema
+}
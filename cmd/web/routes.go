@@ -2,52 +2,128 @@ package main
 
 import (
 	"net/http"
-	// "github.com/gorilla/csrf"
-	"movies4u.net/ui"
+	"time"
+
+	"movies4u.net/internals/models"
+	"movies4u.net/internals/ratelimit"
 )
 
 func (app *application) routes() http.Handler {
 
-	// key := app.generateRandomKey()
-	// csrf := csrf.Protect([]byte(key), csrf.Secure(false), csrf.SameSite(csrf.SameSiteLaxMode))
-
 	router := http.NewServeMux()
 
-	// Static file server
-	fileServer := http.FileServer(http.FS(ui.Files))
-	router.Handle("GET /static/", fileServer)
+	// Static files, cached by their fingerprinted names
+	router.Handle("GET /static/", tagRoute("GET /static/", app.static))
 
 	// Unprotected routes
 	unprotectedRoutes := map[string]http.HandlerFunc{
-		"GET /user/login":   app.userLogin,
-		"POST /user/login":  app.userLoginPost,
-		"GET /user/signin":  app.userSignin,
-		"POST /user/signin": app.userSigninPost,
+		"GET /user/login":                 app.userLogin,
+		"POST /user/login":                app.userLoginPost,
+		"GET /user/signin":                app.userSignin,
+		"POST /user/signin":               app.userSigninPost,
+		"GET /user/login/totp":            app.userTOTP,
+		"GET /user/settings/email/verify": app.userSettingsEmailVerify,
+		"GET /healthz":                    app.healthz,
+		"GET /readyz":                     app.readyz,
+		"POST /user/login/totp":           app.userTOTPPost,
 	}
 
-	// Protected routes
+	// Protected routes, browser sessions only
 	protectedRoutes := map[string]http.HandlerFunc{
-		"/":                 app.home,
+		"/":                                 app.home,
+		"POST /user/logout":                 app.userLogoutPost,
+		"GET /film/search":                  app.search,
+		"GET /user/2fa":                     app.userTwoFactor,
+		"POST /user/2fa/enable":             app.userTwoFactorEnablePost,
+		"POST /user/2fa/disable":            app.userTwoFactorDisablePost,
+		"GET /user/tokens":                  app.userTokens,
+		"POST /user/tokens":                 app.userTokensPost,
+		"POST /user/tokens/{id}/revoke":     app.userTokenRevokePost,
+		"GET /user/settings":                app.userSettings,
+		"POST /user/settings/username":      app.userSettingsUsernamePost,
+		"POST /user/settings/email":         app.userSettingsEmailPost,
+		"POST /user/settings/password":      app.userSettingsPasswordPost,
+		"POST /user/settings/delete":        app.userSettingsDeletePost,
+		"GET /user/export":                  app.userExports,
+		"POST /user/export":                 app.userExportsPost,
+		"GET /user/export/{id}/download":    app.userExportDownload,
+		"GET /user/sessions":                app.userSessions,
+		"POST /user/sessions/{id}/revoke":   app.userSessionRevokePost,
+		"POST /user/sessions/revoke-others": app.userSessionsRevokeOthersPost,
+	}
+
+	// JSON routes, open to sessions and API tokens with the read scope
+	apiReadRoutes := map[string]http.HandlerFunc{
 		"GET /films/{id}":   app.getFilm,
-		"POST /user/logout": app.userLogoutPost,
-		"POST /film/search": app.searchPost,
-		"GET /film/search":  app.search,
 		"GET /films":        app.getFilms,
-		"PUT /watchlist":    app.putWatchlist,
-		"PUT /watchedlist":  app.putWatchedlist,
+		"POST /film/search": app.searchPost,
 		"GET /watchlist":    app.getWatchlist,
 		"GET /watchedlist":  app.getWatchedlist,
 	}
+
+	// JSON routes, open to sessions and API tokens with the write scope
+	apiWriteRoutes := map[string]http.HandlerFunc{
+		"PUT /watchlist":   app.putWatchlist,
+		"PUT /watchedlist": app.putWatchedlist,
+	}
+
+	// Admin routes
+	adminRoutes := map[string]http.HandlerFunc{
+		"GET /admin/lockouts":         app.adminLockouts,
+		"POST /admin/lockouts/unlock": app.adminUnlockPost,
+	}
+
+	// Rate limits, counted per user when signed in and per client IP
+	// otherwise. Routes not listed are unlimited; sign-in attempts have
+	// their own throttle.
+	rateLimits := map[string]ratelimit.Policy{
+		"POST /user/signin": {Limit: 20, Period: time.Hour, Burst: 10},
+		"GET /films/{id}":   {Limit: 300, Period: time.Minute, Burst: 60},
+		"GET /films":        {Limit: 60, Period: time.Minute, Burst: 20},
+		"POST /film/search": {Limit: 30, Period: time.Minute, Burst: 10},
+		"PUT /watchlist":    {Limit: 60, Period: time.Minute, Burst: 20},
+		"PUT /watchedlist":  {Limit: 60, Period: time.Minute, Burst: 20},
+		"POST /user/export": {Limit: 5, Period: time.Hour, Burst: 2},
+	}
+
 	// Register unprotected routes
 	for pattern, handler := range unprotectedRoutes {
-		// router.Handle(pattern, csrf(http.HandlerFunc(handler)))
-		router.Handle(pattern, http.HandlerFunc(handler))
+		router.Handle(pattern, tagRoute(pattern, app.rateLimit(pattern, rateLimits[pattern], cacheControl(cacheNoStore, http.HandlerFunc(handler)))))
 	}
 
 	// Register protected routes with authentication
 	for pattern, handler := range protectedRoutes {
-		// router.Handle(pattern, csrf(app.requireAuthentication(http.HandlerFunc(handler))))
-		router.Handle(pattern, app.requireAuthentication(http.HandlerFunc(handler)))
+		router.Handle(pattern, tagRoute(pattern, app.rateLimit(pattern, rateLimits[pattern], cacheControl(cacheNoStore, app.requireAuthentication(app.requireSession(http.HandlerFunc(handler)))))))
+	}
+
+	// Register JSON routes with authentication and token scope checks.
+	// Their errors use the JSON error envelope.
+	for pattern, handler := range apiReadRoutes {
+		router.Handle(pattern, tagRoute(pattern, jsonRoute(app.rateLimit(pattern, rateLimits[pattern], cacheControl(cacheRevalidate, app.requireAuthentication(app.requireScope(models.ScopeRead, http.HandlerFunc(handler))))))))
+	}
+
+	for pattern, handler := range apiWriteRoutes {
+		router.Handle(pattern, tagRoute(pattern, jsonRoute(app.rateLimit(pattern, rateLimits[pattern], cacheControl(cacheNoStore, app.requireAuthentication(app.requireScope(models.ScopeWrite, http.HandlerFunc(handler))))))))
+	}
+
+	// Register admin routes behind authentication and the admin check
+	for pattern, handler := range adminRoutes {
+		router.Handle(pattern, tagRoute(pattern, app.rateLimit(pattern, rateLimits[pattern], cacheControl(cacheNoStore, app.requireAuthentication(app.requireSession(app.requireAdmin(http.HandlerFunc(handler))))))))
+	}
+
+	// Register the versioned API. Reads may be kept by the browser like the
+	// JSON routes above; writes are never stored.
+	for _, route := range app.apiRoutes() {
+		pattern := route.method + " " + apiPrefix + route.path
+		handler := http.Handler(route.handler)
+		if route.scope != "" {
+			handler = app.requireAPIAuthentication(app.requireScope(route.scope, handler))
+		}
+		policy := cacheNoStore
+		if route.method == http.MethodGet {
+			policy = cacheRevalidate
+		}
+		router.Handle(pattern, tagRoute(pattern, jsonRoute(app.rateLimit(pattern, route.limit, cacheControl(policy, handler)))))
 	}
 
 	// Method Not Allowed handlers
@@ -60,8 +136,26 @@ func (app *application) routes() http.Handler {
 	}
 
 	for pattern, methods := range methodNotAllowedRoutes {
-		router.HandleFunc(pattern, app.methodNotAllowed(methods))
+		router.Handle(pattern, tagRoute(pattern, app.methodNotAllowed(methods)))
+	}
+
+	handler := app.middleware(router)
+
+	if app.metricsEndpoint == nil {
+		return handler
 	}
 
-	return app.chainMiddleware(router, app.sessionManager.LoadAndSave, app.recoverPanic, app.logRequest, secureHeaders, app.authenticate)
+	// Scrapes bypass sessions, CSRF and API token authentication.
+	root := http.NewServeMux()
+	root.Handle("GET /metrics", app.metricsEndpoint)
+	root.Handle("/", handler)
+	return root
+}
+
+// middleware wraps h in the middleware every request goes through.
+// recoverPanic comes straight after requestID, so a panic anywhere below it,
+// the compressor and session manager included, still gets a 500 and a log
+// line carrying the request ID.
+func (app *application) middleware(h http.Handler) http.Handler {
+	return app.chainMiddleware(h, app.proxyHeaders, app.requestID, app.recoverPanic, app.traceRequest, app.logRequest, app.instrument, app.compress, app.sessionManager.LoadAndSave, secureHeaders, app.authenticate, app.noSurf)
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs srv, and the plain HTTP servers in extra such as the HTTPS
+// redirect or the metrics listener, until the process receives SIGINT or
+// SIGTERM. It then stops accepting connections, lets in-flight requests and
+// background work finish within drain, and returns.
+func (app *application) serve(srv *http.Server, drain time.Duration, extra ...*http.Server) error {
+	shutdownError := make(chan error)
+
+	for _, s := range extra {
+		go func() {
+			app.logger.Info("starting listener", "addr", s.Addr)
+			err := s.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error(err.Error(), "addr", s.Addr)
+			}
+		}()
+	}
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Info("shutting down server", "signal", s.String())
+		app.shuttingDown.Store(true)
+
+		ctx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+		for _, s := range extra {
+			err = errors.Join(err, s.Shutdown(ctx))
+		}
+
+		// Stop the workers whether or not every connection drained.
+		app.stopBackground()
+
+		done := make(chan struct{})
+		go func() {
+			app.wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = errors.Join(err, errors.New("background tasks did not finish before the drain timeout"))
+		}
+
+		shutdownError <- err
+	}()
+
+	var err error
+	if srv.TLSConfig != nil {
+		// Certificates come from TLSConfig.GetCertificate.
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("stopped server")
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// staticAssets serves the files under static/ in the UI file system. Each
+// file is also served under a fingerprinted name carrying a hash of its
+// contents, such as /static/css/main.1a2b3c4d5e.css, which templates link to
+// through the static function. The name changes whenever the file does, so
+// fingerprinted responses can be cached for good; plain names must be
+// revalidated. Compressible files are encoded ahead of time with every
+// content encoding that makes them smaller.
+type staticAssets struct {
+	urls  map[string]string       // file name under static/ to fingerprinted URL
+	files map[string]*staticAsset // plain and fingerprinted URLs to file
+}
+
+type staticAsset struct {
+	name        string
+	contentType string
+	content     []byte
+	etag        string
+	encoded     map[string][]byte // content by Content-Encoding
+	encodings   []string          // keys of encoded, smallest first
+}
+
+// newStaticAssets loads and fingerprints every file under static/ in fsys.
+func newStaticAssets(fsys fs.FS) (*staticAssets, error) {
+	s := &staticAssets{
+		urls:  map[string]string{},
+		files: map[string]*staticAsset{},
+	}
+
+	err := fs.WalkDir(fsys, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:])
+		ext := path.Ext(name)
+		asset := &staticAsset{
+			name:        name,
+			contentType: cmp.Or(mime.TypeByExtension(ext), http.DetectContentType(content)),
+			content:     content,
+			etag:        `"` + hash + `"`,
+			encoded:     map[string][]byte{},
+		}
+		if compressible(asset.contentType) {
+			err = asset.precompress()
+			if err != nil {
+				return err
+			}
+		}
+
+		fingerprinted := "/" + strings.TrimSuffix(name, ext) + "." + hash[:10] + ext
+		s.urls[strings.TrimPrefix(name, "static/")] = fingerprinted
+		s.files["/"+name] = asset
+		s.files[fingerprinted] = asset
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// URL returns the fingerprinted URL of name, a file under static/. Unknown
+// names get their plain URL.
+func (s *staticAssets) URL(name string) string {
+	if url, ok := s.urls[name]; ok {
+		return url
+	}
+	return "/static/" + name
+}
+
+func (s *staticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	asset, ok := s.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if "/"+asset.name == r.URL.Path {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	content, etag := asset.content, asset.etag
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), asset.encodings)
+	if encoding != "" {
+		content = asset.encoded[encoding]
+		etag = strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, asset.name, time.Time{}, bytes.NewReader(content))
+}
+
+// precompress encodes the asset with every content encoding that shrinks
+// it.
+func (a *staticAsset) precompress() error {
+	for _, e := range contentEncodings {
+		encoded, err := e.compress(a.content)
+		if err != nil {
+			return err
+		}
+		if len(encoded) < len(a.content) {
+			a.encoded[e.name] = encoded
+			a.encodings = append(a.encodings, e.name)
+		}
+	}
+
+	slices.SortStableFunc(a.encodings, func(x, y string) int {
+		return cmp.Compare(len(a.encoded[x]), len(a.encoded[y]))
+	})
+	return nil
+}
@@ -19,8 +19,24 @@ type templateData struct {
 	Form            any
 	Flash           string
 	IsAuthenticated bool
+	IsAdmin         bool
+	Lockouts        []models.LoginAttempt
+	TwoFactor       twoFactorData
+	RecoveryCodes   []string
+	APITokens       []models.APIToken
+	NewAPIToken     string
+	Sessions        []models.UserSession
+	CurrentSession  string
+	User            *models.User
+	Exports         []models.DataExport
 	CSRFToken       string
-	UserID          int
+}
+
+type twoFactorData struct {
+	Enabled bool
+	Secret  string
+	URI     template.URL
+	QRCode  template.URL
 }
 
 func humanDate(t time.Time) string {
@@ -31,9 +47,17 @@ var functions = template.FuncMap{
 	"humanDate": humanDate,
 }
 
-func newTemplateCache() (map[string]*template.Template, error) {
+// newTemplateCache parses every page. Templates link to static files with
+// {{static "css/main.css"}}, which gives the file's fingerprinted URL in
+// assets.
+func newTemplateCache(assets *staticAssets) (map[string]*template.Template, error) {
 	cache := map[string]*template.Template{}
 
+	funcs := template.FuncMap{"static": assets.URL}
+	for name, fn := range functions {
+		funcs[name] = fn
+	}
+
 	pages, err := fs.Glob(ui.Files, "html/pages/*.html")
 	if err != nil {
 		return nil, err
@@ -48,7 +72,7 @@ func newTemplateCache() (map[string]*template.Template, error) {
 			page,
 		}
 
-		ts, err := template.New(name).Funcs(functions).ParseFS(ui.Files, patterns...)
+		ts, err := template.New(name).Funcs(funcs).ParseFS(ui.Files, patterns...)
 
 		if err != nil {
 			return nil, err
@@ -66,7 +90,7 @@ func (app *application) newTemplateData(r *http.Request) *templateData {
 		CurrentYear:     time.Now(),
 		Flash:           app.sessionManager.PopString(r.Context(), "flash"),
 		IsAuthenticated: app.isAuthenticated(r),
+		IsAdmin:         app.isAdmin(r),
 		CSRFToken:       csrf.Token(r),
-		UserID:          app.sessionManager.GetInt(r.Context(), "userID"),
 	}
 }
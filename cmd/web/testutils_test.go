@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"golang.org/x/crypto/bcrypt"
+	"movies4u.net/internals/cache"
+	"movies4u.net/internals/export"
+	"movies4u.net/internals/metrics"
+	"movies4u.net/internals/models"
+	"movies4u.net/internals/ratelimit"
+	"movies4u.net/internals/throttle"
+	"movies4u.net/ui"
+)
+
+// Films every test application starts with.
+var (
+	testFilmMatrix = models.Film{
+		ID: 1, Name: "The Matrix", Year: 1999, RunTime: 136, Rating: 8.7,
+		Genres:    []models.Genre{{ID: 1, Name: "Sci-Fi"}},
+		Directors: []models.Director{{ID: 1, Name: "Lana Wachowski"}},
+		Stars:     []models.Star{{ID: 1, Name: "Keanu Reeves"}},
+	}
+	testFilmHeat = models.Film{
+		ID: 2, Name: "Heat", Year: 1995, RunTime: 170, Rating: 8.3,
+		Genres:    []models.Genre{{ID: 2, Name: "Crime"}},
+		Directors: []models.Director{{ID: 2, Name: "Michael Mann"}},
+		Stars:     []models.Star{{ID: 2, Name: "Al Pacino"}},
+	}
+)
+
+// testAssets loads the static files once, as precompressing them is slow.
+var testAssets = sync.OnceValues(func() (*staticAssets, error) {
+	return newStaticAssets(ui.Files)
+})
+
+// testPassword is the password of every user made by addTestUser.
+const testPassword = "correct horse battery"
+
+// testDB stands in for the database readyz pings, failing with err.
+type testDB struct {
+	err error
+}
+
+func (db *testDB) PingContext(ctx context.Context) error {
+	return db.err
+}
+
+// newTestApplication returns an application whose films, users and
+// everything belonging to them live in the returned MemoryStore, with film
+// and credit reads cached as in production. Login attempts, rate limits and
+// sessions are kept in memory too, so no database is involved.
+func newTestApplication(t *testing.T) (*application, *models.MemoryStore) {
+	t.Helper()
+
+	assets, err := testAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templateCache, err := newTemplateCache(assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionManager := scs.New()
+	sessionManager.Store = memstore.NewWithCleanupInterval(0)
+
+	csrfKey := make([]byte, 32)
+	_, err = rand.Read(csrfKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := models.NewMemoryStore()
+	store.AddFilm(testFilmMatrix)
+	store.AddFilm(testFilmHeat)
+
+	m := metrics.New()
+
+	films := &models.CachedFilmStore{
+		Store:   store.Films(),
+		Cache:   cache.NewLRU(100),
+		TTL:     time.Minute,
+		Observe: m.ObserveCache,
+	}
+
+	ctx, stopBackground := context.WithCancel(context.Background())
+	app := &application{
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		db:             &testDB{},
+		films:          films,
+		users:          store.Users(),
+		authCache:      cache.NewLRU(100),
+		authCacheTTL:   time.Minute,
+		lists:          store.Lists(),
+		credits:        &models.CachedCreditStore{Store: store.Credits(), Films: films},
+		sessions:       store.Sessions(),
+		tokens:         store.Tokens(),
+		exports:        store.Exports(),
+		baseURL:        "https://movies4u.test",
+		templateCache:  templateCache,
+		static:         assets,
+		sessionManager: sessionManager,
+		throttle: &throttle.Throttle{
+			Backend: throttle.NewMemory(),
+			Account: throttle.DefaultAccountPolicy,
+			IP:      throttle.DefaultIPPolicy,
+		},
+		rateLimiter: ratelimit.NewMemory(),
+		exporter: &export.Exporter{
+			Users:    store.Users(),
+			Lists:    store.Lists(),
+			Sessions: store.Sessions(),
+			Tokens:   store.Tokens(),
+			Exports:  store.Exports(),
+			Dir:      t.TempDir(),
+			TTL:      time.Hour,
+		},
+		csrfKey:        csrfKey,
+		metrics:        m,
+		ctx:            ctx,
+		stopBackground: stopBackground,
+	}
+	app.catalogue.Store(catalogueReady)
+
+	// Background work finishes before the test's temporary directories,
+	// where exports are written, are removed.
+	t.Cleanup(func() {
+		stopBackground()
+		app.wg.Wait()
+	})
+
+	return app, store
+}
+
+// addTestUser creates a user who can sign in with testPassword.
+func addTestUser(t *testing.T, app *application, userName, email string, admin bool) models.User {
+	t.Helper()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := models.User{UserName: userName, Email: email, Password: string(hashedPassword), Admin: admin}
+	err = app.users.Insert(context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// addTestAPIToken stores an API token for userID and returns its plaintext.
+func addTestAPIToken(t *testing.T, app *application, userID uint, scope string) string {
+	t.Helper()
+
+	plaintext, hash, err := models.GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.tokens.Insert(context.Background(), &models.APIToken{UserID: userID, Name: "test", TokenHash: hash, Scope: scope})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plaintext
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+// newTestServer serves h with a client that keeps cookies and doesn't follow
+// redirects, so tests can check where they point.
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Client().Jar = jar
+	ts.Client().CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return &testServer{ts}
+}
+
+// testResponse is what a test needs from a response; the body is read in
+// full.
+type testResponse struct {
+	status int
+	header http.Header
+	body   string
+}
+
+func (ts *testServer) do(t *testing.T, method, urlPath string, header http.Header, body io.Reader) testResponse {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+urlPath, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testResponse{status: res.StatusCode, header: res.Header, body: string(b)}
+}
+
+func (ts *testServer) get(t *testing.T, urlPath string) testResponse {
+	t.Helper()
+	return ts.do(t, http.MethodGet, urlPath, nil, nil)
+}
+
+// postForm posts form to urlPath, adding a valid CSRF token unless the form
+// already has one.
+func (ts *testServer) postForm(t *testing.T, urlPath string, form url.Values) testResponse {
+	t.Helper()
+
+	if form == nil {
+		form = url.Values{}
+	}
+	if !form.Has("csrf_token") {
+		form.Set("csrf_token", ts.csrfToken(t))
+	}
+
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	return ts.do(t, http.MethodPost, urlPath, header, strings.NewReader(form.Encode()))
+}
+
+// sendJSON sends body with method to urlPath the way the site's scripts do,
+// with the CSRF token in a header.
+func (ts *testServer) sendJSON(t *testing.T, method, urlPath, body string) testResponse {
+	t.Helper()
+
+	header := http.Header{
+		"Content-Type": {"application/json"},
+		"X-Csrf-Token": {ts.csrfToken(t)},
+	}
+	return ts.do(t, method, urlPath, header, bytes.NewBufferString(body))
+}
+
+var csrfTokenRX = regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`)
+
+// csrfToken returns a CSRF token valid for the client's cookies.
+func (ts *testServer) csrfToken(t *testing.T) string {
+	t.Helper()
+
+	res := ts.get(t, "/user/login")
+	matches := csrfTokenRX.FindStringSubmatch(res.body)
+	if len(matches) < 2 {
+		t.Fatal("no CSRF token found in body")
+	}
+	return html.UnescapeString(matches[1])
+}
+
+// login signs the client in as the user with email.
+func (ts *testServer) login(t *testing.T, email string) {
+	t.Helper()
+
+	res := ts.postForm(t, "/user/login", url.Values{"email": {email}, "password": {testPassword}})
+	if res.status != http.StatusSeeOther || res.header.Get("Location") != "/" {
+		t.Fatalf("login as %s: got status %d, location %q", email, res.status, res.header.Get("Location"))
+	}
+}
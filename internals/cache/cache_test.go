@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := NewLRU(2)
+	c.now = func() time.Time { return now }
+
+	get := func(key string) (string, bool) {
+		t.Helper()
+		value, ok, err := c.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(value), ok
+	}
+
+	c.Set(ctx, "a", []byte("1"), 0)
+	c.Set(ctx, "b", []byte("2"), time.Minute)
+	if value, ok := get("a"); !ok || value != "1" {
+		t.Errorf("a: got %q, %t", value, ok)
+	}
+
+	// a was just used, so b is evicted.
+	c.Set(ctx, "c", []byte("3"), time.Minute)
+	if _, ok := get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	if c.Len() != 2 {
+		t.Errorf("got %d entries, want 2", c.Len())
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := get("c"); ok {
+		t.Error("c should have expired")
+	}
+	if _, ok := get("a"); !ok {
+		t.Error("a never expires")
+	}
+
+	c.Delete(ctx, "a")
+	if _, ok := get("a"); ok {
+		t.Error("a should have been deleted")
+	}
+}
@@ -0,0 +1,612 @@
+package config
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+	"movies4u.net/internals/validator"
+)
+
+// Config holds every setting the web server reads at startup. Values are
+// layered, each source overriding the ones before it: built-in defaults, the
+// YAML config file, environment variables (including a .env file) and
+// finally command-line flags.
+type Config struct {
+	Addr      string `yaml:"addr" env:"ADDR"`
+	DataPath  string `yaml:"data_path" env:"DATA_PATH"`
+	ExportDir string `yaml:"export_dir" env:"EXPORT_DIR"`
+
+	// BaseURL is the public address of the site, used for links sent out of
+	// band such as in emails. Request headers can't be trusted for this.
+	BaseURL string `yaml:"base_url" env:"BASE_URL"`
+
+	DB        DB        `yaml:"db"`
+	TLS       TLS       `yaml:"tls"`
+	Proxy     Proxy     `yaml:"proxy"`
+	Session   Session   `yaml:"session"`
+	Timeouts  Timeouts  `yaml:"timeouts"`
+	Cache     Cache     `yaml:"cache"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	Log       Log       `yaml:"log"`
+	Metrics   Metrics   `yaml:"metrics"`
+	Tracing   Tracing   `yaml:"tracing"`
+	SMTP      SMTP      `yaml:"smtp"`
+}
+
+// DB selects and configures the database. Driver is one of DriverMySQL,
+// DriverPostgres or DriverSQLite; SQLite only uses Path, the others connect
+// to Host and Port, where port 0 means the driver's standard port.
+type DB struct {
+	Driver          string        `yaml:"driver" env:"DB_DRIVER"`
+	Path            string        `yaml:"path" env:"DB_PATH"`
+	Host            string        `yaml:"host" env:"DB_HOST"`
+	Port            int           `yaml:"port" env:"DB_PORT"`
+	SSLMode         string        `yaml:"sslmode" env:"DB_SSLMODE"`
+	User            string        `yaml:"user" env:"DB_USER"`
+	Password        string        `yaml:"password" env:"DB_PASSWORD" secret:"true"`
+	Name            string        `yaml:"name" env:"DB_NAME"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	// AutoMigrate applies pending migrations when the server starts.
+	AutoMigrate bool `yaml:"auto_migrate" env:"DB_AUTO_MIGRATE"`
+}
+
+// TLS selects how the server is reached. In ModeHTTP it speaks plain HTTP
+// and expects a reverse proxy in front to terminate TLS; in ModeTLS it loads
+// CertFile and KeyFile, reloading them when they change; in ModeACME it
+// obtains certificates for ACMEDomains automatically.
+type TLS struct {
+	Mode         string   `yaml:"mode" env:"TLS_MODE"`
+	CertFile     string   `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile      string   `yaml:"key_file" env:"TLS_KEY_FILE"`
+	RedirectAddr string   `yaml:"redirect_addr" env:"TLS_REDIRECT_ADDR"`
+	ACMEDomains  []string `yaml:"acme_domains" env:"ACME_DOMAINS"`
+	ACMEEmail    string   `yaml:"acme_email" env:"ACME_EMAIL"`
+	ACMECacheDir string   `yaml:"acme_cache_dir" env:"ACME_CACHE_DIR"`
+}
+
+// Proxy lists the reverse proxies whose X-Forwarded-For, X-Forwarded-Proto
+// and X-Forwarded-Host headers are believed. Entries are IPs or CIDR ranges.
+type Proxy struct {
+	Trusted []string `yaml:"trusted" env:"TRUSTED_PROXIES"`
+}
+
+type Session struct {
+	Lifetime      time.Duration `yaml:"lifetime" env:"SESSION_LIFETIME"`
+	SecureCookies bool          `yaml:"secure_cookies" env:"SECURE_COOKIES"`
+	CSRFKey       string        `yaml:"csrf_key" env:"CSRF_KEY" secret:"true"`
+}
+
+type Timeouts struct {
+	Read     time.Duration `yaml:"read" env:"READ_TIMEOUT"`
+	Write    time.Duration `yaml:"write" env:"WRITE_TIMEOUT"`
+	Idle     time.Duration `yaml:"idle" env:"IDLE_TIMEOUT"`
+	Shutdown time.Duration `yaml:"shutdown" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// Cache sizes the in-process caches of film reads and of signed-in users'
+// authentication state. Size is the number of entries each keeps, 0
+// disables them. Film reads expire after TTL; a user's state after AuthTTL,
+// which bounds how long another instance can still accept a session after
+// the user's password or role changed.
+type Cache struct {
+	Size    int           `yaml:"size" env:"CACHE_SIZE"`
+	TTL     time.Duration `yaml:"ttl" env:"CACHE_TTL"`
+	AuthTTL time.Duration `yaml:"auth_ttl" env:"CACHE_AUTH_TTL"`
+}
+
+// RateLimit turns the per-route rate limits on. Buckets live in memory with
+// BackendMemory, or in the database with BackendDatabase, where every
+// instance shares them.
+type RateLimit struct {
+	Enabled bool   `yaml:"enabled" env:"RATE_LIMIT_ENABLED"`
+	Backend string `yaml:"backend" env:"RATE_LIMIT_BACKEND"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+// Metrics controls the Prometheus /metrics endpoint. When Addr is set it is
+// served on its own listener instead of the main one, and when Token is set
+// scrapers must send it as a bearer token.
+type Metrics struct {
+	Enabled bool   `yaml:"enabled" env:"METRICS_ENABLED"`
+	Addr    string `yaml:"addr" env:"METRICS_ADDR"`
+	Token   string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+// Tracing controls OpenTelemetry tracing. Spans are sent to an OTLP/HTTP
+// collector at Endpoint with ExporterOTLP, written as JSON lines to File with
+// ExporterFile, or not recorded at all with ExporterNone.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER"`
+	Endpoint    string  `yaml:"endpoint" env:"TRACING_ENDPOINT"`
+	Insecure    bool    `yaml:"insecure" env:"TRACING_INSECURE"`
+	File        string  `yaml:"file" env:"TRACING_FILE"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+	ServiceName string  `yaml:"service_name" env:"TRACING_SERVICE_NAME"`
+}
+
+type SMTP struct {
+	Host     string `yaml:"host" env:"SMTP_HOST"`
+	Port     int    `yaml:"port" env:"SMTP_PORT"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD" secret:"true"`
+	Sender   string `yaml:"sender" env:"SMTP_SENDER"`
+}
+
+// Database drivers accepted by DB.Driver.
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// Server modes accepted by TLS.Mode.
+const (
+	ModeHTTP = "http"
+	ModeTLS  = "tls"
+	ModeACME = "acme"
+)
+
+// Log levels accepted by Log.Level.
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// Span exporters accepted by Tracing.Exporter.
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+// Rate limit backends accepted by RateLimit.Backend.
+const (
+	BackendMemory   = "memory"
+	BackendDatabase = "database"
+)
+
+// Log output formats accepted by Log.Format.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+func Default() Config {
+	return Config{
+		Addr:      ":4000",
+		BaseURL:   "https://localhost:4000",
+		DataPath:  "./data/films.json",
+		ExportDir: "./data/exports",
+		DB: DB{
+			Driver:          DriverMySQL,
+			Path:            "./data/movies4u.db",
+			SSLMode:         "prefer",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 5 * time.Minute,
+			AutoMigrate:     true,
+		},
+		TLS: TLS{
+			Mode:         ModeTLS,
+			CertFile:     "./tls/cert.pem",
+			KeyFile:      "./tls/key.pem",
+			ACMECacheDir: "./data/acme",
+		},
+		Session: Session{
+			Lifetime:      12 * time.Hour,
+			SecureCookies: true,
+		},
+		Timeouts: Timeouts{
+			Read:     5 * time.Second,
+			Write:    10 * time.Second,
+			Idle:     time.Minute,
+			Shutdown: 30 * time.Second,
+		},
+		Cache: Cache{
+			Size:    10000,
+			TTL:     10 * time.Minute,
+			AuthTTL: 30 * time.Second,
+		},
+		RateLimit: RateLimit{
+			Enabled: true,
+			Backend: BackendMemory,
+		},
+		Log: Log{
+			Level:  LevelInfo,
+			Format: FormatJSON,
+		},
+		Tracing: Tracing{
+			Exporter:    ExporterNone,
+			Endpoint:    "localhost:4318",
+			Insecure:    true,
+			File:        "./data/traces.jsonl",
+			SampleRatio: 1,
+			ServiceName: "movies4u",
+		},
+	}
+}
+
+// Load builds the configuration from all sources and validates it. args are
+// the command-line arguments without the program name.
+func Load(args []string) (*Config, error) {
+	cfg, _, err := Parse("web", args)
+	return cfg, err
+}
+
+// Parse is Load for commands that take positional arguments after the flags,
+// which it returns. name is the command name shown in usage messages.
+func Parse(name string, args []string) (*Config, []string, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", "", "Path to a YAML config file, $CONFIG_FILE by default")
+	envFile := fs.String("env", ".env", "Path to a .env file, ignored if missing")
+	addr := fs.String("addr", cfg.Addr, "Http Server Listening Port")
+	dataPath := fs.String("json", cfg.DataPath, "Path to the JSON file containing film data")
+	exportDir := fs.String("exports", cfg.ExportDir, "Directory personal data exports are written to")
+	secureCookies := fs.Bool("secure-cookies", cfg.Session.SecureCookies, "Only send cookies over HTTPS, disable for plain HTTP development")
+	logLevel := fs.String("log-level", cfg.Log.Level, "Minimum level to log: debug, info, warn or error")
+	logFormat := fs.String("log-format", cfg.Log.Format, "Log output format: json or text")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// godotenv never overrides variables that are already set, so the real
+	// environment wins over .env. It is loaded first so it can name the
+	// config file too.
+	err = godotenv.Load(*envFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("config: loading %s: %w", *envFile, err)
+	}
+
+	path := cmp.Or(*configFile, os.Getenv("CONFIG_FILE"))
+	if path != "" {
+		err = cfg.loadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = loadEnv(reflect.ValueOf(&cfg).Elem())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only flags given explicitly override the earlier sources.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *addr
+		case "json":
+			cfg.DataPath = *dataPath
+		case "exports":
+			cfg.ExportDir = *exportDir
+		case "secure-cookies":
+			cfg.Session.SecureCookies = *secureCookies
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		}
+	})
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &cfg, fs.Args(), nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil {
+		return fmt.Errorf("config: parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv sets every field tagged with env from the environment variable of
+// that name, when it is set. A variable set but empty clears the setting.
+func loadEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct {
+			err := loadEnv(value)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		err := setValue(value, raw)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, raw string) error {
+	if raw == "" {
+		v.SetZero()
+		return nil
+	}
+
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(raw)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Validate checks the configuration is usable, reporting every problem at
+// once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Addr)
+	check(err == nil, "addr %q is not a valid listen address", c.Addr)
+	base, err := url.Parse(c.BaseURL)
+	check(err == nil && (base.Scheme == "http" || base.Scheme == "https") && base.Host != "" && base.RawQuery == "" && base.Fragment == "",
+		"base_url %q must be an absolute http or https URL", c.BaseURL)
+	check(c.DataPath != "", "data_path must be set")
+	check(c.ExportDir != "", "export_dir must be set")
+
+	check(validator.PermittedValue(c.DB.Driver, DriverMySQL, DriverPostgres, DriverSQLite), "db.driver must be one of mysql, postgres or sqlite")
+	if c.DB.Driver == DriverSQLite {
+		check(c.DB.Path != "", "db.path must be set")
+	} else {
+		check(c.DB.Host != "", "db.host must be set")
+		check(c.DB.Port >= 0 && c.DB.Port < 65536, "db.port must be between 0 and 65535")
+		check(c.DB.User != "", "db.user must be set")
+		check(c.DB.Name != "", "db.name must be set")
+	}
+	check(c.DB.MaxOpenConns >= 0, "db.max_open_conns can't be negative")
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns can't be negative")
+	check(c.DB.ConnMaxLifetime >= 0, "db.conn_max_lifetime can't be negative")
+
+	check(validator.PermittedValue(c.TLS.Mode, ModeHTTP, ModeTLS, ModeACME), "tls.mode must be one of http, tls or acme")
+	switch c.TLS.Mode {
+	case ModeTLS:
+		check(c.TLS.CertFile != "", "tls.cert_file must be set")
+		check(c.TLS.KeyFile != "", "tls.key_file must be set")
+	case ModeACME:
+		check(len(c.TLS.ACMEDomains) > 0, "tls.acme_domains must be set")
+		check(c.TLS.ACMECacheDir != "", "tls.acme_cache_dir must be set")
+	}
+	if c.TLS.RedirectAddr != "" {
+		_, _, err = net.SplitHostPort(c.TLS.RedirectAddr)
+		check(err == nil, "tls.redirect_addr %q is not a valid listen address", c.TLS.RedirectAddr)
+		check(c.TLS.Mode != ModeHTTP, "tls.redirect_addr needs tls.mode tls or acme")
+	}
+
+	if c.Metrics.Addr != "" {
+		_, _, err = net.SplitHostPort(c.Metrics.Addr)
+		check(err == nil, "metrics.addr %q is not a valid listen address", c.Metrics.Addr)
+		check(c.Metrics.Addr != c.Addr, "metrics.addr must differ from addr")
+	}
+
+	check(validator.PermittedValue(c.Tracing.Exporter, ExporterNone, ExporterOTLP, ExporterFile), "tracing.exporter must be one of none, otlp or file")
+	switch c.Tracing.Exporter {
+	case ExporterOTLP:
+		check(c.Tracing.Endpoint != "", "tracing.endpoint must be set")
+	case ExporterFile:
+		check(c.Tracing.File != "", "tracing.file must be set")
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	_, err = c.Proxy.Networks()
+	check(err == nil, "proxy.trusted: %v", err)
+
+	check(c.Session.Lifetime > 0, "session.lifetime must be positive")
+	if c.Session.CSRFKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.Session.CSRFKey)
+		check(err == nil && len(key) == 32, "session.csrf_key must be 32 bytes, base64 encoded")
+	}
+
+	check(c.Timeouts.Read > 0, "timeouts.read must be positive")
+	check(c.Timeouts.Write > 0, "timeouts.write must be positive")
+	check(c.Timeouts.Idle > 0, "timeouts.idle must be positive")
+	check(c.Timeouts.Shutdown > 0, "timeouts.shutdown must be positive")
+
+	check(c.Cache.Size >= 0, "cache.size can't be negative")
+	check(c.Cache.TTL > 0, "cache.ttl must be positive")
+	check(c.Cache.AuthTTL > 0, "cache.auth_ttl must be positive")
+	check(validator.PermittedValue(c.RateLimit.Backend, BackendMemory, BackendDatabase), "rate_limit.backend must be memory or database")
+
+	check(validator.PermittedValue(c.Log.Level, LevelDebug, LevelInfo, LevelWarn, LevelError), "log.level must be one of debug, info, warn or error")
+	check(validator.PermittedValue(c.Log.Format, FormatJSON, FormatText), "log.format must be json or text")
+
+	if c.SMTP.Host != "" {
+		check(c.SMTP.Port > 0 && c.SMTP.Port < 65536, "smtp.port must be between 1 and 65535")
+		check(c.SMTP.Sender != "", "smtp.sender must be set")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Networks parses the trusted proxy list.
+func (p Proxy) Networks() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range p.Trusted {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// DSN returns the data source name for the configured driver.
+func (d DB) DSN() string {
+	switch d.Driver {
+	case DriverPostgres:
+		port := cmp.Or(d.Port, 5432)
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(d.User, d.Password),
+			Host:     net.JoinHostPort(d.Host, strconv.Itoa(port)),
+			Path:     "/" + d.Name,
+			RawQuery: url.Values{"sslmode": {d.SSLMode}}.Encode(),
+		}
+		return u.String()
+	case DriverSQLite:
+		// Foreign keys are off by default in SQLite, and the busy timeout
+		// makes concurrent writers wait instead of failing.
+		q := url.Values{"_pragma": {"foreign_keys(1)", "busy_timeout(5000)", "journal_mode(WAL)"}}
+		return d.Path + "?" + q.Encode()
+	default:
+		cfg := mysql.NewConfig()
+		cfg.User = d.User
+		cfg.Passwd = d.Password
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(d.Host, strconv.Itoa(cmp.Or(d.Port, 3306)))
+		cfg.DBName = d.Name
+		cfg.ParseTime = true
+		return cfg.FormatDSN()
+	}
+}
+
+// CSRFKeyBytes returns the decoded CSRF key, or nil if none is configured.
+func (s Session) CSRFKeyBytes() []byte {
+	if s.CSRFKey == "" {
+		return nil
+	}
+	key, _ := base64.StdEncoding.DecodeString(s.CSRFKey)
+	return key
+}
+
+// Redacted returns a copy of the configuration with every secret masked,
+// safe for logging.
+func (c Config) Redacted() Config {
+	redact(reflect.ValueOf(&c).Elem())
+	return c
+}
+
+// String renders the redacted configuration as YAML.
+func (c Config) String() string {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func redact(v reflect.Value) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct {
+			redact(value)
+			continue
+		}
+
+		if field.Tag.Get("secret") == "true" && value.String() != "" {
+			value.SetString("[REDACTED]")
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to name in a scratch directory and returns its
+// path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// unsetAfter removes variables a .env file may set once the test is over,
+// since godotenv sets them for the whole process.
+func unsetAfter(t *testing.T, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Fatalf("%s is already set", name)
+		}
+	}
+	t.Cleanup(func() {
+		for _, name := range names {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// noEnvFile is an -env argument pointing at a file that doesn't exist, so
+// tests don't pick up a stray .env.
+func noEnvFile(t *testing.T) string {
+	return "-env=" + filepath.Join(t.TempDir(), "missing.env")
+}
+
+func TestPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+addr: ":5000"
+data_path: file.json
+export_dir: file-exports
+db:
+  driver: sqlite
+  path: file.db
+log:
+  level: debug
+  format: text
+`)
+	// CONFIG_FILE may come from .env, and the real environment wins over it.
+	envFile := writeFile(t, ".env", "CONFIG_FILE="+file+"\nADDR=:6001\nDATA_PATH=dotenv.json\n")
+	unsetAfter(t, "CONFIG_FILE", "DATA_PATH")
+	t.Setenv("ADDR", ":6000")
+	t.Setenv("DB_PATH", "env.db")
+
+	cfg, err := Load([]string{"-env=" + envFile, "-log-level=warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setting   string
+		got, want any
+	}{
+		{"addr from the environment", cfg.Addr, ":6000"},
+		{"data_path from .env", cfg.DataPath, "dotenv.json"},
+		{"db.path from the environment", cfg.DB.Path, "env.db"},
+		{"export_dir from the file", cfg.ExportDir, "file-exports"},
+		{"log.format from the file", cfg.Log.Format, FormatText},
+		{"log.level from a flag", cfg.Log.Level, LevelWarn},
+		{"session.lifetime by default", cfg.Session.Lifetime, 12 * time.Hour},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+}
+
+func TestEmptyEnvironment(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+db:
+  driver: sqlite
+  port: 5432
+proxy:
+  trusted: [10.0.0.1]
+smtp:
+  host: mail.example.com
+  port: 587
+  sender: films@example.com
+`)
+	t.Setenv("SMTP_HOST", "")
+	t.Setenv("TRUSTED_PROXIES", "")
+	t.Setenv("DB_PORT", "")
+
+	cfg, err := Load([]string{noEnvFile(t), "-config=" + file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SMTP.Host != "" || cfg.Proxy.Trusted != nil || cfg.DB.Port != 0 {
+		t.Errorf("empty variables should clear settings, got %q, %v, %d", cfg.SMTP.Host, cfg.Proxy.Trusted, cfg.DB.Port)
+	}
+	if cfg.SMTP.Sender != "films@example.com" {
+		t.Errorf("unset variables shouldn't, got %q", cfg.SMTP.Sender)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("DB_DRIVER", DriverSQLite)
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{name: "missing file", args: []string{"-config=" + filepath.Join(t.TempDir(), "nope.yaml")}, want: "no such file"},
+		{name: "unknown field", args: []string{"-config=" + writeFile(t, "bad.yaml", "adress: :80\n")}, want: "field adress not found"},
+		{name: "bad number", env: map[string]string{"CACHE_SIZE": "lots"}, want: "CACHE_SIZE"},
+		{name: "bad duration", env: map[string]string{"CACHE_TTL": "10"}, want: "CACHE_TTL"},
+		{name: "invalid value", env: map[string]string{"LOG_LEVEL": "loud"}, want: "log.level must be one of"},
+		{name: "unknown flag", args: []string{"-nope"}, want: "flag provided but not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load(append([]string{noEnvFile(t)}, tt.args...))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		cfg := Default()
+		cfg.DB.Driver = DriverSQLite
+		return cfg
+	}
+	base := valid()
+	err := base.Validate()
+	if err != nil {
+		t.Fatalf("defaults with sqlite should be valid: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string // empty when the change is valid
+	}{
+		{"bad addr", func(c *Config) { c.Addr = "4000" }, "addr"},
+		{"relative base_url", func(c *Config) { c.BaseURL = "movies4u.net" }, "base_url"},
+		{"base_url with a query", func(c *Config) { c.BaseURL = "https://movies4u.net/?a=1" }, "base_url"},
+		{"base_url with a path", func(c *Config) { c.BaseURL = "https://example.com/films/" }, ""},
+		{"unknown driver", func(c *Config) { c.DB.Driver = "oracle" }, "db.driver"},
+		{"mysql without a host", func(c *Config) { c.DB.Driver = DriverMySQL }, "db.host must be set"},
+		{"postgres", func(c *Config) {
+			c.DB = DB{Driver: DriverPostgres, Host: "db", User: "u", Name: "films"}
+		}, ""},
+		{"tls without a cert", func(c *Config) { c.TLS.CertFile = "" }, "tls.cert_file"},
+		{"acme without domains", func(c *Config) { c.TLS.Mode = ModeACME }, "tls.acme_domains"},
+		{"redirect in http mode", func(c *Config) { c.TLS.Mode, c.TLS.RedirectAddr = ModeHTTP, ":80" }, "tls.redirect_addr needs"},
+		{"metrics on the main address", func(c *Config) { c.Metrics.Addr = c.Addr }, "metrics.addr must differ"},
+		{"bad proxy", func(c *Config) { c.Proxy.Trusted = []string{"proxy"} }, "proxy.trusted"},
+		{"short csrf key", func(c *Config) { c.Session.CSRFKey = "c2hvcnQ=" }, "session.csrf_key"},
+		{"no timeout", func(c *Config) { c.Timeouts.Read = 0 }, "timeouts.read"},
+		{"sample ratio", func(c *Config) { c.Tracing.SampleRatio = 2 }, "tracing.sample_ratio"},
+		{"smtp without a sender", func(c *Config) { c.SMTP = SMTP{Host: "mail", Port: 25} }, "smtp.sender"},
+		{"rate limit backend", func(c *Config) { c.RateLimit.Backend = "redis" }, "rate_limit.backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("got %v, want no error", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	// Every problem is reported, not just the first.
+	cfg := valid()
+	cfg.Addr, cfg.Log.Format = "", "xml"
+	err = cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "addr") || !strings.Contains(err.Error(), "log.format") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.DB.Password = "db-secret"
+	cfg.Session.CSRFKey = "csrf-secret"
+	cfg.Metrics.Token = "metrics-secret"
+	cfg.DB.User = "movies4u"
+
+	redacted := cfg.Redacted()
+	if redacted.DB.Password != "[REDACTED]" || redacted.Session.CSRFKey != "[REDACTED]" || redacted.Metrics.Token != "[REDACTED]" {
+		t.Errorf("secrets weren't redacted: %+v", redacted)
+	}
+	if redacted.SMTP.Password != "" {
+		t.Errorf("unset secrets should stay empty, got %q", redacted.SMTP.Password)
+	}
+	if redacted.DB.User != "movies4u" {
+		t.Errorf("other settings should be kept, got %q", redacted.DB.User)
+	}
+	if cfg.DB.Password != "db-secret" {
+		t.Error("Redacted changed the original")
+	}
+
+	s := cfg.String()
+	for _, secret := range []string{"db-secret", "csrf-secret", "metrics-secret"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("String leaks %q", secret)
+		}
+	}
+	if !strings.Contains(s, "user: movies4u") {
+		t.Errorf("String is missing settings:\n%s", s)
+	}
+}
+
+func TestDSN(t *testing.T) {
+	tests := []struct {
+		db   DB
+		want string
+	}{
+		{
+			DB{Driver: DriverMySQL, Host: "db", User: "u", Password: "p@ss", Name: "films"},
+			"u:p@ss@tcp(db:3306)/films?parseTime=true",
+		},
+		{
+			DB{Driver: DriverPostgres, Host: "db", Port: 6432, User: "u", Password: "p@ss", Name: "films", SSLMode: "require"},
+			"postgres://u:p%40ss@db:6432/films?sslmode=require",
+		},
+		{
+			DB{Driver: DriverSQLite, Path: "./data/films.db"},
+			"./data/films.db?_pragma=foreign_keys%281%29&_pragma=busy_timeout%285000%29&_pragma=journal_mode%28WAL%29",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.db.DSN(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.db.Driver, got, tt.want)
+		}
+	}
+}
@@ -1,16 +1,24 @@
 package dataloader
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"os"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 	"movies4u.net/internals/models"
+	"movies4u.net/internals/tracing"
 )
 
 type DataLoader struct {
 	DB *gorm.DB
+	// Progress, if set, is called after each film is imported with the
+	// number done so far and the total.
+	Progress func(done, total int)
 }
 
 var ErrDataLoaded = errors.New("DATABASE LOADED")
@@ -28,9 +36,15 @@ type FilmData struct {
 	ID          uint     `json:"id"`
 }
 
-func (dl *DataLoader) LoadFilmsFromFile(filePath string) error {
+// LoadFilmsFromFile imports the catalogue from filePath in a single
+// transaction, so an import cancelled through ctx, for example by a shutdown,
+// leaves the database as it was.
+func (dl *DataLoader) LoadFilmsFromFile(ctx context.Context, filePath string) error {
+	ctx, span := tracer.Start(ctx, "dataloader.LoadFilmsFromFile")
+	defer span.End()
+
 	var filmCount int64;
-	dl.DB.Model(&models.Film{}).Count(&filmCount)
+	dl.DB.WithContext(ctx).Model(&models.Film{}).Count(&filmCount)
 	if filmCount == 9999{
 		return ErrDataLoaded
 	}
@@ -77,11 +91,24 @@ func (dl *DataLoader) LoadFilmsFromFile(filePath string) error {
 		return errors.New("no stars found")
 	}
 
+	return dl.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return dl.load(tx, filmsData, genresSet, directorsSet, starsSet)
+	})
+}
+
+// filmBatchSize is the number of films imported under one trace span.
+const filmBatchSize = 500
+
+var tracer = tracing.Tracer("movies4u.net/internals/dataloader")
+
+func (dl *DataLoader) load(tx *gorm.DB, filmsData []FilmData, genresSet, directorsSet, starsSet map[string]struct{}) error {
 	var genres []models.Genre
 	for genre := range genresSet {
 		genres = append(genres, models.Genre{Name: genre})
 	}
-	err = dl.DB.Create(&genres).Error
+	err := batch(tx, "dataloader.genres", len(genres), func(tx *gorm.DB) error {
+		return tx.Create(&genres).Error
+	})
 	if err != nil {
 		return err
 	}
@@ -90,7 +117,9 @@ func (dl *DataLoader) LoadFilmsFromFile(filePath string) error {
 	for director := range directorsSet {
 		directors = append(directors, models.Director{Name: director})
 	}
-	err = dl.DB.Create(&directors).Error
+	err = batch(tx, "dataloader.directors", len(directors), func(tx *gorm.DB) error {
+		return tx.Create(&directors).Error
+	})
 	if err != nil {
 		return err
 	}
@@ -99,57 +128,89 @@ func (dl *DataLoader) LoadFilmsFromFile(filePath string) error {
 	for star := range starsSet {
 		stars = append(stars, models.Star{Name: star})
 	}
-	err = dl.DB.Create(&stars).Error
+	err = batch(tx, "dataloader.stars", len(stars), func(tx *gorm.DB) error {
+		return tx.Create(&stars).Error
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, filmData := range filmsData {
-	
-		var filmGenres []models.Genre
-		for _, genreName := range filmData.Genres {
-			var genre models.Genre
-			err = dl.DB.Where("name = ?", genreName).First(&genre).Error
-			if err != nil {
-				return err
+	for start := 0; start < len(filmsData); start += filmBatchSize {
+		end := min(start+filmBatchSize, len(filmsData))
+		err = batch(tx, "dataloader.films", end-start, func(tx *gorm.DB) error {
+			for i := start; i < end; i++ {
+				err := loadFilm(tx, filmsData[i])
+				if err != nil {
+					return err
+				}
+
+				if dl.Progress != nil {
+					dl.Progress(i+1, len(filmsData))
+				}
 			}
-			filmGenres = append(filmGenres, genre)
-		}
-
-		var director models.Director
-		err = dl.DB.Where("name = ?", filmData.Director).First(&director).Error
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		var filmStars []models.Star
-		for _, starName := range filmData.Stars {
-			var star models.Star
-			err = dl.DB.Where("name = ?", starName).First(&star).Error
-			if err != nil {
-				return err
-			}
-			filmStars = append(filmStars, star)
-		}
+	return nil
+}
+
+// batch runs fn in its own span, with tx bound to the span so the queries fn
+// makes are recorded beneath it.
+func batch(tx *gorm.DB, name string, size int, fn func(tx *gorm.DB) error) error {
+	ctx, span := tracer.Start(tx.Statement.Context, name, trace.WithAttributes(attribute.Int("dataloader.batch_size", size)))
+	defer span.End()
 
-		film := models.Film{
-			ID:          filmData.ID,
-			Name:        filmData.Name,
-			Year:        filmData.Year,
-			RunTime:     filmData.RunTime,
-			Rating:      filmData.Rating,
-			Genres:      filmGenres,
-			Directors:   []models.Director{director},
-			Stars:       filmStars,
-			Description: filmData.Description,
-			Image:       filmData.Image,
+	err := fn(tx.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func loadFilm(tx *gorm.DB, filmData FilmData) error {
+	var filmGenres []models.Genre
+	for _, genreName := range filmData.Genres {
+		var genre models.Genre
+		err := tx.Where("name = ?", genreName).First(&genre).Error
+		if err != nil {
+			return err
 		}
+		filmGenres = append(filmGenres, genre)
+	}
 
-		err = dl.DB.Create(&film).Error
+	var director models.Director
+	err := tx.Where("name = ?", filmData.Director).First(&director).Error
+	if err != nil {
+		return err
+	}
+
+	var filmStars []models.Star
+	for _, starName := range filmData.Stars {
+		var star models.Star
+		err = tx.Where("name = ?", starName).First(&star).Error
 		if err != nil {
 			return err
 		}
+		filmStars = append(filmStars, star)
 	}
 
-	return nil
+	film := models.Film{
+		ID:          filmData.ID,
+		Name:        filmData.Name,
+		Year:        filmData.Year,
+		RunTime:     filmData.RunTime,
+		Rating:      filmData.Rating,
+		Genres:      filmGenres,
+		Directors:   []models.Director{director},
+		Stars:       filmStars,
+		Description: filmData.Description,
+		Image:       filmData.Image,
+	}
+
+	return tx.Create(&film).Error
 }
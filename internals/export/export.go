@@ -0,0 +1,293 @@
+package export
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"movies4u.net/internals/models"
+)
+
+// Exporter builds personal data archives in Dir and keeps them for TTL. It
+// reads what goes into them, and tracks the export jobs, through the stores.
+type Exporter struct {
+	Users    models.UserStore
+	Lists    models.ListStore
+	Sessions models.SessionStore
+	Tokens   models.TokenStore
+	Exports  models.ExportStore
+	Dir      string
+	TTL      time.Duration
+}
+
+// staleAfter is how long a job may sit in the running state before it is
+// assumed its worker died and the job is picked up again.
+const staleAfter = 30 * time.Minute
+
+// Path returns where the archive for export id is stored.
+func (e *Exporter) Path(id uint) string {
+	return filepath.Join(e.Dir, strconv.FormatUint(uint64(id), 10)+".zip")
+}
+
+// Pending returns the IDs of exports waiting for a worker, including ones
+// whose worker appears to have died.
+func (e *Exporter) Pending() ([]uint, error) {
+	return e.Exports.Pending(context.Background(), time.Now().Add(-staleAfter))
+}
+
+// Process builds the archive for export id. It reports false without doing
+// anything if another worker has already claimed the job.
+func (e *Exporter) Process(id uint) (bool, error) {
+	ctx := context.Background()
+
+	claimed, err := e.Exports.Claim(ctx, int(id), time.Now().Add(-staleAfter))
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	job, err := e.Exports.Get(ctx, int(id))
+	if err != nil {
+		return true, err
+	}
+
+	err = e.build(&job)
+	if err != nil {
+		os.Remove(e.Path(id))
+		failErr := e.Exports.Fail(ctx, int(id), time.Now().Add(e.TTL))
+		return true, errors.Join(err, failErr)
+	}
+
+	return true, e.Exports.Complete(ctx, int(id), time.Now().Add(e.TTL))
+}
+
+// Purge deletes expired exports and their archives.
+func (e *Exporter) Purge() error {
+	ids, err := e.Exports.Expired(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err = e.remove(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveUser deletes every export belonging to userID.
+func (e *Exporter) RemoveUser(userID uint) error {
+	jobs, err := e.Exports.ForUser(context.Background(), int(userID))
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		err = e.remove(job.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Exporter) remove(id uint) error {
+	err := os.Remove(e.Path(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return e.Exports.Delete(context.Background(), int(id))
+}
+
+// build writes the archive to a temporary file first so a download never
+// sees a half-written zip.
+func (e *Exporter) build(job *models.DataExport) error {
+	err := os.MkdirAll(e.Dir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(e.Dir, "export-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = e.Write(job.UserID, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), e.Path(job.ID))
+}
+
+type profile struct {
+	ID          uint      `json:"id"`
+	UserName    string    `json:"username"`
+	Email       string    `json:"email"`
+	Created     time.Time `json:"created"`
+	TOTPEnabled bool      `json:"two_factor_enabled"`
+}
+
+type listEntry struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	Year int    `json:"year"`
+}
+
+type session struct {
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Write streams a zip of everything stored about userID to w. Sessions and
+// tokens are listed oldest first.
+func (e *Exporter) Write(userID uint, w io.Writer) error {
+	ctx := context.Background()
+
+	user, err := e.Users.Get(ctx, int(userID))
+	if err != nil {
+		return err
+	}
+
+	watchlist, err := e.Lists.Films(ctx, int(userID), models.ListWatchlist)
+	if err != nil {
+		return err
+	}
+	watchedlist, err := e.Lists.Films(ctx, int(userID), models.ListWatchedlist)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := e.Sessions.ForUser(ctx, int(userID))
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(sessions, func(a, b models.UserSession) int {
+		return cmp.Or(a.Created.Compare(b.Created), cmp.Compare(a.ID, b.ID))
+	})
+
+	tokens, err := e.Tokens.ForUser(ctx, int(userID))
+	if err != nil {
+		return err
+	}
+	slices.Reverse(tokens)
+
+	zw := zip.NewWriter(w)
+
+	err = writeJSON(zw, "profile.json", profile{
+		ID:          user.ID,
+		UserName:    user.UserName,
+		Email:       user.Email,
+		Created:     user.Created,
+		TOTPEnabled: user.TOTPEnabled,
+	})
+	if err != nil {
+		return err
+	}
+
+	lists := []struct {
+		name  string
+		films []models.Film
+	}{
+		{"watchlist", watchlist},
+		{"watchedlist", watchedlist},
+	}
+
+	for _, list := range lists {
+		name := list.name
+		entries := make([]listEntry, len(list.films))
+		rows := make([][]string, len(list.films))
+		for i, film := range list.films {
+			entries[i] = listEntry{ID: film.ID, Name: film.Name, Year: film.Year}
+			rows[i] = []string{strconv.FormatUint(uint64(film.ID), 10), film.Name, strconv.Itoa(film.Year)}
+		}
+
+		err = writeJSON(zw, name+".json", entries)
+		if err != nil {
+			return err
+		}
+		err = writeCSV(zw, name+".csv", []string{"id", "name", "year"}, rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries := make([]session, len(sessions))
+	rows := make([][]string, len(sessions))
+	for i, s := range sessions {
+		entries[i] = session{IP: s.IP, UserAgent: s.UserAgent, Created: s.Created, LastSeen: s.LastSeen, ExpiresAt: s.ExpiresAt}
+		rows[i] = []string{s.IP, s.UserAgent, s.Created.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339), s.ExpiresAt.Format(time.RFC3339)}
+	}
+
+	err = writeJSON(zw, "sessions.json", entries)
+	if err != nil {
+		return err
+	}
+	err = writeCSV(zw, "sessions.csv", []string{"ip", "user_agent", "created", "last_seen", "expires_at"}, rows)
+	if err != nil {
+		return err
+	}
+
+	err = writeJSON(zw, "api_tokens.json", tokens)
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func writeJSON(zw *zip.Writer, name string, v any) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(v)
+	if err != nil {
+		return fmt.Errorf("export: writing %s: %w", name, err)
+	}
+	return nil
+}
+
+func writeCSV(zw *zip.Writer, name string, header []string, rows [][]string) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(f)
+	err = cw.Write(header)
+	if err != nil {
+		return err
+	}
+	err = cw.WriteAll(rows)
+	if err != nil {
+		return fmt.Errorf("export: writing %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"movies4u.net/internals/models"
+)
+
+// newTestExporter returns an Exporter over a MemoryStore holding alice,
+// with a film on each of her lists, a session and an API token, and bob,
+// whose data must never end up in her archive.
+func newTestExporter(t *testing.T) (*Exporter, models.User) {
+	t.Helper()
+
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	store.AddFilm(models.Film{ID: 1, Name: "The Matrix", Year: 1999, RunTime: 136, Rating: 8.7})
+	store.AddFilm(models.Film{ID: 2, Name: "Heat, the director's cut", Year: 1995, RunTime: 170, Rating: 8.3})
+
+	alice := models.User{UserName: "alice", Email: "alice@example.com", Password: "hash", TOTPEnabled: true}
+	bob := models.User{UserName: "bob", Email: "bob@example.com", Password: "hash"}
+	for _, user := range []*models.User{&alice, &bob} {
+		err := store.Users().Insert(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	for _, session := range []models.UserSession{
+		{UserID: alice.ID, Token: "alice-session", IP: "192.0.2.1", UserAgent: "Firefox", LastSeen: now, ExpiresAt: now.Add(time.Hour)},
+		{UserID: bob.ID, Token: "bob-session", IP: "198.51.100.1", UserAgent: "Chrome", LastSeen: now, ExpiresAt: now.Add(time.Hour)},
+	} {
+		err := store.Sessions().Insert(ctx, &session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, token := range []models.APIToken{
+		{UserID: alice.ID, Name: "laptop", TokenHash: "alice-hash", Scope: "read"},
+		{UserID: bob.ID, Name: "phone", TokenHash: "bob-hash", Scope: "read"},
+	} {
+		err := store.Tokens().Insert(ctx, &token)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, entry := range []struct {
+		user   models.User
+		filmID int
+		list   string
+	}{
+		{alice, 1, models.ListWatchlist},
+		{alice, 2, models.ListWatchedlist},
+		{bob, 2, models.ListWatchlist},
+	} {
+		err := store.Lists().Add(ctx, int(entry.user.ID), entry.filmID, entry.list)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := &Exporter{
+		Users:    store.Users(),
+		Lists:    store.Lists(),
+		Sessions: store.Sessions(),
+		Tokens:   store.Tokens(),
+		Exports:  store.Exports(),
+		Dir:      filepath.Join(t.TempDir(), "exports"),
+		TTL:      time.Hour,
+	}
+	return e, alice
+}
+
+// addTestExport stores job, failing the test if it can't.
+func addTestExport(t *testing.T, e *Exporter, job *models.DataExport) {
+	t.Helper()
+
+	err := e.Exports.Insert(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readZip returns the contents of each file in the archive at r.
+func readZip(t *testing.T, r io.ReaderAt, size int64) map[string]string {
+	t.Helper()
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+	}
+	return files
+}
+
+func TestWrite(t *testing.T) {
+	e, alice := newTestExporter(t)
+
+	var buf bytes.Buffer
+	err := e.Write(alice.ID, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readZip(t, bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	want := []string{"api_tokens.json", "profile.json", "sessions.csv", "sessions.json", "watchedlist.csv", "watchedlist.json", "watchlist.csv", "watchlist.json"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("got files %v, want %v", names, want)
+	}
+
+	var p profile
+	err = json.Unmarshal([]byte(files["profile.json"]), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != alice.ID || p.UserName != "alice" || p.Email != "alice@example.com" || !p.TOTPEnabled {
+		t.Errorf("got profile %+v", p)
+	}
+
+	var watchlist []listEntry
+	err = json.Unmarshal([]byte(files["watchlist.json"]), &watchlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(watchlist, []listEntry{{ID: 1, Name: "The Matrix", Year: 1999}}) {
+		t.Errorf("got watchlist %v", watchlist)
+	}
+
+	// Names with commas and quotes survive the CSV round trip.
+	rows, err := csv.NewReader(strings.NewReader(files["watchedlist.csv"])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRows := [][]string{{"id", "name", "year"}, {"2", "Heat, the director's cut", "1995"}}
+	if !slices.EqualFunc(rows, wantRows, slices.Equal) {
+		t.Errorf("got watched list CSV %q", rows)
+	}
+
+	rows, err = csv.NewReader(strings.NewReader(files["sessions.csv"])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1][0] != "192.0.2.1" || rows[1][1] != "Firefox" {
+		t.Errorf("got sessions CSV %q", rows)
+	}
+
+	var tokens []map[string]any
+	err = json.Unmarshal([]byte(files["api_tokens.json"]), &tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0]["name"] != "laptop" {
+		t.Errorf("got tokens %v", tokens)
+	}
+
+	// Secrets and other users' data stay out.
+	for name, content := range files {
+		for _, leak := range []string{"hash", "alice-session", "bob", "198.51.100.1", "phone"} {
+			if strings.Contains(content, leak) {
+				t.Errorf("%s contains %q", name, leak)
+			}
+		}
+	}
+
+	err = e.Write(alice.ID+100, io.Discard)
+	if !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("exporting a missing user: got %v", err)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	e, alice := newTestExporter(t)
+
+	job := models.DataExport{UserID: alice.ID, Status: models.ExportPending}
+	addTestExport(t, e, &job)
+	pending, err := e.Pending()
+	if err != nil || !slices.Equal(pending, []uint{job.ID}) {
+		t.Fatalf("Pending: got %v, %v", pending, err)
+	}
+
+	claimed, err := e.Process(job.ID)
+	if err != nil || !claimed {
+		t.Fatalf("Process: got %t, %v", claimed, err)
+	}
+	job, err = e.Exports.Get(context.Background(), int(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != models.ExportReady || job.CompletedAt == nil || job.ExpiresAt == nil {
+		t.Errorf("got %+v", job)
+	}
+	f, err := os.Open(e.Path(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := readZip(t, f, info.Size()); !strings.Contains(files["profile.json"], "alice@example.com") {
+		t.Errorf("got profile %s", files["profile.json"])
+	}
+	// Only the archive is left in Dir, not the temporary file.
+	entries, err := os.ReadDir(e.Dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Dir holds %v, %v", entries, err)
+	}
+
+	// A finished job isn't claimed again.
+	claimed, err = e.Process(job.ID)
+	if err != nil || claimed {
+		t.Errorf("processing a finished job: got %t, %v", claimed, err)
+	}
+}
+
+func TestProcessClaim(t *testing.T) {
+	e, alice := newTestExporter(t)
+
+	recent := time.Now().Add(-time.Minute)
+	stale := time.Now().Add(-staleAfter - time.Minute)
+	running := models.DataExport{UserID: alice.ID, Status: models.ExportRunning, StartedAt: &recent}
+	abandoned := models.DataExport{UserID: alice.ID, Status: models.ExportRunning, StartedAt: &stale}
+	for _, job := range []*models.DataExport{&running, &abandoned} {
+		addTestExport(t, e, job)
+	}
+
+	// A job another worker is running is left alone, but one whose worker
+	// seems to have died is picked up again.
+	pending, err := e.Pending()
+	if err != nil || !slices.Equal(pending, []uint{abandoned.ID}) {
+		t.Fatalf("Pending: got %v, %v", pending, err)
+	}
+	claimed, err := e.Process(running.ID)
+	if err != nil || claimed {
+		t.Errorf("processing a running job: got %t, %v", claimed, err)
+	}
+	claimed, err = e.Process(abandoned.ID)
+	if err != nil || !claimed {
+		t.Errorf("processing an abandoned job: got %t, %v", claimed, err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	e, alice := newTestExporter(t)
+
+	var jobs [2]models.DataExport
+	for i := range jobs {
+		jobs[i] = models.DataExport{UserID: alice.ID, Status: models.ExportPending}
+		addTestExport(t, e, &jobs[i])
+		_, err := e.Process(jobs[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired, kept := jobs[0], jobs[1]
+	err := e.Exports.Complete(ctx, int(expired.ID), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		job  models.DataExport
+		want bool
+	}{
+		{expired, false},
+		{kept, true},
+	} {
+		_, err = e.Exports.Get(ctx, int(tt.job.ID))
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			t.Fatal(err)
+		}
+		_, statErr := os.Stat(e.Path(tt.job.ID))
+		if (err == nil) != tt.want || (statErr == nil) != tt.want {
+			t.Errorf("export %d: job kept %t, archive kept %t, want %t", tt.job.ID, err == nil, statErr == nil, tt.want)
+		}
+	}
+
+	// A missing archive doesn't stop the row going.
+	err = os.Remove(e.Path(kept.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.RemoveUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, err := e.Exports.ForUser(ctx, int(alice.ID))
+	if err != nil || len(left) != 0 {
+		t.Errorf("after RemoveUser got %v, %v", left, err)
+	}
+}
@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// record logs one message with args through a JSON logger and returns the
+// decoded record.
+func record(t *testing.T, logger func(*slog.Logger) *slog.Logger, ctx context.Context, args ...any) map[string]any {
+	t.Helper()
+
+	var buf bytes.Buffer
+	l := New(&buf, "json", slog.LevelInfo)
+	if logger != nil {
+		l = logger(l)
+	}
+	l.InfoContext(ctx, "message", args...)
+
+	var rec map[string]any
+	err := json.Unmarshal(buf.Bytes(), &rec)
+	if err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	return rec
+}
+
+func TestRedact(t *testing.T) {
+	for key := range sensitiveKeys {
+		rec := record(t, nil, context.Background(), key, "hunter2")
+		if rec[key] != redacted {
+			t.Errorf("%s: got %v", key, rec[key])
+		}
+	}
+
+	// Keys match whatever their case, inside groups and in attributes added
+	// with With, and whatever the type of value.
+	rec := record(t, func(l *slog.Logger) *slog.Logger { return l.With("Token", "m4u_abc") }, context.Background(),
+		slog.Group("form", "password", "hunter2", "username", "alice"),
+		"Authorization", "Bearer m4u_abc",
+		"code", 123456,
+	)
+	if rec["Token"] != redacted || rec["Authorization"] != redacted || rec["code"] != redacted {
+		t.Errorf("got %v", rec)
+	}
+	form, _ := rec["form"].(map[string]any)
+	if form["password"] != redacted || form["username"] != "alice" {
+		t.Errorf("got form %v", form)
+	}
+
+	rec = record(t, nil, context.Background(), "email", "alice@example.com", "user_id", 7)
+	if rec["email"] != "a***@example.com" || rec["user_id"] != float64(7) {
+		t.Errorf("got %v", rec)
+	}
+}
+
+func TestRedactText(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, "text", slog.LevelInfo).Info("signed in", "email", "alice@example.com", "password", "hunter2")
+
+	line := buf.String()
+	if strings.Contains(line, "hunter2") || strings.Contains(line, "alice@") {
+		t.Errorf("text output leaks: %s", line)
+	}
+	if !strings.Contains(line, "email=a***@example.com") || !strings.Contains(line, "password="+redacted) {
+		t.Errorf("got %s", line)
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	tests := []struct {
+		email, want string
+	}{
+		{"alice@example.com", "a***@example.com"},
+		{"a@example.com", "a***@example.com"},
+		{"first.last+films@mail.example.com", "f***@mail.example.com"},
+		{"odd@name@example.com", "o***@example.com"},
+		{"@example.com", redacted},
+		{"alice", redacted},
+		{"", redacted},
+	}
+	for _, tt := range tests {
+		if got := MaskEmail(tt.email); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	rec := record(t, nil, context.Background())
+	if _, ok := rec["request_id"]; ok {
+		t.Errorf("no request ID expected, got %v", rec)
+	}
+
+	traceID := trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	ctx := WithRequestID(context.Background(), "req-1")
+	ctx = trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  trace.SpanID{1},
+	}))
+
+	// Loggers derived with With still carry the IDs.
+	rec = record(t, func(l *slog.Logger) *slog.Logger { return l.With("route", "GET /") }, ctx)
+	if rec["request_id"] != "req-1" || rec["trace_id"] != traceID.String() || rec["route"] != "GET /" {
+		t.Errorf("got %v", rec)
+	}
+	if RequestID(ctx) != "req-1" || RequestID(context.Background()) != "" {
+		t.Error("RequestID doesn't return what WithRequestID stored")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+		"loud":  slog.LevelInfo,
+		"":      slog.LevelInfo,
+	}
+	for name, want := range tests {
+		if got := ParseLevel(name); got != want {
+			t.Errorf("%q: got %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Package metrics collects the application's Prometheus metrics: HTTP
+// traffic per route, database pool and query timings, cache hit rates,
+// catalogue import progress and business counters.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "movies4u"
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	queries  *prometheus.HistogramVec
+	cache    *prometheus.CounterVec
+
+	catalogueDone  prometheus.Gauge
+	catalogueTotal prometheus.Gauge
+
+	// Signups counts accounts created through the sign-up form.
+	Signups prometheus.Counter
+	// ListAdds counts films added to a user's watchlist or watched list,
+	// labelled by list (models.ListWatchlist or models.ListWatchedlist).
+	ListAdds *prometheus.CounterVec
+	// RateLimited counts requests turned away by a rate limit, labelled by
+	// route pattern.
+	RateLimited *prometheus.CounterVec
+}
+
+// New returns Metrics registered on a fresh registry together with the Go
+// runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served, by route pattern, method and status code.",
+		}, []string{"route", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by route pattern and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		queries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Time taken by database statements, by operation and table.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"operation", "table"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_lookups_total",
+			Help:      "Cache lookups, by kind of entry and result (hit or miss).",
+		}, []string{"kind", "result"}),
+		catalogueDone: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "catalogue_films_loaded",
+			Help:      "Films imported so far by the catalogue loader.",
+		}),
+		catalogueTotal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "catalogue_films_total",
+			Help:      "Films in the catalogue file being imported.",
+		}),
+		Signups: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signups_total",
+			Help:      "Accounts created.",
+		}),
+		ListAdds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "list_adds_total",
+			Help:      "Films added to a user's list, by list.",
+		}, []string{"list"}),
+		RateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_requests_total",
+			Help:      "Requests rejected by a rate limit, by route pattern.",
+		}, []string{"route"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.duration,
+		m.queries,
+		m.cache,
+		m.catalogueDone,
+		m.catalogueTotal,
+		m.Signups,
+		m.ListAdds,
+		m.RateLimited,
+	)
+	return m
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a served request. route is the pattern it matched.
+// Non-standard methods are counted together so clients can't create
+// unbounded label values.
+func (m *Metrics) ObserveRequest(route, method string, status int, d time.Duration) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+	default:
+		method = "OTHER"
+	}
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	m.duration.WithLabelValues(route, method).Observe(d.Seconds())
+}
+
+// ObserveQuery records the duration of a database statement.
+func (m *Metrics) ObserveQuery(operation, table string, d time.Duration) {
+	m.queries.WithLabelValues(operation, table).Observe(d.Seconds())
+}
+
+// ObserveCache records a cache lookup. kind is the kind of entry, such as
+// "film", "search" or "auth".
+func (m *Metrics) ObserveCache(kind string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cache.WithLabelValues(kind, result).Inc()
+}
+
+// CatalogueProgress records how far the catalogue import has got.
+func (m *Metrics) CatalogueProgress(done, total int) {
+	m.catalogueDone.Set(float64(done))
+	m.catalogueTotal.Set(float64(total))
+}
+
+// RegisterDB exports the connection pool statistics of db.
+func (m *Metrics) RegisterDB(db *sql.DB, name string) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterGauge exports a gauge whose value is read from fn at scrape time.
+func (m *Metrics) RegisterGauge(name, help string, fn func() float64) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
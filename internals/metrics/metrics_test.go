@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// scrape returns the metrics m serves.
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestObserveRequest(t *testing.T) {
+	m := New()
+
+	// ObserveRequest is handed the pattern the router matched, as
+	// tagRoute does in the web server.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /films/{id}", func(w http.ResponseWriter, r *http.Request) {
+		m.ObserveRequest(r.Pattern, r.Method, http.StatusOK, time.Millisecond)
+	})
+	for _, path := range []string{"/films/1", "/films/2"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	m.ObserveRequest("GET /films/{id}", "BREW", http.StatusMethodNotAllowed, time.Millisecond)
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`movies4u_http_requests_total{method="GET",route="GET /films/{id}",status="200"} 2`,
+		`movies4u_http_request_duration_seconds_count{method="GET",route="GET /films/{id}"} 2`,
+		// Non-standard methods share one label value.
+		`movies4u_http_requests_total{method="OTHER",route="GET /films/{id}",status="405"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+	if strings.Contains(body, "/films/1") {
+		t.Error("metrics are labelled with the raw path")
+	}
+}
+
+func TestObserveCache(t *testing.T) {
+	m := New()
+	m.ObserveCache("film", true)
+	m.ObserveCache("film", false)
+	m.ObserveCache("film", false)
+	m.RegisterGauge("cache_entries", "Entries held by the film cache.", func() float64 { return 3 })
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`movies4u_cache_lookups_total{kind="film",result="hit"} 1`,
+		`movies4u_cache_lookups_total{kind="film",result="miss"} 2`,
+		`movies4u_cache_entries 3`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
+
+func TestGormPlugin(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	m := New()
+	err = db.Use(GormPlugin{Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type Film struct {
+		ID   uint
+		Name string
+	}
+	err = db.AutoMigrate(&Film{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Create(&Film{Name: "Heat"}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var films []Film
+	err = db.Find(&films).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`movies4u_db_query_duration_seconds_count{operation="create",table="films"} 1`,
+		`movies4u_db_query_duration_seconds_count{operation="query",table="films"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
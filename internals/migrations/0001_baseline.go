@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+	"movies4u.net/internals/migrations/baseline"
+)
+
+// The baseline creates the schema that AutoMigrate used to maintain. On
+// databases AutoMigrate already set up it only fills in what's missing, such
+// as the session store's table.
+func init() {
+	register(Migration{
+		Version: 1,
+		Name:    "baseline",
+		Up: func(tx *gorm.DB) error {
+			err := tx.AutoMigrate(baseline.Models()...)
+			if err != nil {
+				return err
+			}
+
+			// The email column has always been case-insensitive on MySQL.
+			// Other databases rely on emails being stored lowercased.
+			if tx.Dialector.Name() == "mysql" {
+				return tx.Exec("ALTER TABLE users MODIFY email varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL").Error
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			tables := []any{"user_watchlist", "user_watchedlist", "film_genres", "film_directors", "film_stars"}
+			models := baseline.Models()
+			for i := len(models) - 1; i >= 0; i-- {
+				tables = append(tables, models[i])
+			}
+			return tx.Migrator().DropTable(tables...)
+		},
+	})
+}
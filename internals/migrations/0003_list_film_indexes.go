@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// listTables are the join tables behind the watchlist and watched list.
+var listTables = []string{"user_watchlist", "user_watchedlist"}
+
+// Film listings count list entries by film, which the (user_id, film_id)
+// primary key can't serve. MySQL already indexes film_id for its foreign
+// key; the other databases need one.
+func init() {
+	register(Migration{
+		Version: 3,
+		Name:    "list_film_indexes",
+		Up: func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == "mysql" {
+				return nil
+			}
+			for _, table := range listTables {
+				err := tx.Exec("CREATE INDEX idx_" + table + "_film_id ON " + table + " (film_id)").Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == "mysql" {
+				return nil
+			}
+			for _, table := range listTables {
+				err := tx.Exec("DROP INDEX idx_" + table + "_film_id").Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
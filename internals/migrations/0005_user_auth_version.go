@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// userAuthVersion declares the column on its own, so the migration doesn't
+// change with models.User.
+type userAuthVersion struct {
+	AuthVersion int64 `gorm:"not null;default:0"`
+}
+
+func (userAuthVersion) TableName() string {
+	return "users"
+}
+
+// Sessions remember the AuthVersion of the user they signed in, and end when
+// it moves on. Sessions from before the column existed carry no version,
+// which reads as 0, so they stay signed in.
+func init() {
+	register(Migration{
+		Version: 5,
+		Name:    "user_auth_version",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&userAuthVersion{}, "AuthVersion")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&userAuthVersion{}, "AuthVersion")
+		},
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// rateLimit is the table as this migration creates it.
+type rateLimit struct {
+	Bucket string `gorm:"primaryKey;size:255"`
+	FullAt int64  `gorm:"not null;index"`
+}
+
+func (rateLimit) TableName() string {
+	return "rate_limits"
+}
+
+// Rate limiting buckets, for instances that share them through the
+// database.
+func init() {
+	register(Migration{
+		Version: 6,
+		Name:    "rate_limits",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&rateLimit{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&rateLimit{})
+		},
+	})
+}
@@ -0,0 +1,70 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// legacyEmailIndexQueries find unique indexes on users.email alone other
+// than idx_users_email, by dialect. SQLite only lists indexes created on
+// their own, as those from a UNIQUE clause can't be dropped, but SQLite
+// databases never had the old schema anyway.
+var legacyEmailIndexQueries = map[string]string{
+	"mysql": `SELECT index_name FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'users' AND non_unique = 0
+		AND index_name NOT IN ('PRIMARY', 'idx_users_email')
+		GROUP BY index_name HAVING COUNT(*) = 1 AND MAX(column_name) = 'email'`,
+	"postgres": `SELECT indexname FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename = 'users' AND indexname <> 'idx_users_email'
+		AND indexdef LIKE 'CREATE UNIQUE INDEX % (email)'`,
+	"sqlite": `SELECT il.name FROM pragma_index_list('users') AS il
+		WHERE il."unique" = 1 AND il.origin = 'c' AND il.name <> 'idx_users_email'
+		AND (SELECT COUNT(*) FROM pragma_index_info(il.name)) = 1
+		AND (SELECT name FROM pragma_index_info(il.name)) = 'email'`,
+}
+
+// Databases AutoMigrate created before the baseline kept the unique index of
+// the old `unique` tag next to idx_users_email. A duplicate email could then
+// be reported under the old name, which TranslateError doesn't recognise, so
+// the extra index goes.
+func init() {
+	register(Migration{
+		Version: 7,
+		Name:    "drop_legacy_email_index",
+		Up: func(tx *gorm.DB) error {
+			query, ok := legacyEmailIndexQueries[tx.Dialector.Name()]
+			if !ok {
+				return nil
+			}
+			var names []string
+			err := tx.Raw(query).Scan(&names).Error
+			if err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				index := clause.Column{Name: name}
+				switch tx.Dialector.Name() {
+				case "mysql":
+					err = tx.Exec("DROP INDEX ? ON users", index).Error
+				case "postgres":
+					// Indexes behind a constraint go with the constraint.
+					err = tx.Exec("ALTER TABLE users DROP CONSTRAINT IF EXISTS ?", index).Error
+					if err == nil {
+						err = tx.Exec("DROP INDEX IF EXISTS ?", index).Error
+					}
+				default:
+					err = tx.Exec("DROP INDEX ?", index).Error
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		// The index duplicated idx_users_email, so there's nothing to put back.
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	})
+}
@@ -0,0 +1,129 @@
+// Package baseline freezes the schema as it stood when versioned migrations
+// were introduced. Migration 1 creates these tables; later schema changes go
+// in new migrations, never here, so migration 1 always builds the same
+// schema whatever the current models look like.
+//
+// The types keep the names of their counterparts in models because gorm
+// derives table, join table and constraint names from them.
+package baseline
+
+import (
+	"time"
+)
+
+type User struct {
+	ID          uint      `gorm:"primaryKey;"`
+	UserName    string    `gorm:"size:255;not null;uniqueIndex:idx_users_user_name"`
+	Email       string    `gorm:"size:255;not null;uniqueIndex:idx_users_email"`
+	Password    string    `gorm:"size:255;not null"`
+	WatchList   []Film    `gorm:"many2many:user_watchlist"`
+	WatchedList []Film    `gorm:"many2many:user_watchedlist"`
+	Admin       bool      `gorm:"not null;default:false"`
+	TOTPSecret  string    `gorm:"column:totp_secret;size:64;not null;default:''"`
+	TOTPEnabled bool      `gorm:"column:totp_enabled;not null;default:false"`
+	TOTPStep    int64     `gorm:"column:totp_step;not null;default:0"`
+	Created     time.Time `gorm:"autoCreateTime"`
+}
+
+type Genre struct {
+	ID   uint   `gorm:"primaryKey;autoIncrement"`
+	Name string `gorm:"size:255;not null"`
+}
+
+type Star struct {
+	ID   uint   `gorm:"primaryKey;autoIncrement"`
+	Name string `gorm:"size:255;not null"`
+}
+
+type Director struct {
+	ID   uint   `gorm:"primaryKey"`
+	Name string `gorm:"size:255;not null"`
+}
+
+type Film struct {
+	ID          uint       `gorm:"primaryKey"`
+	Name        string     `gorm:"size:255;not null"`
+	Year        int        `gorm:"not null"`
+	RunTime     int        `gorm:"not null"`
+	Rating      float32    `gorm:"not null"`
+	Genres      []Genre    `gorm:"many2many:film_genres"`
+	Directors   []Director `gorm:"many2many:film_directors"`
+	Stars       []Star     `gorm:"many2many:film_stars"`
+	Description string     `gorm:"type:text"`
+	Image       string     `gorm:"size:255"`
+}
+
+type LoginAttempt struct {
+	ID          uint      `gorm:"primaryKey"`
+	Subject     string    `gorm:"size:255;not null;uniqueIndex"`
+	Failures    int       `gorm:"not null;default:0"`
+	LastFailure time.Time `gorm:"not null"`
+	LockedUntil time.Time `gorm:"not null"`
+}
+
+type RecoveryCode struct {
+	ID       uint   `gorm:"primaryKey"`
+	UserID   uint   `gorm:"not null;index"`
+	User     User   `gorm:"constraint:OnDelete:CASCADE"`
+	CodeHash string `gorm:"size:64;not null;uniqueIndex"`
+	UsedAt   *time.Time
+}
+
+type APIToken struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"not null;index"`
+	User       User   `gorm:"constraint:OnDelete:CASCADE"`
+	Name       string `gorm:"size:100;not null"`
+	TokenHash  string `gorm:"size:64;not null;uniqueIndex"`
+	Scope      string `gorm:"size:16;not null"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	Created    time.Time `gorm:"autoCreateTime"`
+}
+
+type UserSession struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE"`
+	Token     string    `gorm:"size:64;not null;uniqueIndex"`
+	IP        string    `gorm:"size:45;not null"`
+	UserAgent string    `gorm:"size:255;not null"`
+	Created   time.Time `gorm:"autoCreateTime"`
+	LastSeen  time.Time `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type EmailVerification struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE"`
+	Email     string    `gorm:"size:255;not null"`
+	TokenHash string    `gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+type DataExport struct {
+	ID          uint      `gorm:"primaryKey"`
+	UserID      uint      `gorm:"not null;index"`
+	User        User      `gorm:"constraint:OnDelete:CASCADE"`
+	Status      string    `gorm:"size:16;not null;index"`
+	Created     time.Time `gorm:"autoCreateTime"`
+	StartedAt   *time.Time
+	CompletedAt *time.Time
+	ExpiresAt   *time.Time
+}
+
+// Session is the table the scs session store keeps browser sessions in.
+type Session struct {
+	Token  string    `gorm:"primaryKey;type:char(43)"`
+	Data   []byte    `gorm:"not null"`
+	Expiry time.Time `gorm:"type:timestamp(6);not null;index:sessions_expiry_idx"`
+}
+
+// Models lists the baseline tables in creation order.
+func Models() []any {
+	return []any{
+		&User{}, &Genre{}, &Star{}, &Director{}, &Film{}, &LoginAttempt{}, &RecoveryCode{},
+		&APIToken{}, &UserSession{}, &EmailVerification{}, &DataExport{}, &Session{},
+	}
+}
@@ -0,0 +1,365 @@
+// Package migrations applies versioned schema changes. Migrations are either
+// Go functions registered by the files in this package or pairs of SQL files
+// in sql/ named <version>_<name>.up.sql and <version>_<name>.down.sql.
+// Applied versions are recorded in the schema_migrations table, and a
+// database lock keeps concurrent instances from migrating at the same time.
+package migrations
+
+import (
+	"cmp"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is a single, numbered schema change. Up and Down each run in a
+// transaction together with the schema_migrations update, although MySQL
+// commits DDL statements implicitly.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration.
+type SchemaMigration struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"size:255;not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// Status describes a known migration and when it was applied, if it was.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+var ErrUnknownVersion = errors.New("migrations: unknown version")
+
+// lockName identifies the migration lock; it is shared by every instance.
+const lockName = "movies4u_schema_migrations"
+
+//go:embed sql/*.sql
+var sqlFiles embed.FS
+
+// registry holds the Go migrations, added from init functions.
+var registry []Migration
+
+func register(m Migration) {
+	registry = append(registry, m)
+}
+
+type Migrator struct {
+	DB          *gorm.DB
+	Migrations  []Migration
+	LockTimeout time.Duration
+}
+
+// New returns a Migrator for db with every known migration, ordered by
+// version.
+func New(db *gorm.DB) (*Migrator, error) {
+	fromSQL, err := loadSQL(sqlFiles, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	all := append(slices.Clone(registry), fromSQL...)
+	slices.SortFunc(all, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	for i := 1; i < len(all); i++ {
+		if all[i].Version == all[i-1].Version {
+			return nil, fmt.Errorf("migrations: version %d is defined twice", all[i].Version)
+		}
+	}
+
+	return &Migrator{DB: db, Migrations: all, LockTimeout: time.Minute}, nil
+}
+
+var sqlName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// loadSQL reads the SQL migrations in dir. Every up file needs a matching
+// down file, which may be empty when there's nothing to undo.
+func loadSQL(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	var found []int64
+	for _, entry := range entries {
+		match := sqlName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrations: unexpected file %s", entry.Name())
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+
+		body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+			found = append(found, version)
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations: version %d has files named %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = execSQL(string(body))
+		} else {
+			m.Down = execSQL(string(body))
+		}
+	}
+
+	migrations := make([]Migration, 0, len(found))
+	for _, version := range found {
+		m := byVersion[version]
+		if m.Up == nil || m.Down == nil {
+			return nil, fmt.Errorf("migrations: version %d needs both an up and a down file", version)
+		}
+		migrations = append(migrations, *m)
+	}
+	return migrations, nil
+}
+
+// execSQL runs each statement of script in turn. Statements end with a
+// semicolon at the end of a line; lines starting with -- are comments.
+func execSQL(script string) func(tx *gorm.DB) error {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	script = strings.Join(lines, "\n") + "\n"
+
+	return func(tx *gorm.DB) error {
+		for _, stmt := range strings.Split(script, ";\n") {
+			stmt = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(stmt), ";"))
+			if stmt == "" {
+				continue
+			}
+			err := tx.Exec(stmt).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Latest returns the highest known version, or 0 if there are none.
+func (m *Migrator) Latest() int64 {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Status lists every known migration with the time it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, len(m.Migrations))
+	for i, migration := range m.Migrations {
+		statuses[i].Migration = migration
+		if record, ok := applied[migration.Version]; ok {
+			statuses[i].AppliedAt = &record.AppliedAt
+		}
+	}
+	return statuses, nil
+}
+
+// Up applies every pending migration and returns the ones it applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.To(ctx, m.Latest())
+}
+
+// Down rolls back the last steps applied migrations and returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int64
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	slices.Sort(versions)
+
+	target := int64(0)
+	if steps < len(versions) {
+		target = versions[len(versions)-steps-1]
+	}
+	return m.To(ctx, target)
+}
+
+// To migrates up or down until version is the latest applied migration and
+// returns the migrations it ran. Version 0 rolls back everything.
+func (m *Migrator) To(ctx context.Context, version int64) ([]Migration, error) {
+	if version != 0 && !slices.ContainsFunc(m.Migrations, func(mg Migration) bool { return mg.Version == version }) {
+		return nil, fmt.Errorf("%w %d", ErrUnknownVersion, version)
+	}
+
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Read the applied versions only once the lock is held, as another
+	// instance may have just migrated.
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for _, migration := range m.Migrations {
+		if _, ok := applied[migration.Version]; ok || migration.Version > version {
+			continue
+		}
+		err = m.apply(ctx, migration, true)
+		if err != nil {
+			return ran, err
+		}
+		ran = append(ran, migration)
+	}
+
+	for _, migration := range slices.Backward(m.Migrations) {
+		if _, ok := applied[migration.Version]; !ok || migration.Version <= version {
+			continue
+		}
+		err = m.apply(ctx, migration, false)
+		if err != nil {
+			return ran, err
+		}
+		ran = append(ran, migration)
+	}
+
+	return ran, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) error {
+	err := m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if !up {
+			err := migration.Down(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, migration.Version).Error
+		}
+
+		err := migration.Up(tx)
+		if err != nil {
+			return err
+		}
+		return tx.Create(&SchemaMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now().UTC(),
+		}).Error
+	})
+	if err != nil {
+		direction := "up"
+		if !up {
+			direction = "down"
+		}
+		return fmt.Errorf("migrations: %d_%s %s: %w", migration.Version, migration.Name, direction, err)
+	}
+	return nil
+}
+
+// applied returns the recorded migrations by version, creating the
+// schema_migrations table on first use.
+func (m *Migrator) applied(ctx context.Context) (map[int64]SchemaMigration, error) {
+	db := m.DB.WithContext(ctx)
+	err := db.AutoMigrate(&SchemaMigration{})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []SchemaMigration
+	err = db.Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]SchemaMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// lock takes a database-wide lock so only one process migrates at a time.
+// MySQL and PostgreSQL hold it on a dedicated connection; SQLite needs none
+// as it only allows one writer.
+func (m *Migrator) lock(ctx context.Context) (func(), error) {
+	sqlDB, err := m.DB.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.LockTimeout)
+	defer cancel()
+
+	switch m.DB.Dialector.Name() {
+	case "mysql":
+		conn, err := sqlDB.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var got *int
+		err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(m.LockTimeout.Seconds())).Scan(&got)
+		if err != nil || got == nil || *got != 1 {
+			conn.Close()
+			return nil, errors.Join(errors.New("migrations: timed out waiting for the migration lock"), err)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", lockName)
+			conn.Close()
+		}, nil
+	case "postgres":
+		h := fnv.New64a()
+		h.Write([]byte(lockName))
+		key := int64(h.Sum64())
+
+		conn, err := sqlDB.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("migrations: taking the migration lock: %w", err)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+			conn.Close()
+		}, nil
+	default:
+		return func() {}, nil
+	}
+}
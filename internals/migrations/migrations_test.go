@@ -0,0 +1,303 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"movies4u.net/internals/config"
+	"movies4u.net/internals/database"
+	"movies4u.net/internals/models"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	cfg := config.DB{Driver: config.DriverSQLite, Path: filepath.Join(t.TempDir(), "test.db")}
+	db, err := database.Open(cfg, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// tableMigration creates and drops table.
+func tableMigration(version int64, table string) Migration {
+	return Migration{
+		Version: version,
+		Name:    "create_" + table,
+		Up:      execSQL("CREATE TABLE " + table + " (id INTEGER PRIMARY KEY);"),
+		Down:    execSQL("DROP TABLE " + table + ";"),
+	}
+}
+
+func versions(migrations []Migration) []int64 {
+	var vs []int64
+	for _, m := range migrations {
+		vs = append(vs, m.Version)
+	}
+	return vs
+}
+
+// check compares the versions a migration step ran and the tables it left
+// with the wanted ones.
+func check(t *testing.T, db *gorm.DB, ran []Migration, err error, wantRan []int64, wantTables ...string) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(ran); !slices.Equal(got, wantRan) {
+		t.Errorf("ran %v, want %v", got, wantRan)
+	}
+	for _, table := range []string{"a", "b", "c"} {
+		if got, want := db.Migrator().HasTable(table), slices.Contains(wantTables, table); got != want {
+			t.Errorf("table %s exists: %t, want %t", table, got, want)
+		}
+	}
+}
+
+func TestTo(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	m := &Migrator{
+		DB:          db,
+		Migrations:  []Migration{tableMigration(1, "a"), tableMigration(2, "b"), tableMigration(5, "c")},
+		LockTimeout: time.Second,
+	}
+
+	ran, err := m.To(ctx, 2)
+	check(t, db, ran, err, []int64{1, 2}, "a", "b")
+	ran, err = m.Up(ctx)
+	check(t, db, ran, err, []int64{5}, "a", "b", "c")
+	ran, err = m.Up(ctx)
+	check(t, db, ran, err, nil, "a", "b", "c")
+
+	// Down runs newest first.
+	ran, err = m.To(ctx, 1)
+	check(t, db, ran, err, []int64{5, 2}, "a")
+	ran, err = m.To(ctx, 5)
+	check(t, db, ran, err, []int64{2, 5}, "a", "b", "c")
+	ran, err = m.To(ctx, 0)
+	check(t, db, ran, err, []int64{5, 2, 1})
+
+	_, err = m.To(ctx, 3)
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("got %v, want ErrUnknownVersion", err)
+	}
+}
+
+func TestDown(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	m := &Migrator{
+		DB:          db,
+		Migrations:  []Migration{tableMigration(1, "a"), tableMigration(2, "b"), tableMigration(3, "c")},
+		LockTimeout: time.Second,
+	}
+
+	ran, err := m.Up(ctx)
+	check(t, db, ran, err, []int64{1, 2, 3}, "a", "b", "c")
+	ran, err = m.Down(ctx, 1)
+	check(t, db, ran, err, []int64{3}, "a", "b")
+	ran, err = m.Down(ctx, 5)
+	check(t, db, ran, err, []int64{2, 1})
+	ran, err = m.Down(ctx, 1)
+	check(t, db, ran, err, nil)
+}
+
+func TestFailedMigration(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	broken := tableMigration(2, "b")
+	broken.Up = execSQL("CREATE TABLE b (id INTEGER PRIMARY KEY);\nCREATE TABLE nope (;")
+	m := &Migrator{
+		DB:          db,
+		Migrations:  []Migration{tableMigration(1, "a"), broken, tableMigration(3, "c")},
+		LockTimeout: time.Second,
+	}
+
+	// The failed migration is rolled back as a whole and stops the run.
+	ran, err := m.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "2_create_b up") {
+		t.Errorf("got %v", err)
+	}
+	check(t, db, ran, nil, []int64{1}, "a")
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if applied := s.AppliedAt != nil; applied != (s.Version == 1) {
+			t.Errorf("version %d applied: %t", s.Version, applied)
+		}
+	}
+}
+
+func TestLoadSQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string // error, or the versions and names loaded
+	}{
+		{name: "pairs", files: []string{"0010_b.down.sql", "0002_a.up.sql", "0002_a.down.sql", "0010_b.up.sql"}, want: "2_a 10_b"},
+		{name: "missing down", files: []string{"0002_a.up.sql"}, want: "version 2 needs both an up and a down file"},
+		{name: "missing up", files: []string{"0002_a.down.sql"}, want: "version 2 needs both an up and a down file"},
+		{name: "names differ", files: []string{"0002_a.up.sql", "0002_b.down.sql"}, want: "version 2 has files named a and b"},
+		{name: "stray file", files: []string{"0002_a.up.sql", "0002_a.down.sql", "README.md"}, want: "unexpected file README.md"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, name := range tt.files {
+				fsys["sql/"+name] = &fstest.MapFile{}
+			}
+
+			migrations, err := loadSQL(fsys, "sql")
+			var got string
+			if err != nil {
+				got = err.Error()
+			} else {
+				var loaded []string
+				for _, m := range migrations {
+					loaded = append(loaded, fmt.Sprintf("%d_%s", m.Version, m.Name))
+				}
+				got = strings.Join(loaded, " ")
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecSQL(t *testing.T) {
+	db := openTestDB(t)
+	script := `-- A comment; with a semicolon.
+CREATE TABLE t (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL
+);
+  -- An indented comment.
+INSERT INTO t (name) VALUES ('a;b');
+INSERT INTO t (name)
+VALUES ('c');
+
+INSERT INTO t (name) VALUES ('d')`
+
+	err := execSQL(script)(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err = db.Raw("SELECT name FROM t ORDER BY id").Scan(&names).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"a;b", "c", "d"}) {
+		t.Errorf("got %v", names)
+	}
+
+	err = execSQL("")(db)
+	if err != nil {
+		t.Errorf("an empty script should do nothing, got %v", err)
+	}
+}
+
+func TestDuplicateVersions(t *testing.T) {
+	saved := registry
+	t.Cleanup(func() { registry = saved })
+
+	// Version 2 is already a SQL migration.
+	registry = slices.Clone(registry)
+	register(tableMigration(2, "a"))
+	_, err := New(openTestDB(t))
+	if err == nil || !strings.Contains(err.Error(), "version 2 is defined twice") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// TestMigrations applies and rolls back the real migrations, so every down
+// migration runs at least once.
+func TestMigrations(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []func() ([]Migration, error){
+		func() ([]Migration, error) { return m.Up(ctx) },
+		func() ([]Migration, error) { return m.To(ctx, 0) },
+		func() ([]Migration, error) { return m.Up(ctx) },
+	} {
+		ran, err := step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ran) != len(m.Migrations) {
+			t.Errorf("ran %v, want all %d", versions(ran), len(m.Migrations))
+		}
+	}
+}
+
+func TestLegacyEmailIndex(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.To(ctx, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// AutoMigrate named the old index after the column on MySQL.
+	err = db.Exec("CREATE UNIQUE INDEX email ON users (email)").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec("CREATE UNIQUE INDEX idx_users_email_name ON users (email, user_name)").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.To(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Migrator().HasIndex("users", "email") {
+		t.Error("the legacy index should be gone")
+	}
+	for _, index := range []string{"idx_users_email", "idx_users_email_name"} {
+		if !db.Migrator().HasIndex("users", index) {
+			t.Errorf("%s should be kept", index)
+		}
+	}
+
+	users := &models.GormUserStore{DB: db}
+	err = users.Insert(ctx, &models.User{UserName: "alice", Email: "alice@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Insert(ctx, &models.User{UserName: "alice2", Email: "Alice@example.com", Password: "hash"})
+	if !errors.Is(err, models.ErrDuplicateEmail) {
+		t.Errorf("got %v, want ErrDuplicateEmail", err)
+	}
+}
@@ -0,0 +1 @@
+-- The original spelling of the addresses isn't kept, so there's nothing to undo.
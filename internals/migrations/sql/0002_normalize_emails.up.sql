@@ -0,0 +1,3 @@
+-- Accounts created before emails were normalised on save may have mixed
+-- case or surrounding spaces, which stops them from logging in.
+UPDATE users SET email = LOWER(TRIM(email)) WHERE email <> LOWER(TRIM(email));
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"movies4u.net/internals/cache"
+)
+
+// filmGenerationKey holds the generation every cached film read is keyed
+// under. Invalidate replaces it, orphaning everything cached before, which
+// works the same whether the cache is in-process or shared by several
+// instances.
+const filmGenerationKey = "films:generation"
+
+// CachedFilmStore is a read-through cache in front of another FilmStore.
+// Films, ranges, searches and listings are cached; list counts change with
+// every list edit and always come from Store. A failing cache is treated as
+// a miss, so reads fall back to Store.
+type CachedFilmStore struct {
+	Store FilmStore
+	Cache cache.Cache
+	TTL   time.Duration
+	// Observe, if set, is called on every lookup with the kind of read
+	// ("film", "range", "search" or "list", or for a CachedCreditStore
+	// sharing it "genres", "genre", "people" or "person") and whether it was
+	// a hit.
+	Observe func(kind string, hit bool)
+}
+
+func (s *CachedFilmStore) Get(ctx context.Context, id int) (Film, error) {
+	return cached(ctx, s, "film", strconv.Itoa(id), func() (Film, error) {
+		return s.Store.Get(ctx, id)
+	})
+}
+
+func (s *CachedFilmStore) Range(ctx context.Context, start, end int) ([]Film, error) {
+	return cached(ctx, s, "range", strconv.Itoa(start)+"-"+strconv.Itoa(end), func() ([]Film, error) {
+		return s.Store.Range(ctx, start, end)
+	})
+}
+
+// Search results are shared by names differing only in case, as the
+// search ignores it.
+func (s *CachedFilmStore) Search(ctx context.Context, name string) ([]Film, error) {
+	return cached(ctx, s, "search", strings.ToLower(name), func() ([]Film, error) {
+		return s.Store.Search(ctx, name)
+	})
+}
+
+// filmPage is a cached List result.
+type filmPage struct {
+	Films []Film
+	Total int64
+}
+
+// List results are keyed by every field of the query, with the name
+// lowered as for Search.
+func (s *CachedFilmStore) List(ctx context.Context, q FilmQuery) ([]Film, int64, error) {
+	q.Name = strings.ToLower(q.Name)
+	id := fmt.Sprintf("%d:%d:%d:%d:%d:%s", q.GenreID, q.DirectorID, q.StarID, q.Offset, q.Limit, q.Name)
+	page, err := cached(ctx, s, "list", id, func() (filmPage, error) {
+		films, total, err := s.Store.List(ctx, q)
+		return filmPage{films, total}, err
+	})
+	return page.Films, page.Total, err
+}
+
+func (s *CachedFilmStore) WithCounts(ctx context.Context, userID int, films []Film) ([]FilmWithCounts, error) {
+	return s.Store.WithCounts(ctx, userID, films)
+}
+
+// Invalidate drops every cached read, including those of CachedCreditStores
+// sharing s. Call it after anything that changes films or their credits.
+func (s *CachedFilmStore) Invalidate(ctx context.Context) error {
+	generation, err := newGeneration()
+	if err != nil {
+		return err
+	}
+	return s.Cache.Set(ctx, filmGenerationKey, []byte(generation), 0)
+}
+
+// CachedCreditStore is a read-through cache in front of another CreditStore.
+// It keeps its entries in Films' cache and generation, so invalidating Films
+// drops them too.
+type CachedCreditStore struct {
+	Store CreditStore
+	Films *CachedFilmStore
+}
+
+func (s *CachedCreditStore) Genres(ctx context.Context) ([]Genre, error) {
+	return cached(ctx, s.Films, "genres", "all", func() ([]Genre, error) {
+		return s.Store.Genres(ctx)
+	})
+}
+
+func (s *CachedCreditStore) Genre(ctx context.Context, id int) (Genre, error) {
+	return cached(ctx, s.Films, "genre", strconv.Itoa(id), func() (Genre, error) {
+		return s.Store.Genre(ctx, id)
+	})
+}
+
+// personPage is a cached People result.
+type personPage struct {
+	People []Person
+	Total  int64
+}
+
+// People results are keyed by every argument, with the name lowered as the
+// search ignores case.
+func (s *CachedCreditStore) People(ctx context.Context, role, name string, offset, limit int) ([]Person, int64, error) {
+	name = strings.ToLower(name)
+	id := fmt.Sprintf("%s:%d:%d:%s", role, offset, limit, name)
+	page, err := cached(ctx, s.Films, "people", id, func() (personPage, error) {
+		people, total, err := s.Store.People(ctx, role, name, offset, limit)
+		return personPage{people, total}, err
+	})
+	return page.People, page.Total, err
+}
+
+func (s *CachedCreditStore) Person(ctx context.Context, role string, id int) (Person, error) {
+	return cached(ctx, s.Films, "person", role+":"+strconv.Itoa(id), func() (Person, error) {
+		return s.Store.Person(ctx, role, id)
+	})
+}
+
+// generation returns the current generation, starting a new one if there is
+// none, for example because the cache evicted it.
+func (s *CachedFilmStore) generation(ctx context.Context) (string, error) {
+	value, ok, err := s.Cache.Get(ctx, filmGenerationKey)
+	if err != nil || ok {
+		return string(value), err
+	}
+
+	generation, err := newGeneration()
+	if err != nil {
+		return "", err
+	}
+	return generation, s.Cache.Set(ctx, filmGenerationKey, []byte(generation), 0)
+}
+
+// cached returns the value stored for kind and id in the current
+// generation, or loads it with load and stores it. Errors from load are
+// returned and never cached.
+func cached[T any](ctx context.Context, s *CachedFilmStore, kind, id string, load func() (T, error)) (T, error) {
+	generation, err := s.generation(ctx)
+	if err != nil {
+		s.observe(kind, false)
+		return load()
+	}
+	key := fmt.Sprintf("films:%s:%s:%s", generation, kind, id)
+
+	value, ok, err := s.Cache.Get(ctx, key)
+	if err == nil && ok {
+		var v T
+		if json.Unmarshal(value, &v) == nil {
+			s.observe(kind, true)
+			return v, nil
+		}
+	}
+	s.observe(kind, false)
+
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+	value, err = json.Marshal(v)
+	if err == nil {
+		s.Cache.Set(ctx, key, value, s.TTL)
+	}
+	return v, nil
+}
+
+func (s *CachedFilmStore) observe(kind string, hit bool) {
+	if s.Observe != nil {
+		s.Observe(kind, hit)
+	}
+}
+
+func newGeneration() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
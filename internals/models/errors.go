@@ -2,8 +2,87 @@ package models
 
 import (
 	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
 )
 
 var ErrNoRecord = errors.New("models: no matching record found")
 var ErrDuplicateEmail = errors.New("models: duplicate email")
+var ErrDuplicateUsername = errors.New("models: duplicate username")
 var ErrInvalidCredentials = errors.New("models: invalid email or password")
+var ErrInvalidReference = errors.New("models: referenced record does not exist")
+
+// MySQL server error codes the model layer knows how to translate.
+const (
+	mysqlErrDuplicateEntry   = 1062
+	mysqlErrNoReferencedRow  = 1452
+	mysqlErrNoReferencedRow2 = 1216
+)
+
+// PostgreSQL SQLSTATE codes the model layer knows how to translate.
+const (
+	pgErrUniqueViolation     = "23505"
+	pgErrForeignKeyViolation = "23503"
+)
+
+// TranslateError maps gorm and database driver errors onto the sentinel
+// errors declared in this package so handlers never need to inspect driver
+// types. Errors it does not recognise are returned unchanged.
+func TranslateError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNoRecord
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case mysqlErrDuplicateEntry:
+			return translateDuplicate(mysqlErr.Message, err)
+		case mysqlErrNoReferencedRow, mysqlErrNoReferencedRow2:
+			return ErrInvalidReference
+		}
+		return err
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgErrUniqueViolation:
+			return translateDuplicate(pgErr.ConstraintName, err)
+		case pgErrForeignKeyViolation:
+			return ErrInvalidReference
+		}
+		return err
+	}
+
+	// The SQLite driver only reports constraint failures in its message,
+	// for example "UNIQUE constraint failed: users.email".
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "UNIQUE constraint failed"):
+		return translateDuplicate(msg, err)
+	case strings.Contains(msg, "FOREIGN KEY constraint failed"):
+		return ErrInvalidReference
+	}
+
+	return err
+}
+
+// translateDuplicate picks the sentinel for a unique constraint violation
+// from the index or column named in detail.
+func translateDuplicate(detail string, err error) error {
+	switch {
+	case strings.Contains(detail, "idx_users_email"), strings.Contains(detail, "users.email"):
+		return ErrDuplicateEmail
+	case strings.Contains(detail, "idx_users_user_name"), strings.Contains(detail, "users.user_name"):
+		return ErrDuplicateUsername
+	}
+	return err
+}
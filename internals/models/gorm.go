@@ -0,0 +1,592 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GormFilmStore is a FilmStore backed by any database gorm supports.
+type GormFilmStore struct {
+	DB *gorm.DB
+}
+
+func (s *GormFilmStore) withCredits(ctx context.Context) *gorm.DB {
+	return s.DB.WithContext(ctx).Preload("Genres").Preload("Directors").Preload("Stars")
+}
+
+func (s *GormFilmStore) Get(ctx context.Context, id int) (Film, error) {
+	var film Film
+	err := s.withCredits(ctx).First(&film, id).Error
+	return film, TranslateError(err)
+}
+
+func (s *GormFilmStore) Range(ctx context.Context, start, end int) ([]Film, error) {
+	var films []Film
+	err := s.withCredits(ctx).Where("id BETWEEN ? AND ?", start, end).Find(&films).Error
+	return films, TranslateError(err)
+}
+
+// Search returns the films whose name contains name, ignoring case. LIKE is
+// case-sensitive on PostgreSQL, so both sides are lowered.
+func (s *GormFilmStore) Search(ctx context.Context, name string) ([]Film, error) {
+	var films []Film
+	err := s.DB.WithContext(ctx).Where("LOWER(name) LIKE ?", "%"+strings.ToLower(name)+"%").Find(&films).Error
+	return films, TranslateError(err)
+}
+
+// List filters by credits through the join tables, so each filter is a
+// subquery rather than a join that would repeat films.
+func (s *GormFilmStore) List(ctx context.Context, q FilmQuery) ([]Film, int64, error) {
+	db := s.DB.WithContext(ctx).Model(&Film{})
+	if q.Name != "" {
+		db = db.Where("LOWER(name) LIKE ?", "%"+strings.ToLower(q.Name)+"%")
+	}
+	for _, credit := range []struct {
+		table, column string
+		id            int
+	}{
+		{"film_genres", "genre_id", q.GenreID},
+		{"film_directors", "director_id", q.DirectorID},
+		{"film_stars", "star_id", q.StarID},
+	} {
+		if credit.id != 0 {
+			db = db.Where("id IN (?)", s.DB.Table(credit.table).Select("film_id").Where(credit.column+" = ?", credit.id))
+		}
+	}
+	db = db.Session(&gorm.Session{})
+
+	var total int64
+	err := db.Count(&total).Error
+	if err != nil {
+		return nil, 0, TranslateError(err)
+	}
+
+	films := []Film{}
+	page := db.Preload("Genres").Preload("Directors").Preload("Stars").Order("id").Offset(q.Offset)
+	if q.Limit > 0 {
+		page = page.Limit(q.Limit)
+	}
+	err = page.Find(&films).Error
+	return films, total, TranslateError(err)
+}
+
+// WithCounts runs one aggregate query per list for all of films.
+func (s *GormFilmStore) WithCounts(ctx context.Context, userID int, films []Film) ([]FilmWithCounts, error) {
+	result := make([]FilmWithCounts, len(films))
+	ids := make([]uint, len(films))
+	for i, film := range films {
+		result[i].Film = film
+		ids[i] = film.ID
+	}
+	if len(films) == 0 {
+		return result, nil
+	}
+
+	watchlist, err := s.listCounts(ctx, userID, ids, ListWatchlist)
+	if err != nil {
+		return nil, err
+	}
+	watched, err := s.listCounts(ctx, userID, ids, ListWatchedlist)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range result {
+		id := result[i].ID
+		result[i].WatchlistCount = watchlist[id].Total
+		result[i].OnWatchlist = watchlist[id].Mine > 0
+		result[i].WatchedCount = watched[id].Total
+		result[i].Watched = watched[id].Mine > 0
+	}
+	return result, nil
+}
+
+// listCount is how many users have a film on a list, and whether one
+// particular user is among them.
+type listCount struct {
+	FilmID uint
+	Total  int64
+	Mine   int64
+}
+
+// listCounts returns the list counts for filmIDs, keyed by film ID. Films
+// nobody has on the list are missing from the map.
+func (s *GormFilmStore) listCounts(ctx context.Context, userID int, filmIDs []uint, list string) (map[uint]listCount, error) {
+	table, err := listTable(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []listCount
+	err = s.DB.WithContext(ctx).Table(table).
+		Select("film_id, COUNT(*) AS total, SUM(CASE WHEN user_id = ? THEN 1 ELSE 0 END) AS mine", userID).
+		Where("film_id IN ?", filmIDs).
+		Group("film_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, TranslateError(err)
+	}
+
+	counts := make(map[uint]listCount, len(rows))
+	for _, row := range rows {
+		counts[row.FilmID] = row
+	}
+	return counts, nil
+}
+
+// GormCreditStore is a CreditStore backed by any database gorm supports.
+type GormCreditStore struct {
+	DB *gorm.DB
+}
+
+// roleTables maps each role onto the table of people credited in it.
+var roleTables = map[string]string{
+	RoleDirector: "directors",
+	RoleStar:     "stars",
+}
+
+func roleTable(role string) (string, error) {
+	table, ok := roleTables[role]
+	if !ok {
+		return "", fmt.Errorf("models: unknown role %q", role)
+	}
+	return table, nil
+}
+
+func (s *GormCreditStore) Genres(ctx context.Context) ([]Genre, error) {
+	genres := []Genre{}
+	err := s.DB.WithContext(ctx).Order("name").Find(&genres).Error
+	return genres, TranslateError(err)
+}
+
+func (s *GormCreditStore) Genre(ctx context.Context, id int) (Genre, error) {
+	var genre Genre
+	err := s.DB.WithContext(ctx).Take(&genre, id).Error
+	return genre, TranslateError(err)
+}
+
+func (s *GormCreditStore) People(ctx context.Context, role, name string, offset, limit int) ([]Person, int64, error) {
+	table, err := roleTable(role)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	db := s.DB.WithContext(ctx).Table(table)
+	if name != "" {
+		db = db.Where("LOWER(name) LIKE ?", "%"+strings.ToLower(name)+"%")
+	}
+	db = db.Session(&gorm.Session{})
+
+	var total int64
+	err = db.Count(&total).Error
+	if err != nil {
+		return nil, 0, TranslateError(err)
+	}
+
+	people := []Person{}
+	page := db.Select("id, name").Order("id").Offset(offset)
+	if limit > 0 {
+		page = page.Limit(limit)
+	}
+	err = page.Scan(&people).Error
+	if err != nil {
+		return nil, 0, TranslateError(err)
+	}
+	for i := range people {
+		people[i].Role = role
+	}
+	return people, total, nil
+}
+
+func (s *GormCreditStore) Person(ctx context.Context, role string, id int) (Person, error) {
+	table, err := roleTable(role)
+	if err != nil {
+		return Person{}, err
+	}
+
+	var person Person
+	result := s.DB.WithContext(ctx).Table(table).Select("id, name").Where("id = ?", id).Limit(1).Scan(&person)
+	if result.Error != nil {
+		return Person{}, TranslateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return Person{}, ErrNoRecord
+	}
+	person.Role = role
+	return person, nil
+}
+
+// GormUserStore is a UserStore backed by any database gorm supports.
+type GormUserStore struct {
+	DB *gorm.DB
+}
+
+func (s *GormUserStore) Insert(ctx context.Context, user *User) error {
+	return TranslateError(s.DB.WithContext(ctx).Create(user).Error)
+}
+
+func (s *GormUserStore) Get(ctx context.Context, id int) (User, error) {
+	var user User
+	err := s.DB.WithContext(ctx).Take(&user, id).Error
+	return user, TranslateError(err)
+}
+
+func (s *GormUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	err := s.DB.WithContext(ctx).Where("email = ?", NormalizeEmail(email)).Take(&user).Error
+	return user, TranslateError(err)
+}
+
+func (s *GormUserStore) EmailTaken(ctx context.Context, email string) (bool, error) {
+	var count int64
+	err := s.DB.WithContext(ctx).Model(&User{}).Where("email = ?", NormalizeEmail(email)).Count(&count).Error
+	return count > 0, TranslateError(err)
+}
+
+func (s *GormUserStore) UpdateUserName(ctx context.Context, id int, userName string) error {
+	return TranslateError(s.DB.WithContext(ctx).Model(&User{}).Where("id = ?", id).Update("user_name", userName).Error)
+}
+
+func (s *GormUserStore) UpdatePassword(ctx context.Context, id int, hashedPassword string) error {
+	return s.updateAuth(ctx, id, "password", hashedPassword)
+}
+
+func (s *GormUserStore) SetAdmin(ctx context.Context, id int, admin bool) error {
+	return s.updateAuth(ctx, id, "admin", admin)
+}
+
+// updateAuth sets column and bumps the user's AuthVersion in one statement.
+func (s *GormUserStore) updateAuth(ctx context.Context, id int, column string, value any) error {
+	return TranslateError(s.DB.WithContext(ctx).Model(&User{}).Where("id = ?", id).
+		Updates(map[string]any{column: value, "auth_version": gorm.Expr("auth_version + 1")}).Error)
+}
+
+// Delete removes the user. Tokens, recovery codes and the like go with the
+// user through their foreign keys; the list join tables are cleared by hand.
+func (s *GormUserStore) Delete(ctx context.Context, id int) error {
+	return TranslateError(s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, table := range listTables {
+			err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", id).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		result := tx.Delete(&User{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNoRecord
+		}
+		return nil
+	}))
+}
+
+// SetTOTP enables two-factor authentication and replaces the recovery codes
+// in one transaction, so the old codes stop working as the new ones start.
+func (s *GormUserStore) SetTOTP(ctx context.Context, id int, secret string, step int64, codeHashes []string) error {
+	return TranslateError(s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", id).Updates(map[string]any{
+			"totp_secret":  secret,
+			"totp_enabled": true,
+			"totp_step":    step,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("user_id = ?", id).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+
+		codes := make([]RecoveryCode, len(codeHashes))
+		for i, hash := range codeHashes {
+			codes[i] = RecoveryCode{UserID: uint(id), CodeHash: hash}
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+		return tx.Create(&codes).Error
+	}))
+}
+
+func (s *GormUserStore) ClearTOTP(ctx context.Context, id int) error {
+	return TranslateError(s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", id).Updates(map[string]any{
+			"totp_secret":  "",
+			"totp_enabled": false,
+			"totp_step":    0,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", id).Delete(&RecoveryCode{}).Error
+	}))
+}
+
+// AdvanceTOTPStep checks and moves the stored step in the same statement,
+// which stops a code being replayed, even across instances.
+func (s *GormUserStore) AdvanceTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	result := s.DB.WithContext(ctx).Model(&User{}).Where("id = ? AND totp_step < ?", id, step).Update("totp_step", step)
+	if result.Error != nil {
+		return false, TranslateError(result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (s *GormUserStore) UseRecoveryCode(ctx context.Context, id int, codeHash string) (bool, error) {
+	result := s.DB.WithContext(ctx).Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", id, codeHash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, TranslateError(result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (s *GormUserStore) RequestEmailChange(ctx context.Context, verification *EmailVerification) error {
+	return TranslateError(s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", verification.UserID).Delete(&EmailVerification{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(verification).Error
+	}))
+}
+
+func (s *GormUserStore) EmailVerification(ctx context.Context, tokenHash string) (EmailVerification, error) {
+	var verification EmailVerification
+	err := s.DB.WithContext(ctx).Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now()).Take(&verification).Error
+	return verification, TranslateError(err)
+}
+
+func (s *GormUserStore) SetEmail(ctx context.Context, id int, email string) error {
+	return TranslateError(s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", id).Update("email", NormalizeEmail(email)).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", id).Delete(&EmailVerification{}).Error
+	}))
+}
+
+// GormListStore is a ListStore backed by any database gorm supports.
+type GormListStore struct {
+	DB *gorm.DB
+}
+
+// listEntry is a row of one of the list join tables.
+type listEntry struct {
+	UserID uint `gorm:"primaryKey"`
+	FilmID uint `gorm:"primaryKey"`
+}
+
+func listTable(list string) (string, error) {
+	table, ok := listTables[list]
+	if !ok {
+		return "", fmt.Errorf("models: unknown list %q", list)
+	}
+	return table, nil
+}
+
+func (s *GormListStore) Films(ctx context.Context, userID int, list string) ([]Film, error) {
+	table, err := listTable(list)
+	if err != nil {
+		return nil, err
+	}
+
+	films := []Film{}
+	err = s.DB.WithContext(ctx).
+		Joins(fmt.Sprintf("JOIN %s ON %s.film_id = films.id", table, table)).
+		Where(table+".user_id = ?", userID).
+		Find(&films).Error
+	return films, TranslateError(err)
+}
+
+// Add puts the film on the list. Adding a film that is already there is not
+// an error; adding one that doesn't exist is ErrInvalidReference.
+func (s *GormListStore) Add(ctx context.Context, userID, filmID int, list string) error {
+	table, err := listTable(list)
+	if err != nil {
+		return err
+	}
+
+	entry := listEntry{UserID: uint(userID), FilmID: uint(filmID)}
+	err = s.DB.WithContext(ctx).Table(table).Clauses(clause.OnConflict{DoNothing: true}).Create(&entry).Error
+	return TranslateError(err)
+}
+
+func (s *GormListStore) Remove(ctx context.Context, userID, filmID int, list string) error {
+	table, err := listTable(list)
+	if err != nil {
+		return err
+	}
+
+	err = s.DB.WithContext(ctx).Exec("DELETE FROM "+table+" WHERE user_id = ? AND film_id = ?", userID, filmID).Error
+	return TranslateError(err)
+}
+
+// GormSessionStore is a SessionStore backed by any database gorm supports.
+type GormSessionStore struct {
+	DB *gorm.DB
+}
+
+func (s *GormSessionStore) Insert(ctx context.Context, session *UserSession) error {
+	return TranslateError(s.DB.WithContext(ctx).Create(session).Error)
+}
+
+func (s *GormSessionStore) Get(ctx context.Context, userID, id int) (UserSession, error) {
+	var session UserSession
+	err := s.DB.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).Take(&session).Error
+	return session, TranslateError(err)
+}
+
+func (s *GormSessionStore) ForUser(ctx context.Context, userID int) ([]UserSession, error) {
+	sessions := []UserSession{}
+	err := s.DB.WithContext(ctx).Where("user_id = ?", userID).Order("last_seen DESC, id DESC").Find(&sessions).Error
+	return sessions, TranslateError(err)
+}
+
+func (s *GormSessionStore) Rename(ctx context.Context, oldToken, newToken string) error {
+	return TranslateError(s.DB.WithContext(ctx).Model(&UserSession{}).Where("token = ?", oldToken).Update("token", newToken).Error)
+}
+
+func (s *GormSessionStore) Touch(ctx context.Context, token, ip, userAgent string, lastSeen time.Time) (bool, error) {
+	result := s.DB.WithContext(ctx).Model(&UserSession{}).Where("token = ?", token).
+		Updates(map[string]any{"last_seen": lastSeen, "ip": ip, "user_agent": userAgent})
+	if result.Error != nil {
+		return false, TranslateError(result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s *GormSessionStore) Delete(ctx context.Context, token string) error {
+	return TranslateError(s.DB.WithContext(ctx).Where("token = ?", token).Delete(&UserSession{}).Error)
+}
+
+func (s *GormSessionStore) DeleteExpired(ctx context.Context, userID int) error {
+	return TranslateError(s.DB.WithContext(ctx).Where("user_id = ? AND expires_at < ?", userID, time.Now()).Delete(&UserSession{}).Error)
+}
+
+func (s *GormSessionStore) CountActive(ctx context.Context) (int64, error) {
+	var count int64
+	err := s.DB.WithContext(ctx).Model(&UserSession{}).Where("expires_at > ?", time.Now()).Count(&count).Error
+	return count, TranslateError(err)
+}
+
+// GormTokenStore is a TokenStore backed by any database gorm supports.
+type GormTokenStore struct {
+	DB *gorm.DB
+}
+
+func (s *GormTokenStore) Insert(ctx context.Context, token *APIToken) error {
+	return TranslateError(s.DB.WithContext(ctx).Create(token).Error)
+}
+
+func (s *GormTokenStore) GetByHash(ctx context.Context, hash string) (APIToken, error) {
+	var token APIToken
+	err := s.DB.WithContext(ctx).Where("token_hash = ?", hash).Take(&token).Error
+	return token, TranslateError(err)
+}
+
+func (s *GormTokenStore) ForUser(ctx context.Context, userID int) ([]APIToken, error) {
+	tokens := []APIToken{}
+	err := s.DB.WithContext(ctx).Where("user_id = ?", userID).Order("created DESC, id DESC").Find(&tokens).Error
+	return tokens, TranslateError(err)
+}
+
+func (s *GormTokenStore) Touch(ctx context.Context, id int, lastUsed time.Time) error {
+	return TranslateError(s.DB.WithContext(ctx).Model(&APIToken{}).Where("id = ?", id).Update("last_used_at", lastUsed).Error)
+}
+
+func (s *GormTokenStore) Delete(ctx context.Context, userID, id int) error {
+	result := s.DB.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).Delete(&APIToken{})
+	if result.Error != nil {
+		return TranslateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// GormExportStore is an ExportStore backed by any database gorm supports.
+type GormExportStore struct {
+	DB *gorm.DB
+}
+
+func (s *GormExportStore) Insert(ctx context.Context, job *DataExport) error {
+	return TranslateError(s.DB.WithContext(ctx).Create(job).Error)
+}
+
+func (s *GormExportStore) Get(ctx context.Context, id int) (DataExport, error) {
+	var job DataExport
+	err := s.DB.WithContext(ctx).Take(&job, id).Error
+	return job, TranslateError(err)
+}
+
+func (s *GormExportStore) ForUser(ctx context.Context, userID int) ([]DataExport, error) {
+	jobs := []DataExport{}
+	err := s.DB.WithContext(ctx).Where("user_id = ?", userID).Order("created DESC, id DESC").Find(&jobs).Error
+	return jobs, TranslateError(err)
+}
+
+func (s *GormExportStore) InFlight(ctx context.Context, userID int) (bool, error) {
+	var count int64
+	err := s.DB.WithContext(ctx).Model(&DataExport{}).
+		Where("user_id = ? AND status IN ?", userID, []string{ExportPending, ExportRunning}).
+		Count(&count).Error
+	return count > 0, TranslateError(err)
+}
+
+// whereClaimable matches the jobs a worker may pick up.
+func whereClaimable(db *gorm.DB, staleBefore time.Time) *gorm.DB {
+	return db.Where("(status = ? OR (status = ? AND started_at < ?))", ExportPending, ExportRunning, staleBefore)
+}
+
+func (s *GormExportStore) Pending(ctx context.Context, staleBefore time.Time) ([]uint, error) {
+	ids := []uint{}
+	err := whereClaimable(s.DB.WithContext(ctx).Model(&DataExport{}), staleBefore).Order("id").Pluck("id", &ids).Error
+	return ids, TranslateError(err)
+}
+
+// Claim checks and marks the job in one statement, so of several workers
+// claiming it at once only one succeeds.
+func (s *GormExportStore) Claim(ctx context.Context, id int, staleBefore time.Time) (bool, error) {
+	result := whereClaimable(s.DB.WithContext(ctx).Model(&DataExport{}).Where("id = ?", id), staleBefore).
+		Updates(map[string]any{"status": ExportRunning, "started_at": time.Now()})
+	if result.Error != nil {
+		return false, TranslateError(result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (s *GormExportStore) Complete(ctx context.Context, id int, expiresAt time.Time) error {
+	return s.finish(ctx, id, map[string]any{"status": ExportReady, "completed_at": time.Now(), "expires_at": expiresAt})
+}
+
+func (s *GormExportStore) Fail(ctx context.Context, id int, expiresAt time.Time) error {
+	return s.finish(ctx, id, map[string]any{"status": ExportFailed, "expires_at": expiresAt})
+}
+
+func (s *GormExportStore) finish(ctx context.Context, id int, updates map[string]any) error {
+	return TranslateError(s.DB.WithContext(ctx).Model(&DataExport{}).Where("id = ?", id).Updates(updates).Error)
+}
+
+func (s *GormExportStore) Expired(ctx context.Context) ([]uint, error) {
+	ids := []uint{}
+	err := s.DB.WithContext(ctx).Model(&DataExport{}).Where("expires_at < ?", time.Now()).Order("id").Pluck("id", &ids).Error
+	return ids, TranslateError(err)
+}
+
+func (s *GormExportStore) Delete(ctx context.Context, id int) error {
+	return TranslateError(s.DB.WithContext(ctx).Delete(&DataExport{}, id).Error)
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// benchFilms is about one page of the film listing.
+const benchFilms = 35
+
+// newBenchFilmStore returns a GormFilmStore on a scratch SQLite database
+// holding benchFilms films with credits, each on a few users' lists, and a
+// counter of the statements it runs.
+func newBenchFilmStore(b *testing.B) (*GormFilmStore, *atomic.Int64) {
+	b.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(b.TempDir(), "bench.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { sqlDB.Close() })
+
+	err = db.AutoMigrate(&User{}, &Genre{}, &Director{}, &Star{}, &Film{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	users := make([]User, 10)
+	for i := range users {
+		users[i] = User{UserName: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i), Password: "x"}
+	}
+	err = db.Create(&users).Error
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 1; i <= benchFilms; i++ {
+		film := Film{
+			ID: uint(i), Name: fmt.Sprintf("Film %d", i), Year: 2000, RunTime: 100, Rating: 7,
+			Genres:    []Genre{{Name: fmt.Sprintf("Genre %d", i)}},
+			Directors: []Director{{ID: uint(i), Name: fmt.Sprintf("Director %d", i)}},
+			Stars:     []Star{{Name: fmt.Sprintf("Star %d", i)}, {Name: fmt.Sprintf("Co-star %d", i)}},
+		}
+		err = db.Create(&film).Error
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, user := range users[:i%len(users)] {
+			err = db.Model(&user).Association("WatchList").Append(&film)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = db.Model(&user).Association("WatchedList").Append(&film)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	var queries atomic.Int64
+	count := func(*gorm.DB) { queries.Add(1) }
+	err = db.Callback().Query().Before("gorm:query").Register("bench:count", count)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = db.Callback().Row().Before("gorm:row").Register("bench:count", count)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return &GormFilmStore{DB: db}, &queries
+}
+
+// BenchmarkFilmRange compares loading a page of films with their list counts
+// in one batch against asking for each film's counts separately, which is
+// what the listing used to do.
+func BenchmarkFilmRange(b *testing.B) {
+	ctx := context.Background()
+
+	b.Run("batched", func(b *testing.B) {
+		store, queries := newBenchFilmStore(b)
+		queries.Store(0)
+		b.ResetTimer()
+
+		for range b.N {
+			films, err := store.Range(ctx, 1, benchFilms)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = store.WithCounts(ctx, 1, films)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(queries.Load())/float64(b.N), "queries/op")
+	})
+
+	b.Run("per-film", func(b *testing.B) {
+		store, queries := newBenchFilmStore(b)
+		queries.Store(0)
+		b.ResetTimer()
+
+		for range b.N {
+			films, err := store.Range(ctx, 1, benchFilms)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, film := range films {
+				_, err = store.WithCounts(ctx, 1, []Film{film})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(queries.Load())/float64(b.N), "queries/op")
+	})
+}
@@ -0,0 +1,939 @@
+package models
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps films, users and everything belonging to them in
+// memory. It backs the stores it hands out and enforces the same constraints
+// as the database, deleting a user's records along with the user, so tests
+// can run handlers without one.
+type MemoryStore struct {
+	mu            sync.Mutex
+	films         map[uint]Film
+	users         map[uint]User
+	lists         map[string]map[uint][]uint // list -> user ID -> film IDs, oldest first
+	recoveryCodes map[uint][]RecoveryCode    // user ID -> codes
+	verifications map[uint]EmailVerification // user ID -> pending change of address
+	sessions      map[uint]UserSession
+	tokens        map[uint]APIToken
+	exports       map[uint]DataExport
+	lastIDs       map[string]uint // table -> last ID handed out
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		films: map[uint]Film{},
+		users: map[uint]User{},
+		lists: map[string]map[uint][]uint{
+			ListWatchlist:   {},
+			ListWatchedlist: {},
+		},
+		recoveryCodes: map[uint][]RecoveryCode{},
+		verifications: map[uint]EmailVerification{},
+		sessions:      map[uint]UserSession{},
+		tokens:        map[uint]APIToken{},
+		exports:       map[uint]DataExport{},
+		lastIDs:       map[string]uint{},
+	}
+}
+
+// nextID returns a new ID for a record in table, counting from 1 as the
+// database does. The caller must hold m.mu.
+func (m *MemoryStore) nextID(table string) uint {
+	m.lastIDs[table]++
+	return m.lastIDs[table]
+}
+
+// checkUser returns ErrInvalidReference unless userID exists, as a foreign
+// key would. The caller must hold m.mu.
+func (m *MemoryStore) checkUser(userID uint) error {
+	if _, ok := m.users[userID]; !ok {
+		return ErrInvalidReference
+	}
+	return nil
+}
+
+// AddFilm adds film to the catalogue, replacing any film with the same ID.
+// Like the database, it sets UpdatedAt when the film doesn't have one.
+func (m *MemoryStore) AddFilm(film Film) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if film.UpdatedAt.IsZero() {
+		film.UpdatedAt = time.Now()
+	}
+	m.films[film.ID] = film
+}
+
+// Films returns a FilmStore over the store's catalogue.
+func (m *MemoryStore) Films() FilmStore {
+	return memoryFilms{m}
+}
+
+// Credits returns a CreditStore over the genres and people the store's
+// films are credited with.
+func (m *MemoryStore) Credits() CreditStore {
+	return memoryCredits{m}
+}
+
+// Users returns a UserStore over the store's users.
+func (m *MemoryStore) Users() UserStore {
+	return memoryUsers{m}
+}
+
+// Lists returns a ListStore over the store's lists.
+func (m *MemoryStore) Lists() ListStore {
+	return memoryLists{m}
+}
+
+// Sessions returns a SessionStore over the store's device sessions.
+func (m *MemoryStore) Sessions() SessionStore {
+	return memorySessions{m}
+}
+
+// Tokens returns a TokenStore over the store's API tokens.
+func (m *MemoryStore) Tokens() TokenStore {
+	return memoryTokens{m}
+}
+
+// Exports returns an ExportStore over the store's data exports.
+func (m *MemoryStore) Exports() ExportStore {
+	return memoryExports{m}
+}
+
+type memoryFilms struct {
+	m *MemoryStore
+}
+
+func (s memoryFilms) Get(ctx context.Context, id int) (Film, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	film, ok := s.m.films[uint(id)]
+	if !ok {
+		return Film{}, ErrNoRecord
+	}
+	return film, nil
+}
+
+func (s memoryFilms) Range(ctx context.Context, start, end int) ([]Film, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	films := []Film{}
+	for id, film := range s.m.films {
+		if int(id) >= start && int(id) <= end {
+			films = append(films, film)
+		}
+	}
+	sortFilms(films)
+	return films, nil
+}
+
+func (s memoryFilms) Search(ctx context.Context, name string) ([]Film, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	films := []Film{}
+	for _, film := range s.m.films {
+		if strings.Contains(strings.ToLower(film.Name), strings.ToLower(name)) {
+			film.Genres, film.Directors, film.Stars = nil, nil, nil
+			films = append(films, film)
+		}
+	}
+	sortFilms(films)
+	return films, nil
+}
+
+func (s memoryFilms) List(ctx context.Context, q FilmQuery) ([]Film, int64, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	films := []Film{}
+	for _, film := range s.m.films {
+		switch {
+		case !strings.Contains(strings.ToLower(film.Name), strings.ToLower(q.Name)),
+			q.GenreID != 0 && !slices.ContainsFunc(film.Genres, func(g Genre) bool { return g.ID == uint(q.GenreID) }),
+			q.DirectorID != 0 && !slices.ContainsFunc(film.Directors, func(d Director) bool { return d.ID == uint(q.DirectorID) }),
+			q.StarID != 0 && !slices.ContainsFunc(film.Stars, func(s Star) bool { return s.ID == uint(q.StarID) }):
+			continue
+		}
+		films = append(films, film)
+	}
+	sortFilms(films)
+	return page(films, q.Offset, q.Limit), int64(len(films)), nil
+}
+
+// page returns the items from offset on, up to limit of them, or all of
+// them if limit is 0.
+func page[T any](items []T, offset, limit int) []T {
+	items = items[min(offset, len(items)):]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+func (s memoryFilms) WithCounts(ctx context.Context, userID int, films []Film) ([]FilmWithCounts, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	result := make([]FilmWithCounts, len(films))
+	for i, film := range films {
+		result[i].Film = film
+		result[i].WatchlistCount, result[i].OnWatchlist = s.m.listCount(film.ID, uint(userID), ListWatchlist)
+		result[i].WatchedCount, result[i].Watched = s.m.listCount(film.ID, uint(userID), ListWatchedlist)
+	}
+	return result, nil
+}
+
+// listCount returns how many users have filmID on list and whether userID
+// is one of them. The caller must hold m.mu.
+func (m *MemoryStore) listCount(filmID, userID uint, list string) (int64, bool) {
+	var total int64
+	var mine bool
+	for id, filmIDs := range m.lists[list] {
+		if slices.Contains(filmIDs, filmID) {
+			total++
+			mine = mine || id == userID
+		}
+	}
+	return total, mine
+}
+
+func sortFilms(films []Film) {
+	slices.SortFunc(films, func(a, b Film) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
+
+type memoryCredits struct {
+	m *MemoryStore
+}
+
+func (s memoryCredits) Genres(ctx context.Context) ([]Genre, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	byID := map[uint]Genre{}
+	for _, film := range s.m.films {
+		for _, genre := range film.Genres {
+			byID[genre.ID] = genre
+		}
+	}
+
+	genres := []Genre{}
+	for _, genre := range byID {
+		genres = append(genres, genre)
+	}
+	slices.SortFunc(genres, func(a, b Genre) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return genres, nil
+}
+
+func (s memoryCredits) Genre(ctx context.Context, id int) (Genre, error) {
+	genres, err := s.Genres(ctx)
+	if err != nil {
+		return Genre{}, err
+	}
+	for _, genre := range genres {
+		if genre.ID == uint(id) {
+			return genre, nil
+		}
+	}
+	return Genre{}, ErrNoRecord
+}
+
+// people returns everyone credited in role, in ID order.
+func (s memoryCredits) people(role string) ([]Person, error) {
+	_, err := roleTable(role)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	byID := map[uint]Person{}
+	for _, film := range s.m.films {
+		if role == RoleDirector {
+			for _, d := range film.Directors {
+				byID[d.ID] = Person{ID: d.ID, Role: role, Name: d.Name}
+			}
+		} else {
+			for _, star := range film.Stars {
+				byID[star.ID] = Person{ID: star.ID, Role: role, Name: star.Name}
+			}
+		}
+	}
+
+	people := []Person{}
+	for _, person := range byID {
+		people = append(people, person)
+	}
+	slices.SortFunc(people, func(a, b Person) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return people, nil
+}
+
+func (s memoryCredits) People(ctx context.Context, role, name string, offset, limit int) ([]Person, int64, error) {
+	people, err := s.people(role)
+	if err != nil {
+		return nil, 0, err
+	}
+	people = slices.DeleteFunc(people, func(p Person) bool {
+		return !strings.Contains(strings.ToLower(p.Name), strings.ToLower(name))
+	})
+	return page(people, offset, limit), int64(len(people)), nil
+}
+
+func (s memoryCredits) Person(ctx context.Context, role string, id int) (Person, error) {
+	people, err := s.people(role)
+	if err != nil {
+		return Person{}, err
+	}
+	for _, person := range people {
+		if person.ID == uint(id) {
+			return person, nil
+		}
+	}
+	return Person{}, ErrNoRecord
+}
+
+type memoryUsers struct {
+	m *MemoryStore
+}
+
+func (s memoryUsers) Insert(ctx context.Context, user *User) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user.Email = NormalizeEmail(user.Email)
+	for _, other := range s.m.users {
+		switch {
+		case other.Email == user.Email:
+			return ErrDuplicateEmail
+		case other.UserName == user.UserName:
+			return ErrDuplicateUsername
+		}
+	}
+
+	user.ID = s.m.nextID("users")
+	if user.Created.IsZero() {
+		user.Created = time.Now()
+	}
+	s.m.users[user.ID] = *user
+	return nil
+}
+
+func (s memoryUsers) Get(ctx context.Context, id int) (User, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user, ok := s.m.users[uint(id)]
+	if !ok {
+		return User{}, ErrNoRecord
+	}
+	return user, nil
+}
+
+func (s memoryUsers) GetByEmail(ctx context.Context, email string) (User, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	email = NormalizeEmail(email)
+	for _, user := range s.m.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return User{}, ErrNoRecord
+}
+
+func (s memoryUsers) EmailTaken(ctx context.Context, email string) (bool, error) {
+	_, err := s.GetByEmail(ctx, email)
+	if errors.Is(err, ErrNoRecord) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s memoryUsers) UpdateUserName(ctx context.Context, id int, userName string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, other := range s.m.users {
+		if other.UserName == userName && other.ID != uint(id) {
+			return ErrDuplicateUsername
+		}
+	}
+	return s.m.updateUser(id, func(u *User) { u.UserName = userName })
+}
+
+func (s memoryUsers) UpdatePassword(ctx context.Context, id int, hashedPassword string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	return s.m.updateUser(id, func(u *User) {
+		u.Password = hashedPassword
+		u.AuthVersion++
+	})
+}
+
+func (s memoryUsers) SetAdmin(ctx context.Context, id int, admin bool) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	return s.m.updateUser(id, func(u *User) {
+		u.Admin = admin
+		u.AuthVersion++
+	})
+}
+
+// updateUser applies fn to the user with id. Like an UPDATE, a missing user
+// is not an error. The caller must hold m.mu.
+func (m *MemoryStore) updateUser(id int, fn func(*User)) error {
+	user, ok := m.users[uint(id)]
+	if !ok {
+		return nil
+	}
+	fn(&user)
+	m.users[user.ID] = user
+	return nil
+}
+
+func (s memoryUsers) Delete(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if _, ok := s.m.users[uint(id)]; !ok {
+		return ErrNoRecord
+	}
+	delete(s.m.users, uint(id))
+	for _, list := range s.m.lists {
+		delete(list, uint(id))
+	}
+	delete(s.m.recoveryCodes, uint(id))
+	delete(s.m.verifications, uint(id))
+	deleteUserRecords(s.m.sessions, uint(id), func(s UserSession) uint { return s.UserID })
+	deleteUserRecords(s.m.tokens, uint(id), func(t APIToken) uint { return t.UserID })
+	deleteUserRecords(s.m.exports, uint(id), func(e DataExport) uint { return e.UserID })
+	return nil
+}
+
+// deleteUserRecords deletes the records belonging to userID from records.
+func deleteUserRecords[T any](records map[uint]T, userID uint, owner func(T) uint) {
+	for id, record := range records {
+		if owner(record) == userID {
+			delete(records, id)
+		}
+	}
+}
+
+func (s memoryUsers) SetTOTP(ctx context.Context, id int, secret string, step int64, codeHashes []string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	codes := make([]RecoveryCode, len(codeHashes))
+	for i, hash := range codeHashes {
+		codes[i] = RecoveryCode{ID: s.m.nextID("recovery_codes"), UserID: uint(id), CodeHash: hash}
+	}
+	if _, ok := s.m.users[uint(id)]; ok {
+		s.m.recoveryCodes[uint(id)] = codes
+	}
+	return s.m.updateUser(id, func(u *User) {
+		u.TOTPSecret = secret
+		u.TOTPEnabled = true
+		u.TOTPStep = step
+	})
+}
+
+func (s memoryUsers) ClearTOTP(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	delete(s.m.recoveryCodes, uint(id))
+	return s.m.updateUser(id, func(u *User) {
+		u.TOTPSecret = ""
+		u.TOTPEnabled = false
+		u.TOTPStep = 0
+	})
+}
+
+func (s memoryUsers) AdvanceTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user, ok := s.m.users[uint(id)]
+	if !ok || user.TOTPStep >= step {
+		return false, nil
+	}
+	user.TOTPStep = step
+	s.m.users[user.ID] = user
+	return true, nil
+}
+
+func (s memoryUsers) UseRecoveryCode(ctx context.Context, id int, codeHash string) (bool, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	codes := s.m.recoveryCodes[uint(id)]
+	for i := range codes {
+		if codes[i].CodeHash == codeHash && codes[i].UsedAt == nil {
+			now := time.Now()
+			codes[i].UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s memoryUsers) RequestEmailChange(ctx context.Context, verification *EmailVerification) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	err := s.m.checkUser(verification.UserID)
+	if err != nil {
+		return err
+	}
+	verification.ID = s.m.nextID("email_verifications")
+	s.m.verifications[verification.UserID] = *verification
+	return nil
+}
+
+func (s memoryUsers) EmailVerification(ctx context.Context, tokenHash string) (EmailVerification, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, verification := range s.m.verifications {
+		if verification.TokenHash == tokenHash && verification.ExpiresAt.After(time.Now()) {
+			return verification, nil
+		}
+	}
+	return EmailVerification{}, ErrNoRecord
+}
+
+func (s memoryUsers) SetEmail(ctx context.Context, id int, email string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	email = NormalizeEmail(email)
+	for _, other := range s.m.users {
+		if other.Email == email && other.ID != uint(id) {
+			return ErrDuplicateEmail
+		}
+	}
+	delete(s.m.verifications, uint(id))
+	return s.m.updateUser(id, func(u *User) { u.Email = email })
+}
+
+type memoryLists struct {
+	m *MemoryStore
+}
+
+func (s memoryLists) Films(ctx context.Context, userID int, list string) ([]Film, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	entries, ok := s.m.lists[list]
+	if !ok {
+		_, err := listTable(list)
+		return nil, err
+	}
+
+	films := []Film{}
+	for _, filmID := range entries[uint(userID)] {
+		film := s.m.films[filmID]
+		film.Genres, film.Directors, film.Stars = nil, nil, nil
+		films = append(films, film)
+	}
+	return films, nil
+}
+
+func (s memoryLists) Add(ctx context.Context, userID, filmID int, list string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	entries, ok := s.m.lists[list]
+	if !ok {
+		_, err := listTable(list)
+		return err
+	}
+
+	_, userExists := s.m.users[uint(userID)]
+	_, filmExists := s.m.films[uint(filmID)]
+	if !userExists || !filmExists {
+		return ErrInvalidReference
+	}
+
+	if !slices.Contains(entries[uint(userID)], uint(filmID)) {
+		entries[uint(userID)] = append(entries[uint(userID)], uint(filmID))
+	}
+	return nil
+}
+
+func (s memoryLists) Remove(ctx context.Context, userID, filmID int, list string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	entries, ok := s.m.lists[list]
+	if !ok {
+		_, err := listTable(list)
+		return err
+	}
+
+	entries[uint(userID)] = slices.DeleteFunc(entries[uint(userID)], func(id uint) bool {
+		return id == uint(filmID)
+	})
+	return nil
+}
+
+type memorySessions struct {
+	m *MemoryStore
+}
+
+func (s memorySessions) Insert(ctx context.Context, session *UserSession) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	err := s.m.checkUser(session.UserID)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.m.sessionByToken(session.Token); ok {
+		return fmt.Errorf("models: duplicate session token")
+	}
+
+	session.ID = s.m.nextID("user_sessions")
+	if session.Created.IsZero() {
+		session.Created = time.Now()
+	}
+	s.m.sessions[session.ID] = *session
+	return nil
+}
+
+// sessionByToken returns the session with token. The caller must hold m.mu.
+func (m *MemoryStore) sessionByToken(token string) (UserSession, bool) {
+	for _, session := range m.sessions {
+		if session.Token == token {
+			return session, true
+		}
+	}
+	return UserSession{}, false
+}
+
+func (s memorySessions) Get(ctx context.Context, userID, id int) (UserSession, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	session, ok := s.m.sessions[uint(id)]
+	if !ok || session.UserID != uint(userID) {
+		return UserSession{}, ErrNoRecord
+	}
+	return session, nil
+}
+
+func (s memorySessions) ForUser(ctx context.Context, userID int) ([]UserSession, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	sessions := userRecords(s.m.sessions, uint(userID), func(s UserSession) uint { return s.UserID })
+	slices.SortFunc(sessions, func(a, b UserSession) int {
+		return cmp.Or(b.LastSeen.Compare(a.LastSeen), cmp.Compare(b.ID, a.ID))
+	})
+	return sessions, nil
+}
+
+// userRecords returns the records in records belonging to userID.
+func userRecords[T any](records map[uint]T, userID uint, owner func(T) uint) []T {
+	result := []T{}
+	for _, record := range records {
+		if owner(record) == userID {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+func (s memorySessions) Rename(ctx context.Context, oldToken, newToken string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	session, ok := s.m.sessionByToken(oldToken)
+	if ok {
+		session.Token = newToken
+		s.m.sessions[session.ID] = session
+	}
+	return nil
+}
+
+func (s memorySessions) Touch(ctx context.Context, token, ip, userAgent string, lastSeen time.Time) (bool, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	session, ok := s.m.sessionByToken(token)
+	if !ok {
+		return false, nil
+	}
+	session.IP, session.UserAgent, session.LastSeen = ip, userAgent, lastSeen
+	s.m.sessions[session.ID] = session
+	return true, nil
+}
+
+func (s memorySessions) Delete(ctx context.Context, token string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	session, ok := s.m.sessionByToken(token)
+	if ok {
+		delete(s.m.sessions, session.ID)
+	}
+	return nil
+}
+
+func (s memorySessions) DeleteExpired(ctx context.Context, userID int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range s.m.sessions {
+		if session.UserID == uint(userID) && session.ExpiresAt.Before(now) {
+			delete(s.m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s memorySessions) CountActive(ctx context.Context) (int64, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var count int64
+	now := time.Now()
+	for _, session := range s.m.sessions {
+		if session.ExpiresAt.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+type memoryTokens struct {
+	m *MemoryStore
+}
+
+func (s memoryTokens) Insert(ctx context.Context, token *APIToken) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	err := s.m.checkUser(token.UserID)
+	if err != nil {
+		return err
+	}
+	for _, other := range s.m.tokens {
+		if other.TokenHash == token.TokenHash {
+			return fmt.Errorf("models: duplicate token hash")
+		}
+	}
+
+	token.ID = s.m.nextID("api_tokens")
+	if token.Created.IsZero() {
+		token.Created = time.Now()
+	}
+	s.m.tokens[token.ID] = *token
+	return nil
+}
+
+func (s memoryTokens) GetByHash(ctx context.Context, hash string) (APIToken, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, token := range s.m.tokens {
+		if token.TokenHash == hash {
+			return token, nil
+		}
+	}
+	return APIToken{}, ErrNoRecord
+}
+
+func (s memoryTokens) ForUser(ctx context.Context, userID int) ([]APIToken, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	tokens := userRecords(s.m.tokens, uint(userID), func(t APIToken) uint { return t.UserID })
+	slices.SortFunc(tokens, func(a, b APIToken) int {
+		return cmp.Or(b.Created.Compare(a.Created), cmp.Compare(b.ID, a.ID))
+	})
+	return tokens, nil
+}
+
+func (s memoryTokens) Touch(ctx context.Context, id int, lastUsed time.Time) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	token, ok := s.m.tokens[uint(id)]
+	if ok {
+		token.LastUsedAt = &lastUsed
+		s.m.tokens[token.ID] = token
+	}
+	return nil
+}
+
+func (s memoryTokens) Delete(ctx context.Context, userID, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	token, ok := s.m.tokens[uint(id)]
+	if !ok || token.UserID != uint(userID) {
+		return ErrNoRecord
+	}
+	delete(s.m.tokens, token.ID)
+	return nil
+}
+
+type memoryExports struct {
+	m *MemoryStore
+}
+
+func (s memoryExports) Insert(ctx context.Context, job *DataExport) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	err := s.m.checkUser(job.UserID)
+	if err != nil {
+		return err
+	}
+
+	job.ID = s.m.nextID("data_exports")
+	if job.Created.IsZero() {
+		job.Created = time.Now()
+	}
+	s.m.exports[job.ID] = *job
+	return nil
+}
+
+func (s memoryExports) Get(ctx context.Context, id int) (DataExport, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	job, ok := s.m.exports[uint(id)]
+	if !ok {
+		return DataExport{}, ErrNoRecord
+	}
+	return job, nil
+}
+
+func (s memoryExports) ForUser(ctx context.Context, userID int) ([]DataExport, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	jobs := userRecords(s.m.exports, uint(userID), func(e DataExport) uint { return e.UserID })
+	slices.SortFunc(jobs, func(a, b DataExport) int {
+		return cmp.Or(b.Created.Compare(a.Created), cmp.Compare(b.ID, a.ID))
+	})
+	return jobs, nil
+}
+
+func (s memoryExports) InFlight(ctx context.Context, userID int) (bool, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, job := range s.m.exports {
+		if job.UserID == uint(userID) && (job.Status == ExportPending || job.Status == ExportRunning) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// claimable reports whether a worker may pick job up.
+func claimable(job DataExport, staleBefore time.Time) bool {
+	return job.Status == ExportPending ||
+		job.Status == ExportRunning && job.StartedAt != nil && job.StartedAt.Before(staleBefore)
+}
+
+func (s memoryExports) Pending(ctx context.Context, staleBefore time.Time) ([]uint, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	ids := []uint{}
+	for id, job := range s.m.exports {
+		if claimable(job, staleBefore) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (s memoryExports) Claim(ctx context.Context, id int, staleBefore time.Time) (bool, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	job, ok := s.m.exports[uint(id)]
+	if !ok || !claimable(job, staleBefore) {
+		return false, nil
+	}
+	now := time.Now()
+	job.Status, job.StartedAt = ExportRunning, &now
+	s.m.exports[job.ID] = job
+	return true, nil
+}
+
+func (s memoryExports) Complete(ctx context.Context, id int, expiresAt time.Time) error {
+	return s.finish(id, func(job *DataExport) {
+		now := time.Now()
+		job.Status, job.CompletedAt, job.ExpiresAt = ExportReady, &now, &expiresAt
+	})
+}
+
+func (s memoryExports) Fail(ctx context.Context, id int, expiresAt time.Time) error {
+	return s.finish(id, func(job *DataExport) {
+		job.Status, job.ExpiresAt = ExportFailed, &expiresAt
+	})
+}
+
+func (s memoryExports) finish(id int, fn func(*DataExport)) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	job, ok := s.m.exports[uint(id)]
+	if ok {
+		fn(&job)
+		s.m.exports[job.ID] = job
+	}
+	return nil
+}
+
+func (s memoryExports) Expired(ctx context.Context) ([]uint, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	ids := []uint{}
+	now := time.Now()
+	for id, job := range s.m.exports {
+		if job.ExpiresAt != nil && job.ExpiresAt.Before(now) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (s memoryExports) Delete(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	delete(s.m.exports, uint(id))
+	return nil
+}
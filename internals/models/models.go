@@ -1,24 +1,43 @@
 package models
 
 import (
-	"encoding/json"
+	"strings"
 
 	"time"
 
-	_ "gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
 type User struct {
-	ID          uint      `gorm:"primaryKey;" json:"id"`
-	UserName    string    `gorm:"size:255;not null" json:"username"`
-	Email       string    `gorm:"size:255;unique;not null" json:"email"`
-	Password    string    `gorm:"size:255;not null" json:"-"`
-	WatchList   []Film    `gorm:"many2many:user_watchlist" json:"watchlist"`
-	WatchedList []Film    `gorm:"many2many:user_watchedlist" json:"watchedlist"`
+	ID          uint   `gorm:"primaryKey;" json:"id"`
+	UserName    string `gorm:"size:255;not null;uniqueIndex:idx_users_user_name" json:"username"`
+	Email       string `gorm:"size:255;not null;uniqueIndex:idx_users_email" json:"email"`
+	Password    string `gorm:"size:255;not null" json:"-"`
+	WatchList   []Film `gorm:"many2many:user_watchlist" json:"watchlist"`
+	WatchedList []Film `gorm:"many2many:user_watchedlist" json:"watchedlist"`
+	Admin       bool   `gorm:"not null;default:false" json:"-"`
+	TOTPSecret  string `gorm:"column:totp_secret;size:64;not null;default:''" json:"-"`
+	TOTPEnabled bool   `gorm:"column:totp_enabled;not null;default:false" json:"-"`
+	TOTPStep    int64  `gorm:"column:totp_step;not null;default:0" json:"-"`
+	// AuthVersion goes up whenever the user's password or role changes,
+	// ending sessions signed in under an earlier version.
+	AuthVersion int64     `gorm:"not null;default:0" json:"-"`
 	Created     time.Time `gorm:"autoCreateTime" json:"created"`
 }
 
+// NormalizeEmail returns the canonical form an email address is stored and
+// looked up in.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// BeforeSave keeps stored emails canonical so the unique index behaves the
+// same regardless of input casing, whatever the column's collation.
+func (u *User) BeforeSave(tx *gorm.DB) error {
+	u.Email = NormalizeEmail(u.Email)
+	return nil
+}
+
 type Genre struct {
 	ID   uint   `gorm:"primaryKey;autoIncrement" json:"id"`
 	Name string `gorm:"size:255;not null" json:"name"`
@@ -34,6 +53,20 @@ type Director struct {
 	Name string `gorm:"size:255;not null" json:"name"`
 }
 
+// Roles a Person can be credited in.
+const (
+	RoleDirector = "director"
+	RoleStar     = "star"
+)
+
+// Person is a director or a star. Directors and stars are numbered
+// separately, so an ID only means something together with the role.
+type Person struct {
+	ID   uint   `json:"id"`
+	Role string `json:"role"`
+	Name string `json:"name"`
+}
+
 type Film struct {
 	ID          uint       `gorm:"primaryKey" json:"id"`
 	Name        string     `gorm:"size:255;not null" json:"name"`
@@ -45,36 +78,89 @@ type Film struct {
 	Stars       []Star     `gorm:"many2many:film_stars" json:"stars"`
 	Description string     `gorm:"type:text" json:"description"`
 	Image       string     `gorm:"size:255" json:"image"`
+	UpdatedAt   time.Time  `json:"updated_at"`
 }
 
-type FilmWithUsers struct {
+// FilmWithCounts is a film with how many users have it on each list and
+// whether the user asking does. Who else has it stays private.
+type FilmWithCounts struct {
 	Film
-	Users    []string `json:"users"`
-	Watchers []string `json:"watchers"`
+	WatchlistCount int64 `json:"watchlist_count"`
+	WatchedCount   int64 `json:"watched_count"`
+	OnWatchlist    bool  `json:"on_watchlist"`
+	Watched        bool  `json:"watched"`
 }
 
-func (f *Film) Json(db *gorm.DB) ([]byte, error) {
-	var users []User
-	var watchers []User
+// LoginAttempt tracks failed logins for a single subject, which is either an
+// account ("account:<email>") or a client address ("ip:<addr>").
+type LoginAttempt struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Subject     string    `gorm:"size:255;not null;uniqueIndex" json:"subject"`
+	Failures    int       `gorm:"not null;default:0" json:"failures"`
+	LastFailure time.Time `gorm:"not null" json:"last_failure"`
+	LockedUntil time.Time `gorm:"not null" json:"locked_until"`
+}
+
+// RateLimit is a rate limiting bucket shared by every server instance.
+// FullAt is when the bucket will be full again, in Unix nanoseconds.
+type RateLimit struct {
+	Bucket string `gorm:"primaryKey;size:255"`
+	FullAt int64  `gorm:"not null;index"`
+}
 
-	db.Model(&f).Association("WatchList").Find(&users)
-	db.Model(&f).Association("WatchedList").Find(&watchers)
+// RecoveryCode is a single-use code that can stand in for a TOTP code. Only
+// its hash is stored.
+type RecoveryCode struct {
+	ID       uint       `gorm:"primaryKey" json:"id"`
+	UserID   uint       `gorm:"not null;index" json:"-"`
+	User     User       `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	CodeHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	UsedAt   *time.Time `json:"used_at"`
+}
 
-	userNames := make([]string, len(users))
-	for i, user := range users {
-		userNames[i] = user.UserName
-	}
+// UserSession records a signed-in browser session so it can be listed and
+// revoked. Token is the scs session token, which is also the key of the
+// session in the session store.
+type UserSession struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"-"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Token     string    `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	IP        string    `gorm:"size:45;not null" json:"ip"`
+	UserAgent string    `gorm:"size:255;not null" json:"user_agent"`
+	Created   time.Time `gorm:"autoCreateTime" json:"created"`
+	LastSeen  time.Time `gorm:"not null" json:"last_seen"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+}
 
-	watcherNames := make([]string, len(watchers))
-	for i, watcher := range watchers {
-		watcherNames[i] = watcher.UserName
-	}
+// EmailVerification is a pending change of a user's email address, confirmed
+// by following a link sent to the new address.
+type EmailVerification struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"-"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Email     string    `gorm:"size:255;not null" json:"email"`
+	TokenHash string    `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+}
 
-	filmWithUsers := FilmWithUsers{
-		Film:     *f,
-		Users:    userNames,
-		Watchers: watcherNames,
-	}
+// Statuses a DataExport moves through.
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
 
-	return json.Marshal(filmWithUsers)
+// DataExport is a request for a copy of everything stored about a user. The
+// archive itself lives on disk and is removed once the export expires.
+type DataExport struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"-"`
+	User        User       `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Status      string     `gorm:"size:16;not null;index" json:"status"`
+	Created     time.Time  `gorm:"autoCreateTime" json:"created"`
+	StartedAt   *time.Time `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
 }
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Lists a user can keep films on.
+const (
+	ListWatchlist   = "watchlist"
+	ListWatchedlist = "watchedlist"
+)
+
+// listTables maps each list onto the join table that stores it.
+var listTables = map[string]string{
+	ListWatchlist:   "user_watchlist",
+	ListWatchedlist: "user_watchedlist",
+}
+
+// FilmStore reads the film catalogue. Get, Range and List return films with
+// their genres, directors and stars loaded. List also returns how many films
+// match the query across all pages. WithCounts adds list counts and
+// userID's own list membership to films in a fixed number of queries,
+// however many films there are.
+type FilmStore interface {
+	Get(ctx context.Context, id int) (Film, error)
+	Range(ctx context.Context, start, end int) ([]Film, error)
+	Search(ctx context.Context, name string) ([]Film, error)
+	List(ctx context.Context, q FilmQuery) ([]Film, int64, error)
+	WithCounts(ctx context.Context, userID int, films []Film) ([]FilmWithCounts, error)
+}
+
+// FilmQuery selects a page of films in ID order. Zero fields don't filter.
+type FilmQuery struct {
+	Name       string // part of the name, ignoring case
+	GenreID    int
+	DirectorID int
+	StarID     int
+	Offset     int
+	Limit      int // 0 means no limit
+}
+
+// CreditStore reads the genres, directors and stars films are credited
+// with. People lists the people in role whose names contain name, ignoring
+// case, in ID order, and how many there are across all pages; a limit of 0
+// means no limit. role is RoleDirector or RoleStar.
+type CreditStore interface {
+	Genres(ctx context.Context) ([]Genre, error)
+	Genre(ctx context.Context, id int) (Genre, error)
+	People(ctx context.Context, role, name string, offset, limit int) ([]Person, int64, error)
+	Person(ctx context.Context, role string, id int) (Person, error)
+}
+
+// UserStore reads and writes user accounts. UpdatePassword and SetAdmin
+// bump the user's AuthVersion.
+//
+// SetTOTP turns two-factor authentication on, replacing any recovery codes
+// with codeHashes, and ClearTOTP turns it off again. AdvanceTOTPStep and
+// UseRecoveryCode report whether the code was accepted: a step that isn't
+// past the stored one, or a recovery code that is unknown or used, is not.
+//
+// RequestEmailChange stores a pending change of address in place of any
+// earlier one. EmailVerification returns the unexpired request with
+// tokenHash, and SetEmail changes the address and clears pending requests.
+type UserStore interface {
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	EmailTaken(ctx context.Context, email string) (bool, error)
+	UpdateUserName(ctx context.Context, id int, userName string) error
+	UpdatePassword(ctx context.Context, id int, hashedPassword string) error
+	SetAdmin(ctx context.Context, id int, admin bool) error
+	Delete(ctx context.Context, id int) error
+	SetTOTP(ctx context.Context, id int, secret string, step int64, codeHashes []string) error
+	ClearTOTP(ctx context.Context, id int) error
+	AdvanceTOTPStep(ctx context.Context, id int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, id int, codeHash string) (bool, error)
+	RequestEmailChange(ctx context.Context, verification *EmailVerification) error
+	EmailVerification(ctx context.Context, tokenHash string) (EmailVerification, error)
+	SetEmail(ctx context.Context, id int, email string) error
+}
+
+// SessionStore keeps the device records of signed-in browser sessions,
+// which are found by their scs token. ForUser lists the most recently used
+// first. Touch reports false if there is no session with token, and Delete
+// of a missing session is not an error. CountActive counts the unexpired
+// sessions of all users.
+type SessionStore interface {
+	Insert(ctx context.Context, session *UserSession) error
+	Get(ctx context.Context, userID, id int) (UserSession, error)
+	ForUser(ctx context.Context, userID int) ([]UserSession, error)
+	Rename(ctx context.Context, oldToken, newToken string) error
+	Touch(ctx context.Context, token, ip, userAgent string, lastSeen time.Time) (bool, error)
+	Delete(ctx context.Context, token string) error
+	DeleteExpired(ctx context.Context, userID int) error
+	CountActive(ctx context.Context) (int64, error)
+}
+
+// TokenStore keeps API tokens, which are looked up by the hash of their
+// plaintext. ForUser lists the newest first. Delete only removes userID's
+// own tokens and returns ErrNoRecord if id isn't one of them.
+type TokenStore interface {
+	Insert(ctx context.Context, token *APIToken) error
+	GetByHash(ctx context.Context, hash string) (APIToken, error)
+	ForUser(ctx context.Context, userID int) ([]APIToken, error)
+	Touch(ctx context.Context, id int, lastUsed time.Time) error
+	Delete(ctx context.Context, userID, id int) error
+}
+
+// ExportStore keeps the data export jobs. ForUser lists the newest first,
+// and InFlight reports whether userID has one pending or running.
+//
+// Pending returns the IDs of the jobs a worker may claim: the pending ones
+// and those running since before staleBefore, whose worker is presumed
+// dead. Claim marks one of them running and reports false if it isn't
+// claimable, so only one worker gets each job. Complete and Fail end a job
+// and set when it expires, and Expired returns the IDs of the jobs that
+// have.
+type ExportStore interface {
+	Insert(ctx context.Context, job *DataExport) error
+	Get(ctx context.Context, id int) (DataExport, error)
+	ForUser(ctx context.Context, userID int) ([]DataExport, error)
+	InFlight(ctx context.Context, userID int) (bool, error)
+	Pending(ctx context.Context, staleBefore time.Time) ([]uint, error)
+	Claim(ctx context.Context, id int, staleBefore time.Time) (bool, error)
+	Complete(ctx context.Context, id int, expiresAt time.Time) error
+	Fail(ctx context.Context, id int, expiresAt time.Time) error
+	Expired(ctx context.Context) ([]uint, error)
+	Delete(ctx context.Context, id int) error
+}
+
+// ListStore manages the films on a user's watchlist and watched list. list
+// is ListWatchlist or ListWatchedlist.
+type ListStore interface {
+	Films(ctx context.Context, userID int, list string) ([]Film, error)
+	Add(ctx context.Context, userID, filmID int, list string) error
+	Remove(ctx context.Context, userID, filmID int, list string) error
+}
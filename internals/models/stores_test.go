@@ -0,0 +1,827 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testStores is one implementation of the stores, with a way to add films,
+// which none of the store interfaces can.
+type testStores struct {
+	films    FilmStore
+	credits  CreditStore
+	users    UserStore
+	lists    ListStore
+	sessions SessionStore
+	tokens   TokenStore
+	exports  ExportStore
+	addFilm  func(t *testing.T, film Film)
+}
+
+// storeImplementations returns a constructor for each implementation of the
+// stores. The contract tests run against all of them, so MemoryStore, which
+// the handler tests use, behaves like the database.
+func storeImplementations() map[string]func(t *testing.T) testStores {
+	return map[string]func(t *testing.T) testStores{
+		"memory": func(t *testing.T) testStores {
+			m := NewMemoryStore()
+			return testStores{
+				films:    m.Films(),
+				credits:  m.Credits(),
+				users:    m.Users(),
+				lists:    m.Lists(),
+				sessions: m.Sessions(),
+				tokens:   m.Tokens(),
+				exports:  m.Exports(),
+				addFilm:  func(t *testing.T, film Film) { m.AddFilm(film) },
+			}
+		},
+		"sqlite": func(t *testing.T) testStores {
+			db := newTestDB(t)
+			return testStores{
+				films:    &GormFilmStore{DB: db},
+				credits:  &GormCreditStore{DB: db},
+				users:    &GormUserStore{DB: db},
+				lists:    &GormListStore{DB: db},
+				sessions: &GormSessionStore{DB: db},
+				tokens:   &GormTokenStore{DB: db},
+				exports:  &GormExportStore{DB: db},
+				addFilm: func(t *testing.T, film Film) {
+					t.Helper()
+					err := db.Create(&film).Error
+					if err != nil {
+						t.Fatal(err)
+					}
+				},
+			}
+		},
+	}
+}
+
+// newTestDB returns a scratch SQLite database with foreign keys enforced, as
+// in production.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_pragma=foreign_keys(1)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	err = db.AutoMigrate(&User{}, &Genre{}, &Director{}, &Star{}, &Film{},
+		&RecoveryCode{}, &EmailVerification{}, &UserSession{}, &APIToken{}, &DataExport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// runStoreTests runs test against every implementation of the stores.
+func runStoreTests(t *testing.T, test func(t *testing.T, s testStores)) {
+	for name, newStores := range storeImplementations() {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStores(t))
+		})
+	}
+}
+
+func insertUser(t *testing.T, s testStores, userName string) User {
+	t.Helper()
+
+	user := User{UserName: userName, Email: userName + "@example.com", Password: "hash"}
+	err := s.users.Insert(context.Background(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// insertSession stores a session for user that expires in an hour.
+func insertSession(t *testing.T, s testStores, user User, token string, lastSeen time.Time) UserSession {
+	t.Helper()
+
+	session := UserSession{UserID: user.ID, Token: token, IP: "192.0.2.1", UserAgent: "Firefox", LastSeen: lastSeen, ExpiresAt: time.Now().Add(time.Hour)}
+	err := s.sessions.Insert(context.Background(), &session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func testFilm(id uint) Film {
+	return Film{
+		ID: id, Name: fmt.Sprintf("Film %d", id), Year: 2000, RunTime: 100, Rating: 7,
+		Genres:    []Genre{{ID: id, Name: fmt.Sprintf("Genre %d", id)}},
+		Directors: []Director{{ID: id, Name: fmt.Sprintf("Director %d", id)}},
+		Stars:     []Star{{ID: id, Name: fmt.Sprintf("Star %d", id)}},
+	}
+}
+
+func filmIDs(films []Film) []uint {
+	ids := []uint{}
+	for _, film := range films {
+		ids = append(ids, film.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestUserStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		alice := User{UserName: "alice", Email: " Alice@Example.com ", Password: "hash"}
+		err := s.users.Insert(ctx, &alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alice.ID == 0 || alice.Email != "alice@example.com" {
+			t.Errorf("got ID %d and email %q", alice.ID, alice.Email)
+		}
+
+		tests := []struct {
+			name string
+			user User
+			want error
+		}{
+			{"email", User{UserName: "alice2", Email: "ALICE@example.com", Password: "hash"}, ErrDuplicateEmail},
+			{"user name", User{UserName: "alice", Email: "alice2@example.com", Password: "hash"}, ErrDuplicateUsername},
+		}
+		for _, tt := range tests {
+			err := s.users.Insert(ctx, &tt.user)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("duplicate %s: got %v, want %v", tt.name, err, tt.want)
+			}
+		}
+
+		user, err := s.users.GetByEmail(ctx, "ALICE@example.com")
+		if err != nil || user.ID != alice.ID {
+			t.Errorf("GetByEmail: got %v, %v", user.ID, err)
+		}
+		taken, err := s.users.EmailTaken(ctx, "alice@EXAMPLE.com")
+		if err != nil || !taken {
+			t.Errorf("EmailTaken: got %t, %v", taken, err)
+		}
+		_, err = s.users.Get(ctx, int(alice.ID)+1)
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("Get of a missing user: got %v", err)
+		}
+		_, err = s.users.GetByEmail(ctx, "bob@example.com")
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("GetByEmail of a missing user: got %v", err)
+		}
+
+		bob := insertUser(t, s, "bob")
+		err = s.users.UpdateUserName(ctx, int(bob.ID), "alice")
+		if !errors.Is(err, ErrDuplicateUsername) {
+			t.Errorf("UpdateUserName to a taken name: got %v", err)
+		}
+		err = s.users.UpdateUserName(ctx, int(bob.ID), "robert")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		version := alice.AuthVersion
+		for _, update := range []func() error{
+			func() error { return s.users.UpdatePassword(ctx, int(alice.ID), "new hash") },
+			func() error { return s.users.SetAdmin(ctx, int(alice.ID), true) },
+		} {
+			err = update()
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err = s.users.Get(ctx, int(alice.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.AuthVersion != version+1 {
+				t.Errorf("got auth version %d, want %d", user.AuthVersion, version+1)
+			}
+			version = user.AuthVersion
+		}
+		if user.Password != "new hash" || !user.Admin {
+			t.Errorf("got %+v", user)
+		}
+
+		// Like an UPDATE, updating a missing user changes nothing.
+		err = s.users.SetAdmin(ctx, 1000, true)
+		if err != nil {
+			t.Errorf("SetAdmin of a missing user: got %v", err)
+		}
+	})
+}
+
+func TestUserStoreDelete(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		s.addFilm(t, testFilm(1))
+		alice := insertUser(t, s, "alice")
+		bob := insertUser(t, s, "bob")
+		for _, user := range []User{alice, bob} {
+			for list := range listTables {
+				err := s.lists.Add(ctx, int(user.ID), 1, list)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for _, user := range []User{alice, bob} {
+			insertSession(t, s, user, user.UserName+"-session", time.Now())
+			err := s.tokens.Insert(ctx, &APIToken{UserID: user.ID, Name: "laptop", TokenHash: user.UserName + "-hash", Scope: ScopeRead})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.exports.Insert(ctx, &DataExport{UserID: user.ID, Status: ExportPending})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := s.users.Delete(ctx, int(alice.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.users.Get(ctx, int(alice.ID))
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("Get after Delete: got %v", err)
+		}
+		err = s.users.Delete(ctx, int(alice.ID))
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("deleting twice: got %v", err)
+		}
+
+		// The deleted user's records go with them; other users' stay.
+		for _, user := range []User{alice, bob} {
+			want := 0
+			if user.ID == bob.ID {
+				want = 1
+			}
+			sessions, err := s.sessions.ForUser(ctx, int(user.ID))
+			if err != nil || len(sessions) != want {
+				t.Errorf("sessions of %s: got %v, %v", user.UserName, sessions, err)
+			}
+			tokens, err := s.tokens.ForUser(ctx, int(user.ID))
+			if err != nil || len(tokens) != want {
+				t.Errorf("tokens of %s: got %v, %v", user.UserName, tokens, err)
+			}
+			jobs, err := s.exports.ForUser(ctx, int(user.ID))
+			if err != nil || len(jobs) != want {
+				t.Errorf("exports of %s: got %v, %v", user.UserName, jobs, err)
+			}
+		}
+
+		// The deleted user's lists go, other users' stay, and the film
+		// counts no longer include them.
+		for list := range listTables {
+			films, err := s.lists.Films(ctx, int(alice.ID), list)
+			if err != nil || len(films) != 0 {
+				t.Errorf("%s of the deleted user: got %v, %v", list, filmIDs(films), err)
+			}
+			films, err = s.lists.Films(ctx, int(bob.ID), list)
+			if err != nil || !slices.Equal(filmIDs(films), []uint{1}) {
+				t.Errorf("%s of another user: got %v, %v", list, filmIDs(films), err)
+			}
+		}
+		film, err := s.films.Get(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts, err := s.films.WithCounts(ctx, int(bob.ID), []Film{film})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[0].WatchlistCount != 1 || counts[0].WatchedCount != 1 {
+			t.Errorf("got counts %+v", counts[0])
+		}
+	})
+}
+
+func TestUserStoreTwoFactor(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		alice := insertUser(t, s, "alice")
+		bob := insertUser(t, s, "bob")
+		id := int(alice.ID)
+
+		err := s.users.SetTOTP(ctx, id, "secret", 10, []string{"code1", "code2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.users.SetTOTP(ctx, int(bob.ID), "other", 10, []string{"bob1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := s.users.Get(ctx, id)
+		if err != nil || !user.TOTPEnabled || user.TOTPSecret != "secret" || user.TOTPStep != 10 {
+			t.Errorf("after SetTOTP got %+v, %v", user, err)
+		}
+
+		// Each step, and each recovery code, is only accepted once.
+		for _, tt := range []struct {
+			name string
+			use  func() (bool, error)
+			want bool
+		}{
+			{"the current step", func() (bool, error) { return s.users.AdvanceTOTPStep(ctx, id, 10) }, false},
+			{"a later step", func() (bool, error) { return s.users.AdvanceTOTPStep(ctx, id, 11) }, true},
+			{"the later step again", func() (bool, error) { return s.users.AdvanceTOTPStep(ctx, id, 11) }, false},
+			{"a recovery code", func() (bool, error) { return s.users.UseRecoveryCode(ctx, id, "code1") }, true},
+			{"the recovery code again", func() (bool, error) { return s.users.UseRecoveryCode(ctx, id, "code1") }, false},
+			{"another user's code", func() (bool, error) { return s.users.UseRecoveryCode(ctx, id, "bob1") }, false},
+		} {
+			ok, err := tt.use()
+			if err != nil || ok != tt.want {
+				t.Errorf("%s: got %t, %v, want %t", tt.name, ok, err, tt.want)
+			}
+		}
+
+		// Enrolling again replaces the codes.
+		err = s.users.SetTOTP(ctx, id, "secret", 20, []string{"code3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := s.users.UseRecoveryCode(ctx, id, "code2")
+		if err != nil || ok {
+			t.Errorf("a replaced code: got %t, %v", ok, err)
+		}
+
+		err = s.users.ClearTOTP(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err = s.users.Get(ctx, id)
+		if err != nil || user.TOTPEnabled || user.TOTPSecret != "" || user.TOTPStep != 0 {
+			t.Errorf("after ClearTOTP got %+v, %v", user, err)
+		}
+		ok, err = s.users.UseRecoveryCode(ctx, id, "code3")
+		if err != nil || ok {
+			t.Errorf("a code after ClearTOTP: got %t, %v", ok, err)
+		}
+		ok, err = s.users.UseRecoveryCode(ctx, int(bob.ID), "bob1")
+		if err != nil || !ok {
+			t.Errorf("another user's code after ClearTOTP: got %t, %v", ok, err)
+		}
+	})
+}
+
+func TestUserStoreEmailChange(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		alice := insertUser(t, s, "alice")
+		insertUser(t, s, "bob")
+		expires := time.Now().Add(time.Hour)
+
+		// Only the latest request counts.
+		for _, hash := range []string{"first", "second"} {
+			err := s.users.RequestEmailChange(ctx, &EmailVerification{UserID: alice.ID, Email: "new@example.com", TokenHash: hash, ExpiresAt: expires})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := s.users.EmailVerification(ctx, "first")
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("a replaced request: got %v", err)
+		}
+		verification, err := s.users.EmailVerification(ctx, "second")
+		if err != nil || verification.UserID != alice.ID || verification.Email != "new@example.com" {
+			t.Errorf("got %+v, %v", verification, err)
+		}
+
+		err = s.users.RequestEmailChange(ctx, &EmailVerification{UserID: alice.ID, Email: "new@example.com", TokenHash: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.users.EmailVerification(ctx, "expired")
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("an expired request: got %v", err)
+		}
+		err = s.users.RequestEmailChange(ctx, &EmailVerification{UserID: alice.ID + 100, Email: "new@example.com", TokenHash: "nobody", ExpiresAt: expires})
+		if !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("a request for a missing user: got %v", err)
+		}
+
+		err = s.users.SetEmail(ctx, int(alice.ID), "BOB@example.com")
+		if !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("SetEmail to a taken address: got %v", err)
+		}
+		err = s.users.RequestEmailChange(ctx, &EmailVerification{UserID: alice.ID, Email: "new@example.com", TokenHash: "third", ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.users.SetEmail(ctx, int(alice.ID), "New@Example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := s.users.Get(ctx, int(alice.ID))
+		if err != nil || user.Email != "new@example.com" {
+			t.Errorf("after SetEmail got %q, %v", user.Email, err)
+		}
+		_, err = s.users.EmailVerification(ctx, "third")
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("a request after SetEmail: got %v", err)
+		}
+	})
+}
+
+func TestListStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		s.addFilm(t, testFilm(1))
+		s.addFilm(t, testFilm(2))
+		alice := insertUser(t, s, "alice")
+		userID := int(alice.ID)
+
+		// Adding a film twice is not an error and lists it once.
+		for range 2 {
+			err := s.lists.Add(ctx, userID, 1, ListWatchlist)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := s.lists.Add(ctx, userID, 2, ListWatchlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		films, err := s.lists.Films(ctx, userID, ListWatchlist)
+		if err != nil || !slices.Equal(filmIDs(films), []uint{1, 2}) {
+			t.Errorf("watchlist: got %v, %v", filmIDs(films), err)
+		}
+		films, err = s.lists.Films(ctx, userID, ListWatchedlist)
+		if err != nil || films == nil || len(films) != 0 {
+			t.Errorf("watched list: got %#v, %v", films, err)
+		}
+
+		for _, tt := range []struct {
+			name           string
+			userID, filmID int
+		}{
+			{"film", userID, 3},
+			{"user", userID + 1, 1},
+		} {
+			err := s.lists.Add(ctx, tt.userID, tt.filmID, ListWatchlist)
+			if !errors.Is(err, ErrInvalidReference) {
+				t.Errorf("adding with an unknown %s: got %v, want ErrInvalidReference", tt.name, err)
+			}
+		}
+
+		err = s.lists.Remove(ctx, userID, 1, ListWatchlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Removing a film that isn't on the list is not an error.
+		err = s.lists.Remove(ctx, userID, 1, ListWatchlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		films, err = s.lists.Films(ctx, userID, ListWatchlist)
+		if err != nil || !slices.Equal(filmIDs(films), []uint{2}) {
+			t.Errorf("watchlist after Remove: got %v, %v", filmIDs(films), err)
+		}
+
+		for _, err := range []error{
+			s.lists.Add(ctx, userID, 1, "favourites"),
+			s.lists.Remove(ctx, userID, 1, "favourites"),
+		} {
+			if err == nil {
+				t.Error("an unknown list should be an error")
+			}
+		}
+		_, err = s.lists.Films(ctx, userID, "favourites")
+		if err == nil {
+			t.Error("an unknown list should be an error")
+		}
+	})
+}
+
+func TestCreditStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		s.addFilm(t, testFilm(1))
+		s.addFilm(t, testFilm(2))
+
+		genres, err := s.credits.Genres(ctx)
+		if err != nil || len(genres) != 2 || genres[0].Name != "Genre 1" {
+			t.Errorf("Genres: got %v, %v", genres, err)
+		}
+		genre, err := s.credits.Genre(ctx, 2)
+		if err != nil || genre.Name != "Genre 2" {
+			t.Errorf("Genre: got %v, %v", genre, err)
+		}
+		_, err = s.credits.Genre(ctx, 3)
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("Genre of a missing genre: got %v", err)
+		}
+
+		people, total, err := s.credits.People(ctx, RoleStar, "STAR", 1, 1)
+		want := []Person{{ID: 2, Role: RoleStar, Name: "Star 2"}}
+		if err != nil || total != 2 || !slices.Equal(people, want) {
+			t.Errorf("People: got %v, %d, %v", people, total, err)
+		}
+		people, total, err = s.credits.People(ctx, RoleDirector, "nobody", 0, 0)
+		if err != nil || total != 0 || people == nil || len(people) != 0 {
+			t.Errorf("People matching nobody: got %#v, %d, %v", people, total, err)
+		}
+
+		person, err := s.credits.Person(ctx, RoleDirector, 1)
+		if err != nil || person != (Person{ID: 1, Role: RoleDirector, Name: "Director 1"}) {
+			t.Errorf("Person: got %v, %v", person, err)
+		}
+		_, err = s.credits.Person(ctx, RoleDirector, 3)
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("Person of a missing person: got %v", err)
+		}
+		_, err = s.credits.Person(ctx, "writer", 1)
+		if err == nil {
+			t.Error("an unknown role should be an error")
+		}
+	})
+}
+
+func TestSessionStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		alice := insertUser(t, s, "alice")
+		bob := insertUser(t, s, "bob")
+		now := time.Now()
+		older := insertSession(t, s, alice, "older", now.Add(-time.Hour))
+		newer := insertSession(t, s, alice, "newer", now)
+		insertSession(t, s, bob, "bob", now)
+
+		sessions, err := s.sessions.ForUser(ctx, int(alice.ID))
+		if err != nil || len(sessions) != 2 || sessions[0].ID != newer.ID || sessions[1].ID != older.ID {
+			t.Errorf("ForUser: got %v, %v", sessions, err)
+		}
+		session, err := s.sessions.Get(ctx, int(alice.ID), int(older.ID))
+		if err != nil || session.Token != "older" {
+			t.Errorf("Get: got %+v, %v", session, err)
+		}
+		_, err = s.sessions.Get(ctx, int(bob.ID), int(older.ID))
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("Get of another user's session: got %v", err)
+		}
+		err = s.sessions.Insert(ctx, &UserSession{UserID: alice.ID + 100, Token: "nobody", ExpiresAt: now.Add(time.Hour), LastSeen: now})
+		if !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("Insert for a missing user: got %v", err)
+		}
+
+		err = s.sessions.Rename(ctx, "older", "renamed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			token string
+			want  bool
+		}{
+			{"renamed", true},
+			{"older", false},
+		} {
+			found, err := s.sessions.Touch(ctx, tt.token, "198.51.100.1", "Chrome", now.Add(time.Minute))
+			if err != nil || found != tt.want {
+				t.Errorf("Touch %s: got %t, %v, want %t", tt.token, found, err, tt.want)
+			}
+		}
+		session, err = s.sessions.Get(ctx, int(alice.ID), int(older.ID))
+		if err != nil || session.Token != "renamed" || session.IP != "198.51.100.1" || session.UserAgent != "Chrome" {
+			t.Errorf("after Rename and Touch got %+v, %v", session, err)
+		}
+
+		count, err := s.sessions.CountActive(ctx)
+		if err != nil || count != 3 {
+			t.Errorf("CountActive: got %d, %v", count, err)
+		}
+
+		expired := UserSession{UserID: alice.ID, Token: "expired", LastSeen: now, ExpiresAt: now.Add(-time.Minute)}
+		err = s.sessions.Insert(ctx, &expired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err = s.sessions.CountActive(ctx)
+		if err != nil || count != 3 {
+			t.Errorf("CountActive with an expired session: got %d, %v", count, err)
+		}
+		err = s.sessions.DeleteExpired(ctx, int(alice.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.sessions.Get(ctx, int(alice.ID), int(expired.ID))
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("Get after DeleteExpired: got %v", err)
+		}
+
+		// Deleting a session twice is not an error.
+		for range 2 {
+			err = s.sessions.Delete(ctx, "newer")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		sessions, err = s.sessions.ForUser(ctx, int(alice.ID))
+		if err != nil || len(sessions) != 1 || sessions[0].ID != older.ID {
+			t.Errorf("ForUser after Delete: got %v, %v", sessions, err)
+		}
+	})
+}
+
+func TestTokenStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		alice := insertUser(t, s, "alice")
+		bob := insertUser(t, s, "bob")
+
+		var tokens []APIToken
+		for _, name := range []string{"first", "second"} {
+			token := APIToken{UserID: alice.ID, Name: name, TokenHash: name + "-hash", Scope: ScopeRead}
+			err := s.tokens.Insert(ctx, &token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, token)
+		}
+		err := s.tokens.Insert(ctx, &APIToken{UserID: alice.ID + 100, Name: "nobody", TokenHash: "nobody-hash", Scope: ScopeRead})
+		if !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("Insert for a missing user: got %v", err)
+		}
+
+		list, err := s.tokens.ForUser(ctx, int(alice.ID))
+		if err != nil || len(list) != 2 || list[0].ID != tokens[1].ID {
+			t.Errorf("ForUser: got %v, %v", list, err)
+		}
+		token, err := s.tokens.GetByHash(ctx, "first-hash")
+		if err != nil || token.ID != tokens[0].ID || token.LastUsedAt != nil {
+			t.Errorf("GetByHash: got %+v, %v", token, err)
+		}
+		_, err = s.tokens.GetByHash(ctx, "unknown")
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("GetByHash of an unknown token: got %v", err)
+		}
+
+		err = s.tokens.Touch(ctx, int(token.ID), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err = s.tokens.GetByHash(ctx, "first-hash")
+		if err != nil || token.LastUsedAt == nil {
+			t.Errorf("after Touch got %+v, %v", token, err)
+		}
+
+		err = s.tokens.Delete(ctx, int(bob.ID), int(token.ID))
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("deleting another user's token: got %v", err)
+		}
+		err = s.tokens.Delete(ctx, int(alice.ID), int(token.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.tokens.GetByHash(ctx, "first-hash")
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("GetByHash after Delete: got %v", err)
+		}
+	})
+}
+
+func TestExportStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s testStores) {
+		ctx := context.Background()
+		alice := insertUser(t, s, "alice")
+		bob := insertUser(t, s, "bob")
+		now := time.Now()
+		stale := now.Add(-time.Hour)
+		staleBefore := now.Add(-time.Minute)
+
+		pending := DataExport{UserID: alice.ID, Status: ExportPending}
+		running := DataExport{UserID: alice.ID, Status: ExportRunning, StartedAt: &now}
+		abandoned := DataExport{UserID: bob.ID, Status: ExportRunning, StartedAt: &stale}
+		for _, job := range []*DataExport{&pending, &running, &abandoned} {
+			err := s.exports.Insert(ctx, job)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := s.exports.Insert(ctx, &DataExport{UserID: alice.ID + 100, Status: ExportPending})
+		if !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("Insert for a missing user: got %v", err)
+		}
+
+		jobs, err := s.exports.ForUser(ctx, int(alice.ID))
+		if err != nil || len(jobs) != 2 || jobs[0].ID != running.ID {
+			t.Errorf("ForUser: got %v, %v", jobs, err)
+		}
+		ids, err := s.exports.Pending(ctx, staleBefore)
+		if err != nil || !slices.Equal(ids, []uint{pending.ID, abandoned.ID}) {
+			t.Errorf("Pending: got %v, %v", ids, err)
+		}
+
+		// Only one claim on a job succeeds, and a job that is running
+		// isn't claimable until it goes stale.
+		for _, tt := range []struct {
+			name string
+			id   uint
+			want bool
+		}{
+			{"pending", pending.ID, true},
+			{"pending again", pending.ID, false},
+			{"running", running.ID, false},
+			{"abandoned", abandoned.ID, true},
+			{"missing", abandoned.ID + 100, false},
+		} {
+			claimed, err := s.exports.Claim(ctx, int(tt.id), staleBefore)
+			if err != nil || claimed != tt.want {
+				t.Errorf("Claim %s: got %t, %v, want %t", tt.name, claimed, err, tt.want)
+			}
+		}
+		job, err := s.exports.Get(ctx, int(pending.ID))
+		if err != nil || job.Status != ExportRunning || job.StartedAt == nil {
+			t.Errorf("a claimed job: got %+v, %v", job, err)
+		}
+
+		for _, user := range []User{alice, bob} {
+			inFlight, err := s.exports.InFlight(ctx, int(user.ID))
+			if err != nil || !inFlight {
+				t.Errorf("InFlight of %s: got %t, %v", user.UserName, inFlight, err)
+			}
+		}
+
+		err = s.exports.Complete(ctx, int(pending.ID), now.Add(-time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.exports.Fail(ctx, int(running.ID), now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		job, err = s.exports.Get(ctx, int(pending.ID))
+		if err != nil || job.Status != ExportReady || job.CompletedAt == nil || job.ExpiresAt == nil {
+			t.Errorf("a completed job: got %+v, %v", job, err)
+		}
+		job, err = s.exports.Get(ctx, int(running.ID))
+		if err != nil || job.Status != ExportFailed || job.CompletedAt != nil || job.ExpiresAt == nil {
+			t.Errorf("a failed job: got %+v, %v", job, err)
+		}
+		inFlight, err := s.exports.InFlight(ctx, int(alice.ID))
+		if err != nil || inFlight {
+			t.Errorf("InFlight after finishing: got %t, %v", inFlight, err)
+		}
+
+		ids, err = s.exports.Expired(ctx)
+		if err != nil || !slices.Equal(ids, []uint{pending.ID}) {
+			t.Errorf("Expired: got %v, %v", ids, err)
+		}
+		err = s.exports.Delete(ctx, int(pending.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.exports.Get(ctx, int(pending.ID))
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("Get after Delete: got %v", err)
+		}
+	})
+}
+
+func TestTranslateError(t *testing.T) {
+	other := errors.New("something else")
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"nil", nil, nil},
+		{"not found", fmt.Errorf("get: %w", gorm.ErrRecordNotFound), ErrNoRecord},
+		{"sqlite email", errors.New("constraint failed: UNIQUE constraint failed: users.email (2067)"), ErrDuplicateEmail},
+		{"sqlite user name", errors.New("constraint failed: UNIQUE constraint failed: users.user_name (2067)"), ErrDuplicateUsername},
+		{"sqlite foreign key", errors.New("constraint failed: FOREIGN KEY constraint failed (787)"), ErrInvalidReference},
+		{"postgres email", &pgconn.PgError{Code: pgErrUniqueViolation, ConstraintName: "idx_users_email"}, ErrDuplicateEmail},
+		{"postgres user name", &pgconn.PgError{Code: pgErrUniqueViolation, ConstraintName: "idx_users_user_name"}, ErrDuplicateUsername},
+		{"postgres foreign key", &pgconn.PgError{Code: pgErrForeignKeyViolation, ConstraintName: "fk_user_watchlist_film"}, ErrInvalidReference},
+		{"mysql email", &mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry 'a@example.com' for key 'users.idx_users_email'"}, ErrDuplicateEmail},
+		{"mysql foreign key", &mysql.MySQLError{Number: mysqlErrNoReferencedRow, Message: "Cannot add or update a child row"}, ErrInvalidReference},
+		{"other", other, other},
+	}
+	for _, tt := range tests {
+		if got := TranslateError(tt.err); !errors.Is(got, tt.want) || (tt.want == nil && got != nil) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A duplicate the model layer doesn't know comes back unchanged.
+	pgErr := &pgconn.PgError{Code: pgErrUniqueViolation, ConstraintName: "film_genres_pkey"}
+	if got := TranslateError(pgErr); got != error(pgErr) {
+		t.Errorf("unknown duplicate: got %v", got)
+	}
+}
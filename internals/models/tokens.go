@@ -0,0 +1,67 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Scopes an API token can be granted. A write token can also read.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// APITokenPrefix marks a string as one of our tokens, which makes leaked
+// tokens easy to spot in logs and by secret scanners.
+const APITokenPrefix = "m4u_"
+
+type APIToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"-"`
+	User       User       `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name       string     `gorm:"size:100;not null" json:"name"`
+	TokenHash  string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Scope      string     `gorm:"size:16;not null" json:"scope"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Created    time.Time  `gorm:"autoCreateTime" json:"created"`
+}
+
+// Expired reports whether the token can no longer be used at time t.
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// Allows reports whether the token grants scope.
+func (t *APIToken) Allows(scope string) bool {
+	return t.Scope == scope || t.Scope == ScopeWrite
+}
+
+// GenerateAPIToken returns a new plaintext token and the hash it is stored
+// under. The plaintext is shown to the user once and never persisted.
+func GenerateAPIToken() (string, string, error) {
+	return GenerateToken(APITokenPrefix)
+}
+
+// GenerateToken returns a random 256-bit bearer secret starting with prefix,
+// along with the hash it should be stored under.
+func GenerateToken(prefix string) (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := prefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the stored form of a plaintext token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,174 @@
+// Package ratelimit limits how often a caller may make a request with token
+// buckets. A bucket holds Burst tokens and refills at Limit tokens per Period;
+// each request takes one. Buckets are kept as the time they will next be full
+// (the generic cell rate algorithm), so a backend stores a single timestamp
+// per key and can update it with a compare-and-set, which suits shared stores
+// as well as memory.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"movies4u.net/internals/models"
+)
+
+// Policy describes one kind of bucket. The zero Policy means no limit.
+type Policy struct {
+	Limit  int           // requests allowed per Period on average
+	Period time.Duration // time taken to earn Limit tokens back
+	Burst  int           // size of the bucket, Limit if zero
+}
+
+// Unlimited reports whether p lets every request through.
+func (p Policy) Unlimited() bool {
+	return p.Limit <= 0 || p.Period <= 0
+}
+
+func (p Policy) burst() int {
+	if p.Burst > 0 {
+		return p.Burst
+	}
+	return p.Limit
+}
+
+// interval is the time it takes to earn back one token.
+func (p Policy) interval() time.Duration {
+	return p.Period / time.Duration(p.Limit)
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed    bool
+	Limit      int           // size of the bucket
+	Remaining  int           // tokens left after this request
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until a token is available, zero if Allowed
+}
+
+// take works out the outcome of a request at now for a bucket that is next
+// full at full, which is zero for a new bucket, and the new full time if
+// the request is allowed.
+func (p Policy) take(full, now time.Time) (time.Time, Result) {
+	interval := p.interval()
+	capacity := interval * time.Duration(p.burst())
+
+	if full.Before(now) {
+		full = now
+	}
+	next := full.Add(interval)
+	res := Result{Limit: p.burst()}
+
+	if next.Sub(now) > capacity {
+		res.Reset = full.Sub(now)
+		res.RetryAfter = next.Sub(now) - capacity
+		return full, res
+	}
+
+	res.Allowed = true
+	res.Reset = next.Sub(now)
+	res.Remaining = int((capacity - res.Reset) / interval)
+	return next, res
+}
+
+// Backend keeps buckets. Take takes a token from the bucket at key,
+// following p. Purge drops buckets that are full by now, which behave like
+// new ones; backends whose store expires keys by itself needn't do anything.
+type Backend interface {
+	Take(ctx context.Context, key string, p Policy, now time.Time) (Result, error)
+	Purge(ctx context.Context, now time.Time) (int64, error)
+}
+
+// Memory is a Backend for a single instance.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]time.Time // key to when the bucket is next full
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]time.Time{}}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, p Policy, now time.Time) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	full, res := p.take(m.buckets[key], now)
+	m.buckets[key] = full
+	return res, nil
+}
+
+func (m *Memory) Purge(ctx context.Context, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	for key, full := range m.buckets {
+		if !full.After(now) {
+			delete(m.buckets, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Store is a Backend in the database, shared by every instance.
+type Store struct {
+	DB *gorm.DB
+}
+
+// errContended means other instances kept changing a bucket while Take
+// tried to update it.
+var errContended = errors.New("ratelimit: bucket contended")
+
+// storeAttempts is how often Take retries a bucket another instance
+// changed under it.
+const storeAttempts = 5
+
+func (s *Store) Take(ctx context.Context, key string, p Policy, now time.Time) (Result, error) {
+	db := s.DB.WithContext(ctx)
+
+	for range storeAttempts {
+		var bucket models.RateLimit
+		result := db.Where("bucket = ?", key).Limit(1).Find(&bucket)
+		if result.Error != nil {
+			return Result{}, result.Error
+		}
+		found := result.RowsAffected > 0
+
+		var full time.Time
+		if found {
+			full = time.Unix(0, bucket.FullAt)
+		}
+		next, res := p.take(full, now)
+		if !res.Allowed {
+			return res, nil
+		}
+
+		// Only one of several instances taking a token at once wins; the
+		// others see nothing change and try again.
+		if found {
+			result = db.Model(&models.RateLimit{}).Where("bucket = ? AND full_at = ?", key, bucket.FullAt).
+				Update("full_at", next.UnixNano())
+		} else {
+			result = db.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&models.RateLimit{Bucket: key, FullAt: next.UnixNano()})
+		}
+		if result.Error != nil {
+			return Result{}, result.Error
+		}
+		if result.RowsAffected > 0 {
+			return res, nil
+		}
+	}
+	return Result{}, errContended
+}
+
+func (s *Store) Purge(ctx context.Context, now time.Time) (int64, error) {
+	result := s.DB.WithContext(ctx).Where("full_at <= ?", now.UnixNano()).Delete(&models.RateLimit{})
+	return result.RowsAffected, result.Error
+}
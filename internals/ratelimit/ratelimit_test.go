@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"movies4u.net/internals/models"
+)
+
+func testBackend(t *testing.T, b Backend) {
+	ctx := context.Background()
+	now := time.Now()
+	policy := Policy{Limit: 60, Period: time.Minute, Burst: 3}
+
+	take := func(key string) Result {
+		t.Helper()
+		res, err := b.Take(ctx, key, policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for want := 2; want >= 0; want-- {
+		res := take("a")
+		if !res.Allowed || res.Remaining != want || res.Limit != 3 {
+			t.Fatalf("got %+v, want %d remaining", res, want)
+		}
+	}
+	if res := take("a"); res.Allowed || res.RetryAfter != time.Second || res.Reset != 3*time.Second {
+		t.Errorf("over the burst got %+v", res)
+	}
+	if res := take("b"); !res.Allowed {
+		t.Error("buckets should be separate")
+	}
+
+	// One token comes back every second.
+	now = now.Add(1500 * time.Millisecond)
+	if res := take("a"); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("after refilling got %+v", res)
+	}
+	if res := take("a"); res.Allowed || res.RetryAfter != 500*time.Millisecond {
+		t.Errorf("got %+v", res)
+	}
+
+	now = now.Add(time.Hour)
+	purged, err := b.Purge(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("purged %d buckets, want 2", purged)
+	}
+	if res := take("a"); !res.Allowed || res.Remaining != 2 {
+		t.Errorf("after purging got %+v", res)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testBackend(t, NewMemory())
+}
+
+func TestStore(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	err = db.AutoMigrate(&models.RateLimit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, &Store{DB: db})
+}
+
+func TestUnlimited(t *testing.T) {
+	for _, p := range []Policy{{}, {Limit: 10}, {Period: time.Second}} {
+		if !p.Unlimited() {
+			t.Errorf("%+v should be unlimited", p)
+		}
+	}
+	if (Policy{Limit: 1, Period: time.Second}).Unlimited() {
+		t.Error("a limit and period make a limit")
+	}
+}
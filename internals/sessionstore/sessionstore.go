@@ -0,0 +1,82 @@
+// Package sessionstore keeps scs sessions in the sessions table through
+// gorm, so they work on every database the application supports.
+package sessionstore
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// session is a row of the sessions table created by migration 1.
+type session struct {
+	Token  string `gorm:"primaryKey"`
+	Data   []byte
+	Expiry time.Time
+}
+
+func (session) TableName() string {
+	return "sessions"
+}
+
+// Store implements scs.Store and scs.CtxStore.
+type Store struct {
+	DB *gorm.DB
+}
+
+// New returns a Store that keeps sessions in db.
+func New(db *gorm.DB) *Store {
+	return &Store{DB: db}
+}
+
+// FindCtx returns the data for an unexpired session token. found is false if
+// the token doesn't exist or has expired.
+func (s *Store) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	// Only data is read back: SQLite's driver can't scan the timestamp(6)
+	// expiry column into a time.Time.
+	var row session
+	result := s.DB.WithContext(ctx).Select("data").Where("token = ? AND expiry > ?", token, time.Now().UTC()).Limit(1).Find(&row)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	return row.Data, result.RowsAffected == 1, nil
+}
+
+// CommitCtx adds the session token and data to the store, replacing any
+// existing data for the token.
+func (s *Store) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	row := session{Token: token, Data: b, Expiry: expiry.UTC()}
+	return s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "token"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "expiry"}),
+	}).Create(&row).Error
+}
+
+// DeleteCtx removes the session token. Deleting a token that doesn't exist
+// is not an error.
+func (s *Store) DeleteCtx(ctx context.Context, token string) error {
+	return s.DB.WithContext(ctx).Where("token = ?", token).Delete(&session{}).Error
+}
+
+// Find is FindCtx without a context.
+func (s *Store) Find(token string) ([]byte, bool, error) {
+	return s.FindCtx(context.Background(), token)
+}
+
+// Commit is CommitCtx without a context.
+func (s *Store) Commit(token string, b []byte, expiry time.Time) error {
+	return s.CommitCtx(context.Background(), token, b, expiry)
+}
+
+// Delete is DeleteCtx without a context.
+func (s *Store) Delete(token string) error {
+	return s.DeleteCtx(context.Background(), token)
+}
+
+// Purge deletes expired sessions and returns how many it removed.
+func (s *Store) Purge(ctx context.Context) (int64, error) {
+	result := s.DB.WithContext(ctx).Where("expiry <= ?", time.Now().UTC()).Delete(&session{})
+	return result.RowsAffected, result.Error
+}
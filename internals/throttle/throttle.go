@@ -0,0 +1,338 @@
+package throttle
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"movies4u.net/internals/models"
+)
+
+// Policy describes how failed attempts against one kind of subject are
+// slowed down and eventually locked out.
+type Policy struct {
+	FreeAttempts int           // failures tolerated before any delay applies
+	BaseDelay    time.Duration // delay after the first throttled failure, doubled for each one after
+	MaxDelay     time.Duration
+	LockoutAfter int // failures that trigger a lockout, 0 disables lockouts
+	LockoutFor   time.Duration
+	Window       time.Duration // failures older than this are forgotten
+}
+
+var DefaultAccountPolicy = Policy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	LockoutAfter: 10,
+	LockoutFor:   15 * time.Minute,
+	Window:       24 * time.Hour,
+}
+
+var DefaultIPPolicy = Policy{
+	FreeAttempts: 10,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	LockoutAfter: 100,
+	LockoutFor:   time.Hour,
+	Window:       24 * time.Hour,
+}
+
+// Throttle counts failed logins in Backend. With Store the counters survive
+// restarts and are shared by every server instance.
+type Throttle struct {
+	Backend Backend
+	Account Policy
+	IP      Policy
+	Now     func() time.Time // the clock, time.Now if nil
+}
+
+func (t *Throttle) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return time.Now()
+}
+
+// Result reports the outcome of recording a failed attempt.
+type Result struct {
+	AccountLocked bool // the account was locked by this failure
+	IPLocked      bool // the client address was locked by this failure
+}
+
+func AccountSubject(email string) string {
+	return "account:" + models.NormalizeEmail(email)
+}
+
+func IPSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns how long the caller must wait before another login attempt
+// for email from ip is allowed. A zero duration means the attempt may go
+// ahead.
+func (t *Throttle) Check(email, ip string) (time.Duration, error) {
+	now := t.now()
+
+	accountWait, err := t.wait(AccountSubject(email), t.Account, now)
+	if err != nil {
+		return 0, err
+	}
+
+	ipWait, err := t.wait(IPSubject(ip), t.IP, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return max(accountWait, ipWait), nil
+}
+
+// Fail records a failed attempt for both the account and the client address.
+func (t *Throttle) Fail(email, ip string) (Result, error) {
+	var res Result
+	var err error
+
+	now := t.now()
+
+	res.AccountLocked, err = t.fail(AccountSubject(email), t.Account, now)
+	if err != nil {
+		return res, err
+	}
+
+	res.IPLocked, err = t.fail(IPSubject(ip), t.IP, now)
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// Reset clears the failure count for an account after a successful login.
+// The client address is left alone so one valid account can't be used to
+// launder attempts against others.
+func (t *Throttle) Reset(email string) error {
+	return t.Unlock(AccountSubject(email))
+}
+
+// Unlock removes all tracked failures and any lockout for subject.
+func (t *Throttle) Unlock(subject string) error {
+	return t.Backend.Delete(context.Background(), subject)
+}
+
+// Locked returns every subject that is currently locked out, the longest
+// lock first.
+func (t *Throttle) Locked() ([]models.LoginAttempt, error) {
+	return t.Backend.Locked(context.Background(), t.now())
+}
+
+// Purge deletes the records of subjects that are no longer locked and whose
+// last failure is older than their policy's window, which count for nothing
+// any more. It returns how many it deleted.
+func (t *Throttle) Purge(ctx context.Context, now time.Time) (int64, error) {
+	var purged int64
+	for prefix, p := range map[string]Policy{AccountSubject(""): t.Account, IPSubject(""): t.IP} {
+		n, err := t.Backend.Purge(ctx, prefix, now.Add(-p.Window), now)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (t *Throttle) wait(subject string, p Policy, now time.Time) (time.Duration, error) {
+	attempt, err := t.Backend.Get(context.Background(), subject)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.wait(attempt, now), nil
+}
+
+func (t *Throttle) fail(subject string, p Policy, now time.Time) (bool, error) {
+	ctx := context.Background()
+
+	err := t.Backend.Fail(ctx, subject, now, now.Add(-p.Window))
+	if err != nil {
+		return false, err
+	}
+
+	if p.LockoutAfter == 0 {
+		return false, nil
+	}
+
+	return t.Backend.Lock(ctx, subject, p.LockoutAfter, now, now.Add(p.LockoutFor))
+}
+
+func (p Policy) wait(attempt models.LoginAttempt, now time.Time) time.Duration {
+	if attempt.LockedUntil.After(now) {
+		return attempt.LockedUntil.Sub(now)
+	}
+
+	if now.Sub(attempt.LastFailure) > p.Window || attempt.Failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < attempt.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+
+	return max(attempt.LastFailure.Add(delay).Sub(now), 0)
+}
+
+// Backend keeps the failure counts. Get returns the zero LoginAttempt for a
+// subject with no failures. Fail counts a failure at now, starting the count
+// over if the last one was before forgetBefore. Lock locks subject until
+// until and clears its count if it has at least failures failures and isn't
+// locked at now, and reports whether it did, so that of several instances
+// only one reports each lockout. Locked returns the subjects locked at now,
+// the longest lock first, and Purge deletes the subjects starting with
+// prefix that are unlocked at now and last failed before forgetBefore.
+type Backend interface {
+	Get(ctx context.Context, subject string) (models.LoginAttempt, error)
+	Fail(ctx context.Context, subject string, now, forgetBefore time.Time) error
+	Lock(ctx context.Context, subject string, failures int, now, until time.Time) (bool, error)
+	Delete(ctx context.Context, subject string) error
+	Locked(ctx context.Context, now time.Time) ([]models.LoginAttempt, error)
+	Purge(ctx context.Context, prefix string, forgetBefore, now time.Time) (int64, error)
+}
+
+// Memory is a Backend for a single instance.
+type Memory struct {
+	mu       sync.Mutex
+	attempts map[string]models.LoginAttempt
+}
+
+func NewMemory() *Memory {
+	return &Memory{attempts: map[string]models.LoginAttempt{}}
+}
+
+func (m *Memory) Get(ctx context.Context, subject string) (models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.attempts[subject], nil
+}
+
+func (m *Memory) Fail(ctx context.Context, subject string, now, forgetBefore time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempt, ok := m.attempts[subject]
+	if !ok || attempt.LastFailure.Before(forgetBefore) {
+		attempt.Failures = 0
+	}
+	attempt.Subject = subject
+	attempt.Failures++
+	attempt.LastFailure = now
+	m.attempts[subject] = attempt
+	return nil
+}
+
+func (m *Memory) Lock(ctx context.Context, subject string, failures int, now, until time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempt, ok := m.attempts[subject]
+	if !ok || attempt.Failures < failures || !attempt.LockedUntil.Before(now) {
+		return false, nil
+	}
+	attempt.Failures = 0
+	attempt.LockedUntil = until
+	m.attempts[subject] = attempt
+	return true, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, subject)
+	return nil
+}
+
+func (m *Memory) Locked(ctx context.Context, now time.Time) ([]models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var locked []models.LoginAttempt
+	for _, attempt := range m.attempts {
+		if attempt.LockedUntil.After(now) {
+			locked = append(locked, attempt)
+		}
+	}
+	slices.SortFunc(locked, func(a, b models.LoginAttempt) int {
+		return b.LockedUntil.Compare(a.LockedUntil)
+	})
+	return locked, nil
+}
+
+func (m *Memory) Purge(ctx context.Context, prefix string, forgetBefore, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	for subject, attempt := range m.attempts {
+		if strings.HasPrefix(subject, prefix) && attempt.LastFailure.Before(forgetBefore) && !attempt.LockedUntil.After(now) {
+			delete(m.attempts, subject)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Store is a Backend in the database, shared by every instance.
+type Store struct {
+	DB *gorm.DB
+}
+
+func (s *Store) Get(ctx context.Context, subject string) (models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	err := s.DB.WithContext(ctx).Where("subject = ?", subject).Limit(1).Find(&attempt).Error
+	return attempt, err
+}
+
+// Fail increments the count in a single upsert so concurrent failures on
+// different instances are all counted.
+func (s *Store) Fail(ctx context.Context, subject string, now, forgetBefore time.Time) error {
+	attempt := models.LoginAttempt{Subject: subject, Failures: 1, LastFailure: now}
+	return s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "subject"}},
+		DoUpdates: []clause.Assignment{
+			{Column: clause.Column{Name: "failures"}, Value: gorm.Expr("CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END", forgetBefore)},
+			{Column: clause.Column{Name: "last_failure"}, Value: now},
+		},
+	}).Create(&attempt).Error
+}
+
+func (s *Store) Lock(ctx context.Context, subject string, failures int, now, until time.Time) (bool, error) {
+	result := s.DB.WithContext(ctx).Model(&models.LoginAttempt{}).
+		Where("subject = ? AND failures >= ? AND locked_until < ?", subject, failures, now).
+		Updates(map[string]any{"failures": 0, "locked_until": until})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (s *Store) Delete(ctx context.Context, subject string) error {
+	return s.DB.WithContext(ctx).Where("subject = ?", subject).Delete(&models.LoginAttempt{}).Error
+}
+
+func (s *Store) Locked(ctx context.Context, now time.Time) ([]models.LoginAttempt, error) {
+	var attempts []models.LoginAttempt
+	err := s.DB.WithContext(ctx).Where("locked_until > ?", now).Order("locked_until DESC").Find(&attempts).Error
+	return attempts, err
+}
+
+func (s *Store) Purge(ctx context.Context, prefix string, forgetBefore, now time.Time) (int64, error) {
+	result := s.DB.WithContext(ctx).
+		Where("subject LIKE ? AND last_failure < ? AND locked_until <= ?", prefix+"%", forgetBefore, now).
+		Delete(&models.LoginAttempt{})
+	return result.RowsAffected, result.Error
+}
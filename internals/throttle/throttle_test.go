@@ -0,0 +1,254 @@
+package throttle
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"movies4u.net/internals/models"
+)
+
+var testPolicy = Policy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     8 * time.Second,
+	LockoutAfter: 6,
+	LockoutFor:   15 * time.Minute,
+	Window:       time.Hour,
+}
+
+func TestPolicyWait(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		failures    int
+		lastFailure time.Duration // before now
+		lockedUntil time.Duration // after now
+		want        time.Duration
+	}{
+		{name: "none", want: 0},
+		{name: "free attempts", failures: 3, want: 0},
+		{name: "first delay", failures: 4, want: time.Second},
+		{name: "doubles", failures: 5, want: 2 * time.Second},
+		{name: "doubles again", failures: 6, want: 4 * time.Second},
+		{name: "reaches the cap", failures: 7, want: 8 * time.Second},
+		{name: "stays at the cap", failures: 30, want: 8 * time.Second},
+		{name: "partly waited", failures: 5, lastFailure: 1500 * time.Millisecond, want: 500 * time.Millisecond},
+		{name: "fully waited", failures: 5, lastFailure: 3 * time.Second, want: 0},
+		{name: "outside the window", failures: 30, lastFailure: 2 * time.Hour, want: 0},
+		{name: "locked", lockedUntil: 5 * time.Minute, want: 5 * time.Minute},
+		{name: "lock outlasts the window", lastFailure: 2 * time.Hour, lockedUntil: time.Minute, want: time.Minute},
+		{name: "lock expired", failures: 2, lockedUntil: -time.Second, want: 0},
+	}
+	for _, tt := range tests {
+		attempt := models.LoginAttempt{
+			Failures:    tt.failures,
+			LastFailure: now.Add(-tt.lastFailure),
+		}
+		if tt.lockedUntil != 0 {
+			attempt.LockedUntil = now.Add(tt.lockedUntil)
+		}
+		if got := testPolicy.wait(attempt, now); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// runBackendTests runs test against a Throttle on each Backend, in memory
+// and on a scratch SQLite database, whose clock is *now.
+func runBackendTests(t *testing.T, test func(t *testing.T, th *Throttle, now *time.Time)) {
+	backends := map[string]func(t *testing.T) Backend{
+		"memory": func(t *testing.T) Backend { return NewMemory() },
+		"sqlite": func(t *testing.T) Backend {
+			db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sqlDB, err := db.DB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { sqlDB.Close() })
+
+			err = db.AutoMigrate(&models.LoginAttempt{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &Store{DB: db}
+		},
+	}
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+			ipPolicy := testPolicy
+			ipPolicy.LockoutAfter = 0
+			th := &Throttle{Backend: newBackend(t), Account: testPolicy, IP: ipPolicy, Now: func() time.Time { return now }}
+			test(t, th, &now)
+		})
+	}
+}
+
+func TestLockout(t *testing.T) {
+	runBackendTests(t, func(t *testing.T, th *Throttle, now *time.Time) {
+		check := func(want time.Duration) {
+			t.Helper()
+			wait, err := th.Check("alice@example.com", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wait != want {
+				t.Errorf("got wait %s, want %s", wait, want)
+			}
+		}
+		fail := func(wantLocked bool) {
+			t.Helper()
+			res, err := th.Fail("Alice@Example.com", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.AccountLocked != wantLocked || res.IPLocked {
+				t.Errorf("got %+v, want account locked %t", res, wantLocked)
+			}
+		}
+
+		for range testPolicy.LockoutAfter - 1 {
+			fail(false)
+		}
+		check(2 * time.Second)
+
+		// Only the failure that reaches the threshold reports the lockout.
+		fail(true)
+		check(testPolicy.LockoutFor)
+		fail(false)
+		check(testPolicy.LockoutFor)
+
+		locked, err := th.Locked()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locked) != 1 || locked[0].Subject != "account:alice@example.com" {
+			t.Errorf("got locked %+v", locked)
+		}
+
+		// The lockout reset the count, so once it expires the account starts
+		// over, though the address keeps its own count.
+		*now = now.Add(testPolicy.LockoutFor)
+		check(0)
+		fail(false)
+		check(8 * time.Second)
+
+		err = th.Reset("alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait, err := th.Check("bob@example.com", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 8*time.Second {
+			t.Errorf("resetting an account shouldn't clear its address, got wait %s", wait)
+		}
+	})
+}
+
+func TestUnlock(t *testing.T) {
+	runBackendTests(t, func(t *testing.T, th *Throttle, now *time.Time) {
+		for range testPolicy.LockoutAfter {
+			_, err := th.Fail("alice@example.com", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := th.Unlock(AccountSubject("alice@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		locked, err := th.Locked()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locked) != 0 {
+			t.Errorf("still locked: %+v", locked)
+		}
+	})
+}
+
+func TestWindow(t *testing.T) {
+	runBackendTests(t, func(t *testing.T, th *Throttle, now *time.Time) {
+		for range testPolicy.LockoutAfter - 1 {
+			_, err := th.Fail("alice@example.com", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Failures older than the window are forgotten, so this one doesn't
+		// lock the account.
+		*now = now.Add(testPolicy.Window + time.Second)
+		res, err := th.Fail("alice@example.com", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.AccountLocked {
+			t.Error("old failures should have been forgotten")
+		}
+	})
+}
+
+func TestPurge(t *testing.T) {
+	runBackendTests(t, func(t *testing.T, th *Throttle, now *time.Time) {
+		th.Account.LockoutFor = 3 * time.Hour
+		th.IP.Window = 2 * time.Hour
+
+		for range testPolicy.LockoutAfter {
+			_, err := th.Fail("locked@example.com", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := th.Fail("stale@example.com", "192.0.2.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		*now = now.Add(testPolicy.Window - time.Minute)
+		_, err = th.Fail("recent@example.com", "192.0.2.3")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Past the account window the stale account goes, but the locked one
+		// stays until its lock ends, and the addresses have a longer window.
+		*now = now.Add(2 * time.Minute)
+		all := []string{"account:locked@example.com", "account:recent@example.com", "account:stale@example.com", "ip:192.0.2.1", "ip:192.0.2.2", "ip:192.0.2.3"}
+		purge := func(want ...string) {
+			t.Helper()
+			purged, err := th.Purge(context.Background(), *now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var subjects []string
+			for _, subject := range all {
+				attempt, err := th.Backend.Get(context.Background(), subject)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if attempt.Subject != "" {
+					subjects = append(subjects, subject)
+				}
+			}
+			if !slices.Equal(subjects, want) {
+				t.Fatalf("purged %d, left %v, want %v", purged, subjects, want)
+			}
+		}
+		purge("account:locked@example.com", "account:recent@example.com", "ip:192.0.2.1", "ip:192.0.2.2", "ip:192.0.2.3")
+
+		*now = now.Add(2 * time.Hour)
+		purge()
+	})
+}
@@ -0,0 +1,100 @@
+package totp
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from RFC 6238 appendix B, "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerateCode(t *testing.T) {
+	// The RFC's codes have eight digits; ours are their last six.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := GenerateCode(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("at %d got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if _, err := GenerateCode("not base32!", 1); err == nil {
+		t.Error("a bad secret should fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	for offset := int64(-2); offset <= 2; offset++ {
+		code, err := GenerateCode(rfcSecret, current+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Validate(rfcSecret, code, now)
+		wantOK := offset >= -Skew && offset <= Skew
+		if ok != wantOK {
+			t.Errorf("code %d steps away: got %t, want %t", offset, ok, wantOK)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code %d steps away matched step %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	for _, code := range []string{" 050 471 ", "050471"} {
+		if step, ok := Validate(rfcSecret, code, now); !ok || step != current {
+			t.Errorf("%q: got %d, %t", code, step, ok)
+		}
+	}
+	for _, code := range []string{"", "05047", "0504711", "050472"} {
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("%q should be rejected", code)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("got %d codes", len(codes))
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{4}(-[a-z2-7]{4}){3}$`)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("%q isn't formatted as a recovery code", code)
+		}
+		if seen[code] {
+			t.Errorf("%q generated twice", code)
+		}
+		seen[code] = true
+
+		// Users may type codes in capitals or paste them with whitespace.
+		if HashRecoveryCode(" "+strings.ToUpper(code)+"\n") != HashRecoveryCode(code) {
+			t.Errorf("%q should hash the same however it is typed", code)
+		}
+	}
+	if HashRecoveryCode(codes[0]) == HashRecoveryCode(codes[1]) {
+		t.Error("different codes should hash differently")
+	}
+}
@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const spanKey = "tracing:span"
+
+// GormPlugin records a span for every statement run through a gorm.DB, as a
+// child of the span in the statement's context. Use db.WithContext to link
+// queries to the request that made them.
+type GormPlugin struct {
+	// System is the database system reported on spans, such as "mysql".
+	System string
+}
+
+func (p GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (p GormPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("*").Register("tracing:before_create", p.start("create")),
+		cb.Create().After("*").Register("tracing:after_create", end),
+		cb.Query().Before("*").Register("tracing:before_query", p.start("query")),
+		cb.Query().After("*").Register("tracing:after_query", end),
+		cb.Update().Before("*").Register("tracing:before_update", p.start("update")),
+		cb.Update().After("*").Register("tracing:after_update", end),
+		cb.Delete().Before("*").Register("tracing:before_delete", p.start("delete")),
+		cb.Delete().After("*").Register("tracing:after_delete", end),
+		cb.Row().Before("*").Register("tracing:before_row", p.start("row")),
+		cb.Row().After("*").Register("tracing:after_row", end),
+		cb.Raw().Before("*").Register("tracing:before_raw", p.start("raw")),
+		cb.Raw().After("*").Register("tracing:after_raw", end),
+	)
+}
+
+func (p GormPlugin) start(operation string) func(*gorm.DB) {
+	tracer := Tracer("gorm.io/gorm")
+
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		_, span := tracer.Start(ctx, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemKey.String(p.System),
+				semconv.DBOperationName(operation),
+			),
+		)
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+func end(db *gorm.DB) {
+	v, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	defer span.End()
+
+	// The SQL holds placeholders, not the bound values.
+	span.SetAttributes(
+		semconv.DBQueryText(db.Statement.SQL.String()),
+		semconv.DBCollectionName(db.Statement.Table),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+}
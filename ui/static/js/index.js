@@ -1,6 +1,20 @@
+// Headers for state-changing fetch calls. The server rejects them without
+// the CSRF token rendered into the page's meta tag.
+function JsonHeaders(){
+    return {
+        'Content-Type': 'application/json',
+        'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').getAttribute('content')
+    };
+}
+
+function Logout(){
+    document.querySelector('#logout-form').submit();
+}
+
 function Add(id, watchlist){
     fetch(`/watchlist`, {
         method: 'PUT',
+        headers: JsonHeaders(),
         body: JSON.stringify({
             id: id,
             watchlist: watchlist
@@ -25,6 +39,7 @@ function Add(id, watchlist){
 function Watched(id, watched){
     fetch(`/watchedlist`, {
         method: 'PUT',
+        headers: JsonHeaders(),
         body: JSON.stringify({
             id: id,
             watched: watched
@@ -85,8 +100,7 @@ function Film(id){
         
         watchlist.setAttribute('class', 'button');
         watchlist.setAttribute('id', 'watchlist-add-button');
-        const user_id = document.querySelector('#user_id')
-        if (film.users.includes(user_id.innerHTML)){
+        if (film.on_watchlist){
             watchlist.innerHTML = 'Remove from Watchlist';
             watchlist.setAttribute('onclick', `Add(${film.id}, true)`);
         }else{
@@ -99,7 +113,7 @@ function Film(id){
         
         watchedlist.setAttribute('class', 'button');
         watchedlist.setAttribute('id', 'watchedlist-add-button');
-        if (film.watchers.includes(user_id.innerHTML)){
+        if (film.watched){
             watchedlist.innerHTML = 'Remove from Watchedlist';
             watchedlist.setAttribute('onclick', `Watched(${film.id}, true)`);
         }else{
@@ -232,6 +246,7 @@ function Searched(){
     const film = document.querySelector('#search-film').value
     fetch(`/film/search`, {
     method : 'POST',
+    headers: JsonHeaders(),
     body: JSON.stringify({
         film : film
     })